@@ -1,24 +1,84 @@
 package client
 
 import (
-	"crypto/sha256"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
+	"yuki-client/compress"
 	"yuki-client/config"
 	"yuki-client/crypto"
+	"yuki-client/proto"
 	"yuki-client/tun"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// protocolVersion is the tunnel protocol version this client speaks
+	protocolVersion = 1
+	software        = "yuki-client windows"
 )
 
+// defaultKeepAlive is the ping interval in seconds when the config has none.
+// The server drops sessions that stay silent for 30 seconds by default.
+const defaultKeepAlive = 15
+
+// ErrDisconnected ends a session closed by Disconnect
+var ErrDisconnected = errors.New("disconnected by user")
+
+// ReconnectError ends a session the server asked to resume later, possibly
+// on another server
+type ReconnectError struct {
+	Reason        string
+	After         time.Duration
+	ServerAddress string
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("server asked to reconnect in %s: %s", e.After, e.Reason)
+}
+
+// DisconnectError ends a session the server closed on purpose. Unless Retry
+// is set, connecting again will not help.
+type DisconnectError struct {
+	Reason string
+	Retry  bool
+}
+
+func (e *DisconnectError) Error() string {
+	return "disconnected by server: " + e.Reason
+}
+
 type Client struct {
-	config     *config.Config
-	tunIface   tun.Interface
-	conn       net.Conn
-	cipher     *crypto.Cipher
-	connected  bool
-	stats      Stats
+	config        *config.Config
+	serverAddress string
+	// proxyOnly runs without a TUN interface; traffic comes in through the
+	// local proxies only
+	proxyOnly bool
+	tunIface  tun.Interface
+	gateway       net.IP
+	// ticket from the last handshake lets the next session take over the
+	// previous one instead of counting against the session limit
+	ticket []byte
+
+	mutex     sync.Mutex
+	cancel    context.CancelCauseFunc
+	connected bool
+	session   *session
+	stats     Stats
 }
 
 type Stats struct {
@@ -26,124 +86,416 @@ type Stats struct {
 	BytesDown int64
 	Connected time.Time
 	LastSeen  time.Time
+	// RTT and Jitter are measured with pings
+	RTT    time.Duration
+	Jitter time.Duration
+}
+
+// session is one gRPC tunnel stream and its cipher
+type session struct {
+	id     string
+	stream proto.TunnelService_ConnectClient
+	cipher *crypto.Cipher
+	// features were negotiated in the handshake
+	features uint64
+	// codec compresses frames when the server agreed to
+	// FEATURE_COMPRESSION; nil otherwise
+	codec *compress.Codec
+	// mutex serializes sends: the nonce sequence and the stream both need a
+	// single writer
+	mutex sync.Mutex
+	// started stamps pings; rtt is only used by the receiving goroutine
+	started time.Time
+	rtt     rttEstimator
+
+	flowsMutex sync.Mutex
+	flows      map[uint32]*flowConn
+	nextFlow   uint32
 }
 
 func New(cfg *config.Config) *Client {
 	return &Client{
-		config:    cfg,
-		connected: false,
+		config:        cfg,
+		serverAddress: cfg.ServerAddress,
+		proxyOnly:     cfg.Proxy.Enabled,
 	}
 }
 
-func (c *Client) Connect() error {
-	// Create cipher key from config
-	key := sha256.Sum256([]byte(c.config.Encryption))
-	cipher, err := crypto.NewCipher(key[:])
-	if err != nil {
-		return fmt.Errorf("cipher creation failed: %w", err)
+// SetServerAddress switches the server used by the next Run
+func (c *Client) SetServerAddress(address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.serverAddress = address
+}
+
+// Run connects to the server and relays packets until the session ends. The
+// TUN interface is created on the first run and kept between sessions; in
+// proxy mode there is none.
+func (c *Client) Run() error {
+	if !c.proxyOnly {
+		if err := c.setupTun(); err != nil {
+			return err
+		}
 	}
-	c.cipher = cipher
 
-	// Create TUN interface
-	tunIface := tun.NewTunInterface()
-	if err := tunIface.Create("Yuki Tunnel"); err != nil {
-		return fmt.Errorf("TUN interface creation failed: %w", err)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	c.mutex.Lock()
+	address := c.serverAddress
+	c.cancel = cancel
+	c.mutex.Unlock()
+
+	if address == "" {
+		return fmt.Errorf("server address not configured")
 	}
-	c.tunIface = tunIface
 
-	// Connect to server via TCP
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+	// For testing, ignore cert warnings
+	creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})
+	// HTTP/2 pings find a dead connection even while the stream is stuck
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds), grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                c.keepAliveInterval(),
+		Timeout:             2 * c.keepAliveInterval(),
+		PermitWithoutStream: true,
+	}))
 	if err != nil {
-		tunIface.Close()
 		return fmt.Errorf("connection failed: %w", err)
 	}
-	c.conn = conn
+	defer conn.Close()
 
-	// Send authentication
-	authMsg := map[string]string{
-		"client_id":     c.config.ClientID,
-		"client_secret": c.config.ClientSecret,
+	md := metadata.Pairs("client-id", c.config.ClientID, "client-secret", c.config.ClientSecret)
+	stream, err := proto.NewTunnelServiceClient(conn).Connect(metadata.NewOutgoingContext(ctx, md))
+	if err != nil {
+		return fmt.Errorf("connection failed: %w", err)
 	}
 
-	authData, _ := json.Marshal(authMsg)
-	if _, err := conn.Write(authData); err != nil {
-		conn.Close()
-		tunIface.Close()
-		return fmt.Errorf("auth send failed: %w", err)
+	handshake, hello, err := c.handshake(stream)
+	if err != nil {
+		return err
+	}
+	cipher, err := crypto.NewClientCipher(hello.Key)
+	if err != nil {
+		return fmt.Errorf("cipher creation failed: %w", err)
+	}
+	c.ticket = hello.Ticket
+	if c.proxyOnly {
+		if hello.Features&uint64(proto.Feature_FEATURE_FLOWS) == 0 {
+			return &DisconnectError{Reason: "server does not support flows, which proxy mode needs"}
+		}
+	} else {
+		c.configureTun(hello)
 	}
 
+	s := &session{
+		id:       handshake.SessionId,
+		stream:   stream,
+		cipher:   cipher,
+		features: hello.Features,
+		started:  time.Now(),
+		flows:    make(map[uint32]*flowConn),
+	}
+	if hello.Features&uint64(proto.Feature_FEATURE_COMPRESSION) != 0 {
+		s.codec = compress.NewCodec()
+	}
+	c.mutex.Lock()
 	c.connected = true
-	c.stats.Connected = time.Now()
-
-	// Start packet relay
-	go c.relayPackets()
-
-	return nil
-}
-
-func (c *Client) relayPackets() {
+	c.session = s
+	c.stats = Stats{Connected: time.Now(), LastSeen: time.Now()}
+	c.mutex.Unlock()
 	defer func() {
+		c.mutex.Lock()
 		c.connected = false
+		c.session = nil
+		c.mutex.Unlock()
+		s.closeFlows()
 	}()
+	log.Printf("✅ Сессия %s установлена", s.id)
 
-	buffer := make([]byte, 4096)
-	for c.connected {
-		// Read from TUN
-		n, err := c.tunIface.Read(buffer)
+	if c.tunIface != nil {
+		go c.readTun(ctx, cancel, s)
+	}
+	go c.keepAlive(ctx, cancel, s)
+
+	for {
+		tunnelFrame, err := stream.Recv()
 		if err != nil {
-			break
+			if cause := context.Cause(ctx); cause != nil {
+				return cause
+			}
+			return streamError(stream, err)
 		}
 
-		// Encrypt and send to server
-		encrypted, err := c.cipher.Encrypt(buffer[:n])
+		frame, err := cipher.DecryptFrame(tunnelFrame.Data)
 		if err != nil {
-			break
+			log.Printf("⚠️ Ошибка расшифровки: %v", err)
+			continue
 		}
-		if _, err := c.conn.Write(encrypted); err != nil {
-			break
+		if s.codec != nil {
+			frame.Type, frame.Data, err = s.codec.Decompress(frame.Type, frame.Data)
+			if err != nil {
+				log.Printf("⚠️ Ошибка распаковки: %v", err)
+				continue
+			}
 		}
+		c.touch()
 
-		c.stats.BytesUp += int64(len(encrypted))
+		switch frame.Type {
+		case 0: // Data frame
+			if c.tunIface == nil {
+				continue
+			}
+			if _, err := c.tunIface.Write(frame.Data); err != nil {
+				log.Printf("⚠️ Ошибка записи в TUN: %v", err)
+				continue
+			}
+			c.countDown(len(frame.Data))
 
-		// Read response from server
-		respBuffer := make([]byte, 4096)
-		c.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-		m, err := c.conn.Read(respBuffer)
-		if err != nil {
-			break
+		case 1: // Ping frame
+			// Echo the server's stamp so it can measure the round trip
+			s.send(&crypto.Frame{Type: 2, Length: uint32(len(frame.Data)), Data: frame.Data})
+
+		case 2: // Pong frame
+			c.pong(s, frame.Data)
+
+		case 4: // Flow frame
+			c.handleFlow(s, frame.Data)
+
+		case 3: // Control frame
+			if err := c.handleControl(frame.Data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handshake exchanges ClientHello and ServerHello
+func (c *Client) handshake(stream proto.TunnelService_ConnectClient) (*proto.TunnelFrame, *proto.ServerHello, error) {
+	data, err := protobuf.Marshal(&proto.ClientHello{
+		Version:  protocolVersion,
+		Features: uint64(proto.Feature_FEATURE_FLOWS | proto.Feature_FEATURE_COMPRESSION),
+		Software: software,
+		Ticket:   c.ticket,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := stream.Send(&proto.TunnelFrame{Data: data, Timestamp: time.Now().Unix()}); err != nil {
+		return nil, nil, streamError(stream, err)
+	}
+
+	frame, err := stream.Recv()
+	if err != nil {
+		return nil, nil, streamError(stream, err)
+	}
+
+	hello := &proto.ServerHello{}
+	if err := protobuf.Unmarshal(frame.Data, hello); err != nil {
+		return nil, nil, fmt.Errorf("malformed ServerHello: %w", err)
+	}
+	if hello.Version == 0 || hello.Version > protocolVersion {
+		return nil, nil, &DisconnectError{Reason: fmt.Sprintf("server chose unsupported protocol version %d", hello.Version)}
+	}
+
+	if skew := time.Since(time.UnixMilli(hello.ServerTime)); skew > time.Minute || skew < -time.Minute {
+		log.Printf("⚠️ Часы расходятся с сервером на %s", skew.Round(time.Second))
+	}
+	return frame, hello, nil
+}
+
+// setupTun creates the TUN interface once
+func (c *Client) setupTun() error {
+	if c.tunIface != nil {
+		return nil
+	}
+
+	tunIface := tun.NewTunInterface()
+	if err := tunIface.Create("Yuki Tunnel"); err != nil {
+		return fmt.Errorf("TUN interface creation failed: %w", err)
+	}
+	c.tunIface = tunIface
+	return nil
+}
+
+// configureTun applies the settings from the handshake, falling back to the
+// config file for anything the server left out
+func (c *Client) configureTun(hello *proto.ServerHello) {
+	settings := c.config.TunSettings
+
+	ip := net.ParseIP(settings.IP)
+	mask := net.IPMask(net.ParseIP(settings.Netmask).To4())
+	if len(hello.Addresses) > 0 {
+		if address, network, err := net.ParseCIDR(hello.Addresses[0]); err == nil {
+			ip, mask = address, network.Mask
 		}
+	}
+	if ip == nil {
+		ip = net.ParseIP("10.0.0.2")
+	}
+	if mask == nil {
+		mask = net.CIDRMask(24, 32)
+	}
 
-		// Decrypt and write to TUN
-		decrypted, err := c.cipher.Decrypt(respBuffer[:m])
+	c.gateway = net.ParseIP(hello.Gateway)
+	if c.gateway == nil {
+		c.gateway = net.ParseIP(settings.Gateway)
+	}
+	if c.gateway == nil {
+		c.gateway = net.ParseIP("10.0.0.1")
+	}
+
+	if err := c.tunIface.SetIP(ip, mask, c.gateway); err != nil {
+		log.Printf("⚠️ Failed to set IP address: %v", err)
+	}
+	log.Printf("🌐 Interface: %s (%s)", "Yuki Tunnel", ip)
+
+	dns := hello.Dns
+	if len(dns) == 0 {
+		dns = settings.DNS
+	}
+	c.applyConfig(&proto.ConfigUpdate{Dns: dns, Routes: hello.Routes, Mtu: hello.Mtu})
+}
+
+// readTun sends packets from the TUN interface to the server
+func (c *Client) readTun(ctx context.Context, cancel context.CancelCauseFunc, s *session) {
+	buffer := make([]byte, 65535)
+	for ctx.Err() == nil {
+		n, err := c.tunIface.Read(buffer)
 		if err != nil {
-			break
+			// WinTun reports an empty ring as an error
+			time.Sleep(10 * time.Millisecond)
+			continue
 		}
-		if _, err := c.tunIface.Write(decrypted); err != nil {
-			break
+
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		if err := s.send(&crypto.Frame{Type: 0, Length: uint32(n), Data: packet}); err != nil {
+			cancel(fmt.Errorf("send failed: %w", err))
+			return
 		}
 
-		c.stats.BytesDown += int64(len(decrypted))
+		c.countUp(n)
+	}
+}
+
+// keepAliveInterval is how often the server is pinged
+func (c *Client) keepAliveInterval() time.Duration {
+	if c.config.Advanced.KeepAlive <= 0 {
+		return defaultKeepAlive * time.Second
+	}
+	return time.Duration(c.config.Advanced.KeepAlive) * time.Second
+}
+
+// keepAlive pings the server and ends the session once it stops answering
+func (c *Client) keepAlive(ctx context.Context, cancel context.CancelCauseFunc, s *session) {
+	interval := c.keepAliveInterval()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(c.GetStats().LastSeen) > 3*interval {
+				cancel(errors.New("server is not responding"))
+				return
+			}
+			if err := s.send(s.pingFrame()); err != nil {
+				cancel(fmt.Errorf("ping failed: %w", err))
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) touch() {
+	c.mutex.Lock()
+	c.stats.LastSeen = time.Now()
+	c.mutex.Unlock()
+}
+
+func (c *Client) countUp(n int) {
+	c.mutex.Lock()
+	c.stats.BytesUp += int64(n)
+	c.mutex.Unlock()
+}
+
+func (c *Client) countDown(n int) {
+	c.mutex.Lock()
+	c.stats.BytesDown += int64(n)
+	c.mutex.Unlock()
+}
+
+func (s *session) send(frame *crypto.Frame) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Compress before the frame is encrypted and before any padding is added
+	if s.codec != nil {
+		compressed := *frame
+		compressed.Type, compressed.Data = s.codec.Compress(frame.Type, frame.Data)
+		compressed.Length = uint32(len(compressed.Data))
+		frame = &compressed
+	}
+
+	data, err := s.cipher.EncryptFrame(frame)
+	if err != nil {
+		return err
 	}
+
+	return s.stream.Send(&proto.TunnelFrame{
+		Data:      data,
+		Timestamp: time.Now().Unix(),
+		SessionId: s.id,
+	})
+}
+
+// streamError turns the status a session ended with into the error the
+// caller acts on
+func streamError(stream proto.TunnelService_ConnectClient, err error) error {
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.Unavailable:
+		// Refused during maintenance; the trailer says when to come back
+		trailer := stream.Trailer()
+		if retry := trailer.Get("yuki-retry-after"); len(retry) > 0 {
+			seconds, _ := strconv.ParseInt(retry[0], 10, 64)
+			reconnect := &ReconnectError{Reason: st.Message(), After: time.Duration(seconds) * time.Second}
+			if address := trailer.Get("yuki-server-address"); len(address) > 0 {
+				reconnect.ServerAddress = address[0]
+			}
+			return reconnect
+		}
+	case codes.Unauthenticated, codes.FailedPrecondition:
+		return &DisconnectError{Reason: st.Message()}
+	}
+	return err
 }
 
 func (c *Client) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.connected
 }
 
 func (c *Client) GetStats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.stats
 }
 
+// Disconnect ends the current session and removes the TUN interface
 func (c *Client) Disconnect() error {
-	c.connected = false
-	
-	if c.conn != nil {
-		c.conn.Close()
+	c.mutex.Lock()
+	if c.cancel != nil {
+		c.cancel(ErrDisconnected)
 	}
-	
+	c.mutex.Unlock()
+
 	if c.tunIface != nil {
 		c.tunIface.Close()
 	}
-	
+
 	return nil
 }
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"yuki-client/proto"
+
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// handleControl acts on a control frame from the server. A non-nil error
+// ends the session.
+func (c *Client) handleControl(payload []byte) error {
+	message := &proto.ControlMessage{}
+	if err := protobuf.Unmarshal(payload, message); err != nil {
+		log.Printf("⚠️ Неверное управляющее сообщение: %v", err)
+		return nil
+	}
+
+	switch m := message.Message.(type) {
+	case *proto.ControlMessage_Notice:
+		switch m.Notice.Level {
+		case proto.Notice_WARNING:
+			log.Printf("⚠️ Сообщение сервера: %s", m.Notice.Text)
+		case proto.Notice_CRITICAL:
+			log.Printf("🚨 Сообщение сервера: %s", m.Notice.Text)
+		default:
+			log.Printf("📢 Сообщение сервера: %s", m.Notice.Text)
+		}
+
+	case *proto.ControlMessage_QuotaWarning:
+		log.Printf("⚠️ Использовано %.2f из %.2f MB трафика",
+			float64(m.QuotaWarning.UsedBytes)/1024/1024,
+			float64(m.QuotaWarning.LimitBytes)/1024/1024)
+
+	case *proto.ControlMessage_ConfigUpdate:
+		log.Printf("🔧 Сервер обновил настройки туннеля")
+		c.applyConfig(m.ConfigUpdate)
+
+	case *proto.ControlMessage_Reconnect:
+		return &ReconnectError{
+			Reason:        m.Reconnect.Reason,
+			After:         time.Duration(m.Reconnect.RetryAfter) * time.Second,
+			ServerAddress: m.Reconnect.ServerAddress,
+		}
+
+	case *proto.ControlMessage_Disconnect:
+		return &DisconnectError{Reason: m.Disconnect.Reason, Retry: m.Disconnect.Retry}
+	}
+	return nil
+}
+
+// applyConfig changes the TUN settings the server pushed
+func (c *Client) applyConfig(update *proto.ConfigUpdate) {
+	if c.tunIface == nil {
+		return
+	}
+
+	if len(update.Dns) > 0 {
+		if err := c.tunIface.SetDNS(update.Dns); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+
+	if update.Mtu > 0 {
+		if err := c.tunIface.SetMTU(int(update.Mtu)); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+
+	for _, route := range update.Routes {
+		_, network, err := net.ParseCIDR(route)
+		if err != nil || network.IP.To4() == nil {
+			log.Printf("⚠️ Пропущен маршрут %q", route)
+			continue
+		}
+		if err := c.tunIface.AddRoute(network, c.gateway); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"yuki-client/crypto"
+	"yuki-client/proto"
+
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// flowWindow is the window each side of a TCP flow starts with; it is
+	// fixed by the protocol
+	flowWindow = 256 * 1024
+	// flowChunk is the largest data message the client sends
+	flowChunk = 16 * 1024
+	// udpFlowQueue is how many datagrams of a UDP flow may wait for Read
+	// before new ones are dropped
+	udpFlowQueue = 256
+)
+
+var (
+	// ErrNotConnected is returned by DialFlow without a live session
+	ErrNotConnected = errors.New("not connected")
+	// ErrFlowsUnsupported is returned by DialFlow when the server does not
+	// offer flow mode
+	ErrFlowsUnsupported = errors.New("server does not support flows")
+	errFlowClosed       = errors.New("flow closed")
+)
+
+// flowConn is a TCP connection or UDP association the server opened on the
+// client's behalf. It carries a stream for TCP and one datagram per Read
+// and Write for UDP.
+type flowConn struct {
+	id      uint32
+	network string
+	client  *Client
+	session *session
+	opened  chan struct{}
+
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	remote net.Addr
+	// queue holds received data; for UDP every element is one datagram
+	queue [][]byte
+	// credit is how much TCP data the server still accepts; consumed is
+	// what was read but not granted back yet
+	credit   int
+	consumed int
+	// err is set once the flow is over: io.EOF when the server closed it
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// DialFlow connects to address through the server without going through
+// the TUN interface. The client terminates the connection itself, which
+// avoids carrying TCP inside the tunnel's TCP stream.
+func (c *Client) DialFlow(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "udp" {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	c.mutex.Lock()
+	s := c.session
+	c.mutex.Unlock()
+	if s == nil {
+		return nil, ErrNotConnected
+	}
+	if s.features&uint64(proto.Feature_FEATURE_FLOWS) == 0 {
+		return nil, ErrFlowsUnsupported
+	}
+
+	f := &flowConn{
+		network: network,
+		client:  c,
+		session: s,
+		opened:  make(chan struct{}),
+		credit:  flowWindow,
+	}
+	f.cond = sync.NewCond(&f.mutex)
+
+	s.flowsMutex.Lock()
+	if s.flows == nil {
+		s.flowsMutex.Unlock()
+		return nil, ErrNotConnected
+	}
+	s.nextFlow++
+	f.id = s.nextFlow
+	s.flows[f.id] = f
+	s.flowsMutex.Unlock()
+
+	err := s.sendFlow(&proto.FlowMessage{
+		FlowId:  f.id,
+		Message: &proto.FlowMessage_Open{Open: &proto.FlowOpen{Network: network, Address: address}},
+	})
+	if err != nil {
+		f.fail(err)
+		return nil, err
+	}
+
+	select {
+	case <-f.opened:
+	case <-ctx.Done():
+		f.Close()
+		return nil, ctx.Err()
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.remote == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: f.err}
+	}
+	return f, nil
+}
+
+// handleFlow acts on a flow frame from the server
+func (c *Client) handleFlow(s *session, payload []byte) {
+	message := &proto.FlowMessage{}
+	if err := protobuf.Unmarshal(payload, message); err != nil {
+		log.Printf("⚠️ Неверное сообщение потока: %v", err)
+		return
+	}
+
+	s.flowsMutex.Lock()
+	f := s.flows[message.FlowId]
+	s.flowsMutex.Unlock()
+	if f == nil {
+		return
+	}
+
+	switch m := message.Message.(type) {
+	case *proto.FlowMessage_Opened:
+		f.mutex.Lock()
+		if f.err == nil && f.remote == nil {
+			f.remote = flowAddr(f.network, m.Opened.RemoteAddress)
+			close(f.opened)
+		}
+		f.mutex.Unlock()
+
+	case *proto.FlowMessage_Data:
+		f.mutex.Lock()
+		if f.network == "tcp" || len(f.queue) < udpFlowQueue {
+			f.queue = append(f.queue, m.Data)
+		}
+		f.mutex.Unlock()
+		f.cond.Broadcast()
+		c.countDown(len(m.Data))
+
+	case *proto.FlowMessage_Window:
+		f.mutex.Lock()
+		f.credit += int(m.Window)
+		f.mutex.Unlock()
+		f.cond.Broadcast()
+
+	case *proto.FlowMessage_Close:
+		err := io.EOF
+		if m.Close.Error != "" {
+			err = errors.New(m.Close.Error)
+		}
+		f.fail(err)
+	}
+}
+
+func (f *flowConn) Read(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for len(f.queue) == 0 && f.err == nil {
+		if err := f.wait(f.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.queue) == 0 {
+		return 0, f.err
+	}
+
+	var n int
+	if f.network == "udp" {
+		n = copy(b, f.queue[0])
+		f.queue = f.queue[1:]
+		return n, nil
+	}
+
+	n = copy(b, f.queue[0])
+	if n == len(f.queue[0]) {
+		f.queue = f.queue[1:]
+	} else {
+		f.queue[0] = f.queue[0][n:]
+	}
+
+	// Grant the window back in batches rather than per read
+	f.consumed += n
+	if f.consumed >= flowWindow/4 && f.err == nil {
+		grant := f.consumed
+		f.consumed = 0
+		go f.session.sendFlow(&proto.FlowMessage{FlowId: f.id, Message: &proto.FlowMessage_Window{Window: uint32(grant)}})
+	}
+	return n, nil
+}
+
+func (f *flowConn) Write(b []byte) (int, error) {
+	if f.network == "udp" {
+		return f.send(b)
+	}
+
+	written := 0
+	for written < len(b) {
+		f.mutex.Lock()
+		for f.credit <= 0 && f.err == nil {
+			if err := f.wait(f.writeDeadline); err != nil {
+				f.mutex.Unlock()
+				return written, err
+			}
+		}
+		if f.err != nil {
+			f.mutex.Unlock()
+			return written, errFlowClosed
+		}
+		size := min(len(b)-written, f.credit, flowChunk)
+		f.credit -= size
+		f.mutex.Unlock()
+
+		if _, err := f.send(b[written : written+size]); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+func (f *flowConn) send(b []byte) (int, error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	err := f.session.sendFlow(&proto.FlowMessage{FlowId: f.id, Message: &proto.FlowMessage_Data{Data: data}})
+	if err != nil {
+		return 0, err
+	}
+	f.client.countUp(len(b))
+	return len(b), nil
+}
+
+// wait blocks on the condition until it is signalled or deadline passes;
+// must be called with mutex held
+func (f *flowConn) wait(deadline time.Time) error {
+	if deadline.IsZero() {
+		f.cond.Wait()
+		return nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.AfterFunc(remaining, f.cond.Broadcast)
+	f.cond.Wait()
+	timer.Stop()
+	return nil
+}
+
+// Close ends the flow and tells the server
+func (f *flowConn) Close() error {
+	if f.fail(errFlowClosed) {
+		f.session.sendFlow(&proto.FlowMessage{FlowId: f.id, Message: &proto.FlowMessage_Close{Close: &proto.FlowClose{}}})
+	}
+	return nil
+}
+
+// fail ends the flow with err and reports whether it was still open
+func (f *flowConn) fail(err error) bool {
+	f.session.flowsMutex.Lock()
+	if f.session.flows[f.id] == f {
+		delete(f.session.flows, f.id)
+	}
+	f.session.flowsMutex.Unlock()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.err != nil {
+		return false
+	}
+	f.err = err
+	if f.remote == nil {
+		close(f.opened)
+	}
+	f.cond.Broadcast()
+	return true
+}
+
+func (f *flowConn) LocalAddr() net.Addr {
+	return flowAddr(f.network, "")
+}
+
+func (f *flowConn) RemoteAddr() net.Addr {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.remote
+}
+
+func (f *flowConn) SetDeadline(t time.Time) error {
+	f.SetReadDeadline(t)
+	return f.SetWriteDeadline(t)
+}
+
+func (f *flowConn) SetReadDeadline(t time.Time) error {
+	f.mutex.Lock()
+	f.readDeadline = t
+	f.mutex.Unlock()
+	f.cond.Broadcast()
+	return nil
+}
+
+func (f *flowConn) SetWriteDeadline(t time.Time) error {
+	f.mutex.Lock()
+	f.writeDeadline = t
+	f.mutex.Unlock()
+	f.cond.Broadcast()
+	return nil
+}
+
+func flowAddr(network, address string) net.Addr {
+	if network == "udp" {
+		addr, _ := net.ResolveUDPAddr("udp", address)
+		if addr == nil {
+			addr = &net.UDPAddr{}
+		}
+		return addr
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", address)
+	if addr == nil {
+		addr = &net.TCPAddr{}
+	}
+	return addr
+}
+
+// sendFlow sends a flow frame to the server
+func (s *session) sendFlow(message *proto.FlowMessage) error {
+	payload, err := protobuf.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return s.send(&crypto.Frame{Type: 4, Length: uint32(len(payload)), Data: payload})
+}
+
+// closeFlows ends every flow of a session that is over
+func (s *session) closeFlows() {
+	s.flowsMutex.Lock()
+	flows := s.flows
+	s.flows = nil
+	s.flowsMutex.Unlock()
+
+	for _, f := range flows {
+		f.fail(ErrNotConnected)
+	}
+}
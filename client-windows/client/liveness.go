@@ -0,0 +1,58 @@
+package client
+
+import (
+	"encoding/binary"
+	"time"
+
+	"yuki-client/crypto"
+)
+
+// rttEstimator smooths round-trip samples the way TCP does and tracks
+// jitter as the mean deviation between consecutive samples (RFC 3550)
+type rttEstimator struct {
+	rtt    time.Duration
+	jitter time.Duration
+	last   time.Duration
+}
+
+func (e *rttEstimator) add(sample time.Duration) {
+	if e.last == 0 {
+		e.rtt = sample
+	} else {
+		e.rtt += (sample - e.rtt) / 8
+		e.jitter += (abs(sample-e.last) - e.jitter) / 16
+	}
+	e.last = sample
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// pingFrame is a ping stamped with the session's age. The server echoes the
+// stamp in its pong, so the round trip needs no synchronized clocks.
+func (s *session) pingFrame() *crypto.Frame {
+	stamp := binary.BigEndian.AppendUint64(nil, uint64(time.Since(s.started)))
+	return &crypto.Frame{Type: 1, Length: uint32(len(stamp)), Data: stamp}
+}
+
+// pong records the round trip of an answered ping. Older servers answer
+// without the stamp.
+func (c *Client) pong(s *session, data []byte) {
+	if len(data) != 8 {
+		return
+	}
+	sample := time.Since(s.started) - time.Duration(binary.BigEndian.Uint64(data))
+	if sample <= 0 {
+		return
+	}
+	s.rtt.add(sample)
+
+	c.mutex.Lock()
+	c.stats.RTT = s.rtt.rtt
+	c.stats.Jitter = s.rtt.jitter
+	c.mutex.Unlock()
+}
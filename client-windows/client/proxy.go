@@ -0,0 +1,453 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect      = 0x01
+	socksUDPAssociate = 0x03
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksNotAllowed          = 0x02
+	socksNetworkUnreachable  = 0x03
+	socksConnectionRefused   = 0x05
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+)
+
+// proxyDialTimeout bounds opening a flow for a proxied connection
+const proxyDialTimeout = 15 * time.Second
+
+// hopHeaders are connection-specific and not forwarded by the HTTP proxy
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ServeProxy accepts SOCKS5 connections on socksAddress and HTTP proxy
+// requests on httpAddress and carries them as flows of the current session.
+// Either address may be empty to leave that proxy off. The listeners outlive
+// sessions; requests made while reconnecting fail.
+func (c *Client) ServeProxy(socksAddress, httpAddress string) error {
+	if socksAddress != "" {
+		listener, err := net.Listen("tcp", socksAddress)
+		if err != nil {
+			return err
+		}
+		log.Printf("🧦 SOCKS5 прокси: %s", listener.Addr())
+		go c.serveSOCKS(listener)
+	}
+
+	if httpAddress != "" {
+		listener, err := net.Listen("tcp", httpAddress)
+		if err != nil {
+			return err
+		}
+		log.Printf("🌐 HTTP прокси: %s", listener.Addr())
+		server := &http.Server{
+			Handler:           &httpProxy{client: c},
+			ReadHeaderTimeout: proxyDialTimeout,
+		}
+		go server.Serve(listener)
+	}
+	return nil
+}
+
+func (c *Client) dialProxy(network, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	return c.DialFlow(ctx, network, address)
+}
+
+func (c *Client) serveSOCKS(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("⚠️ SOCKS5 прокси остановлен: %v", err)
+			return
+		}
+		go c.handleSOCKS(conn)
+	}
+}
+
+// handleSOCKS serves one SOCKS5 client connection
+func (c *Client) handleSOCKS(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil || header[0] != socksVersion {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	// The proxy only listens locally, so no authentication is offered
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil || method != socksNoAuth {
+		return
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(reader, request); err != nil || request[0] != socksVersion {
+		return
+	}
+	address, err := readSOCKSAddr(reader)
+	if err != nil {
+		writeSOCKSReply(conn, socksAddressNotSupported, nil)
+		return
+	}
+
+	switch request[1] {
+	case socksConnect:
+		remote, err := c.dialProxy("tcp", address)
+		if err != nil {
+			writeSOCKSReply(conn, socksReplyCode(err), nil)
+			return
+		}
+		defer remote.Close()
+
+		if err := writeSOCKSReply(conn, socksSucceeded, remote.LocalAddr()); err != nil {
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		relay(&bufferedConn{Conn: conn, reader: reader}, remote)
+
+	case socksUDPAssociate:
+		c.associateUDP(conn)
+
+	default:
+		writeSOCKSReply(conn, socksCommandNotSupported, nil)
+	}
+}
+
+// associateUDP relays datagrams for a SOCKS5 UDP ASSOCIATE until the
+// control connection closes. Every destination gets its own UDP flow.
+func (c *Client) associateUDP(control net.Conn) {
+	host, _, _ := net.SplitHostPort(control.LocalAddr().String())
+	packetConn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		writeSOCKSReply(control, socksNetworkUnreachable, nil)
+		return
+	}
+	defer packetConn.Close()
+
+	if err := writeSOCKSReply(control, socksSucceeded, packetConn.LocalAddr()); err != nil {
+		return
+	}
+	control.SetDeadline(time.Time{})
+
+	// Only the host of the control connection may use the association
+	peerHost, _, _ := net.SplitHostPort(control.RemoteAddr().String())
+	peerIP := net.ParseIP(peerHost)
+
+	var mutex sync.Mutex
+	flows := make(map[string]net.Conn)
+	defer func() {
+		mutex.Lock()
+		for _, flow := range flows {
+			flow.Close()
+		}
+		mutex.Unlock()
+	}()
+
+	go func() {
+		// The association lasts as long as the control connection
+		io.Copy(io.Discard, control)
+		packetConn.Close()
+	}()
+
+	buffer := make([]byte, 65535)
+	for {
+		n, source, err := packetConn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		udpSource, ok := source.(*net.UDPAddr)
+		if !ok || !udpSource.IP.Equal(peerIP) {
+			continue
+		}
+
+		// RSV (2), FRAG (1), then the destination; fragments are dropped
+		if n < 4 || buffer[2] != 0 {
+			continue
+		}
+		reader := bufio.NewReader(bytes.NewReader(buffer[3:n]))
+		address, err := readSOCKSAddr(reader)
+		if err != nil {
+			continue
+		}
+		payload, _ := io.ReadAll(reader)
+
+		mutex.Lock()
+		flow, exists := flows[address]
+		mutex.Unlock()
+		if !exists {
+			flow, err = c.dialProxy("udp", address)
+			if err != nil {
+				log.Printf("⚠️ UDP поток к %s: %v", address, err)
+				continue
+			}
+			mutex.Lock()
+			flows[address] = flow
+			mutex.Unlock()
+
+			go func(address string, flow net.Conn, client net.Addr) {
+				defer func() {
+					mutex.Lock()
+					if flows[address] == flow {
+						delete(flows, address)
+					}
+					mutex.Unlock()
+					flow.Close()
+				}()
+
+				header := socksUDPHeader(address)
+				reply := make([]byte, 65535)
+				for {
+					n, err := flow.Read(reply)
+					if err != nil {
+						return
+					}
+					packetConn.WriteTo(append(header[:len(header):len(header)], reply[:n]...), client)
+				}
+			}(address, flow, source)
+		}
+
+		flow.Write(payload)
+	}
+}
+
+// readSOCKSAddr reads ATYP, DST.ADDR and DST.PORT and returns host:port
+func readSOCKSAddr(reader *bufio.Reader) (string, error) {
+	addressType, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	var host string
+	switch addressType {
+	case socksIPv4, socksIPv6:
+		size := net.IPv4len
+		if addressType == socksIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", errors.New("unsupported address type")
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksUDPHeader is the header of a datagram relayed back from address
+func socksUDPHeader(address string) []byte {
+	header := []byte{0, 0, 0}
+	host, port, _ := net.SplitHostPort(address)
+	portNumber, _ := strconv.Atoi(port)
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		header = append(append(header, socksIPv4), ip.To4()...)
+	case ip != nil:
+		header = append(append(header, socksIPv6), ip.To16()...)
+	default:
+		header = append(append(header, socksDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(header, uint16(portNumber))
+}
+
+func writeSOCKSReply(conn net.Conn, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+	var ip net.IP
+	var port int
+	switch addr := bound.(type) {
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(reply[4:8], ip4)
+	}
+	binary.BigEndian.PutUint16(reply[8:], uint16(port))
+	_, err := conn.Write(reply)
+	return err
+}
+
+// socksReplyCode maps a failed flow to a SOCKS5 reply
+func socksReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, ErrNotConnected), errors.Is(err, ErrFlowsUnsupported):
+		return socksNetworkUnreachable
+	case strings.Contains(err.Error(), "blocked by policy"):
+		return socksNotAllowed
+	}
+	return socksConnectionRefused
+}
+
+// httpProxy serves CONNECT tunnels and forwards plain HTTP requests
+type httpProxy struct {
+	client    *Client
+	transport *http.Transport
+	once      sync.Once
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+
+	if r.URL.Host == "" {
+		http.Error(w, "yuki: not a proxy request", http.StatusBadRequest)
+		return
+	}
+
+	p.once.Do(func() {
+		p.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return p.client.DialFlow(ctx, "tcp", address)
+			},
+			MaxIdleConns:    100,
+			IdleConnTimeout: 90 * time.Second,
+		}
+	})
+
+	request := r.Clone(r.Context())
+	request.RequestURI = ""
+	removeHopHeaders(request.Header)
+
+	response, err := p.transport.RoundTrip(request)
+	if err != nil {
+		http.Error(w, "yuki: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+
+	removeHopHeaders(response.Header)
+	for key, values := range response.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	remote, err := p.client.dialProxy("tcp", r.Host)
+	if err != nil {
+		http.Error(w, "yuki: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer remote.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "yuki: hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	relay(&bufferedConn{Conn: conn, reader: buffered.Reader}, remote)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, name := range header.Values("Connection") {
+		for _, field := range strings.Split(name, ",") {
+			header.Del(strings.TrimSpace(field))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// bufferedConn reads through a reader that may already hold bytes the
+// client sent after its request
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// relay copies between two connections until either side closes
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,265 @@
+// Package compress shrinks tunnel frame payloads with zstd. Each session
+// has a Codec that learns which kinds of traffic do not compress, such as
+// TLS and QUIC, and stops trying on them.
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Flag is set in the frame type of frames whose data is compressed
+const Flag = 0x80
+
+const (
+	// minSize is the smallest payload worth compressing
+	minSize = 128
+	// maxSize bounds decompressed payloads so a peer cannot make the
+	// receiver allocate without limit
+	maxSize = 1 << 20
+	// maxBackoff is how many payloads of a class are skipped at most after
+	// it failed to compress
+	maxBackoff = 64
+	// maxClasses bounds the traffic classes a codec remembers
+	maxClasses = 4096
+)
+
+var (
+	ErrCorrupt = errors.New("corrupt compressed frame")
+
+	setupOnce sync.Once
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+
+	// totals sums the statistics of every codec
+	totalsMutex sync.Mutex
+	totals      Stats
+)
+
+// Stats describe how well compression worked so far
+type Stats struct {
+	// Compressed payloads were sent compressed; Incompressible ones were
+	// tried but did not get smaller; Skipped ones were not tried
+	Compressed     int64 `json:"compressed"`
+	Incompressible int64 `json:"incompressible"`
+	Skipped        int64 `json:"skipped"`
+	// BytesIn and BytesOut are the sizes of compressed payloads before and
+	// after compression
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Ratio is BytesOut / BytesIn
+	Ratio float64 `json:"ratio"`
+	// CompressMillis and DecompressMillis are the CPU time spent
+	CompressMillis   float64 `json:"compress_ms"`
+	DecompressMillis float64 `json:"decompress_ms"`
+
+	compressTime   time.Duration
+	decompressTime time.Duration
+}
+
+func (s *Stats) add(other Stats) {
+	s.Compressed += other.Compressed
+	s.Incompressible += other.Incompressible
+	s.Skipped += other.Skipped
+	s.BytesIn += other.BytesIn
+	s.BytesOut += other.BytesOut
+	s.compressTime += other.compressTime
+	s.decompressTime += other.decompressTime
+}
+
+func (s Stats) report() Stats {
+	if s.BytesIn > 0 {
+		s.Ratio = float64(s.BytesOut) / float64(s.BytesIn)
+	}
+	s.CompressMillis = float64(s.compressTime) / float64(time.Millisecond)
+	s.DecompressMillis = float64(s.decompressTime) / float64(time.Millisecond)
+	return s
+}
+
+// Totals returns the statistics of all codecs together
+func Totals() Stats {
+	totalsMutex.Lock()
+	defer totalsMutex.Unlock()
+	return totals.report()
+}
+
+func setup() {
+	setupOnce.Do(func() {
+		// EncodeAll and DecodeAll are safe for concurrent use, so all
+		// sessions share one encoder and decoder
+		encoder, _ = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderCRC(false),
+			zstd.WithLowerEncoderMem(true))
+		decoder, _ = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(maxSize),
+			zstd.WithDecoderLowmem(true))
+	})
+}
+
+// backoff tracks a traffic class that did not compress
+type backoff struct {
+	skip    int
+	penalty int
+}
+
+// Codec compresses the payloads of one session. Compress and Decompress
+// may be called concurrently with each other but not with themselves.
+type Codec struct {
+	classes map[uint32]*backoff
+
+	mutex sync.Mutex
+	stats Stats
+}
+
+func NewCodec() *Codec {
+	setup()
+	return &Codec{classes: make(map[uint32]*backoff)}
+}
+
+// Compress returns the frame type and data to send. The data is compressed
+// and Flag set in the type when that makes it smaller.
+func (c *Codec) Compress(frameType byte, data []byte) (byte, []byte) {
+	if len(data) < minSize {
+		return frameType, data
+	}
+
+	class, encrypted := classify(frameType, data)
+	if encrypted {
+		c.count(func(stats *Stats) { stats.Skipped++ })
+		return frameType, data
+	}
+	state := c.classes[class]
+	if state != nil && state.skip > 0 {
+		state.skip--
+		c.count(func(stats *Stats) { stats.Skipped++ })
+		return frameType, data
+	}
+
+	started := time.Now()
+	compressed := encoder.EncodeAll(data, make([]byte, 0, len(data)))
+	elapsed := time.Since(started)
+
+	// Sending the result must save at least a sixteenth
+	if len(compressed) > len(data)-len(data)/16 {
+		if state == nil {
+			if len(c.classes) >= maxClasses {
+				clear(c.classes)
+			}
+			state = &backoff{}
+			c.classes[class] = state
+		}
+		state.penalty = min(max(state.penalty*2, 1), maxBackoff)
+		state.skip = state.penalty
+		c.count(func(stats *Stats) {
+			stats.Incompressible++
+			stats.compressTime += elapsed
+		})
+		return frameType, data
+	}
+
+	if state != nil {
+		delete(c.classes, class)
+	}
+	c.count(func(stats *Stats) {
+		stats.Compressed++
+		stats.BytesIn += int64(len(data))
+		stats.BytesOut += int64(len(compressed))
+		stats.compressTime += elapsed
+	})
+	return frameType | Flag, compressed
+}
+
+// Decompress undoes Compress. Frames without Flag are returned as they are.
+func (c *Codec) Decompress(frameType byte, data []byte) (byte, []byte, error) {
+	if frameType&Flag == 0 {
+		return frameType, data, nil
+	}
+
+	started := time.Now()
+	plain, err := decoder.DecodeAll(data, nil)
+	if err != nil || len(plain) > maxSize {
+		return 0, nil, ErrCorrupt
+	}
+	elapsed := time.Since(started)
+	c.count(func(stats *Stats) { stats.decompressTime += elapsed })
+	return frameType &^ Flag, plain, nil
+}
+
+// Stats returns the codec's statistics
+func (c *Codec) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats.report()
+}
+
+func (c *Codec) count(update func(stats *Stats)) {
+	var delta Stats
+	update(&delta)
+
+	c.mutex.Lock()
+	c.stats.add(delta)
+	c.mutex.Unlock()
+
+	totalsMutex.Lock()
+	totals.add(delta)
+	totalsMutex.Unlock()
+}
+
+// classify groups payloads that likely compress alike: packets by protocol
+// and service port, other frames by type. It also reports payloads that
+// are already encrypted: TLS records and QUIC.
+func classify(frameType byte, data []byte) (uint32, bool) {
+	if frameType != 0 || len(data) < 20 {
+		return 1<<16 | uint32(frameType), false
+	}
+
+	var protocol byte
+	var payload []byte
+	switch data[0] >> 4 {
+	case 4:
+		headerLength := int(data[0]&0x0f) * 4
+		if headerLength < 20 || len(data) < headerLength {
+			return 0, false
+		}
+		protocol, payload = data[9], data[headerLength:]
+	case 6:
+		if len(data) < 40 {
+			return 0, false
+		}
+		protocol, payload = data[6], data[40:]
+	default:
+		return 0, false
+	}
+
+	if len(payload) < 4 {
+		return uint32(protocol) << 16, false
+	}
+	source := binary.BigEndian.Uint16(payload[0:2])
+	destination := binary.BigEndian.Uint16(payload[2:4])
+	// The lower port is usually the service
+	port := min(source, destination)
+	class := uint32(protocol)<<16 | uint32(port)
+
+	switch protocol {
+	case 6: // TCP
+		if len(payload) < 20 {
+			return class, false
+		}
+		offset := int(payload[12]>>4) * 4
+		if offset < 20 || len(payload) < offset+3 {
+			return class, false
+		}
+		record := payload[offset:]
+		// A TLS record: content type 20-23, version 3.x
+		return class, record[0] >= 20 && record[0] <= 23 && record[1] == 3
+	case 17: // UDP
+		return class, port == 443
+	}
+	return class, false
+}
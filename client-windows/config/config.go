@@ -5,6 +5,12 @@ import (
 	"os"
 )
 
+// Local proxy addresses used when the config leaves them empty
+const (
+	DefaultSOCKSAddress = "127.0.0.1:1080"
+	DefaultHTTPAddress  = "127.0.0.1:8080"
+)
+
 type Config struct {
 	ServerAddress string `json:"server_address"`
 	ClientID      string `json:"client_id"`
@@ -26,6 +32,14 @@ type Config struct {
 		AutoStart    bool `json:"auto_start"`
 		KillSwitch   bool `json:"kill_switch"`
 	} `json:"advanced"`
+	
+	// Proxy runs the client without a TUN adapter or administrator rights:
+	// applications reach the tunnel through local SOCKS5 and HTTP proxies
+	Proxy struct {
+		Enabled      bool   `json:"enabled"`
+		SOCKSAddress string `json:"socks_address"`
+		HTTPAddress  string `json:"http_address"`
+	} `json:"proxy"`
 }
 
 func Load(path string) (*Config, error) {
@@ -81,5 +95,14 @@ func Default() *Config {
 			AutoStart:  false,
 			KillSwitch: false,
 		},
+		Proxy: struct {
+			Enabled      bool   `json:"enabled"`
+			SOCKSAddress string `json:"socks_address"`
+			HTTPAddress  string `json:"http_address"`
+		}{
+			Enabled:      false,
+			SOCKSAddress: DefaultSOCKSAddress,
+			HTTPAddress:  DefaultHTTPAddress,
+		},
 	}
 }
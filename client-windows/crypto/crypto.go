@@ -2,7 +2,6 @@ package crypto
 
 import (
 	"crypto/cipher"
-	"crypto/rand"
 	"crypto/subtle"
 	"encoding/binary"
 	"errors"
@@ -25,12 +24,15 @@ type Cipher struct {
 }
 
 type Frame struct {
-	Type   uint8  // 0=data, 1=ping, 2=pong
+	Type   uint8  // 0=data, 1=ping, 2=pong, 3=control (proto.ControlMessage)
 	Length uint32
 	Data   []byte
 }
 
-func NewCipher(key []byte) (*Cipher, error) {
+// NewClientCipher creates the client side of a session cipher. The nonce
+// scheme matches the server's: the client sends even nonces and receives
+// odd ones, each side stepping by 2.
+func NewClientCipher(key []byte) (*Cipher, error) {
 	if len(key) != KeySize {
 		return nil, errors.New("invalid key size")
 	}
@@ -42,19 +44,13 @@ func NewCipher(key []byte) (*Cipher, error) {
 
 	c := &Cipher{aead: aead}
 	copy(c.key[:], key)
-	
-	if _, err := rand.Read(c.sendNonce[:]); err != nil {
-		return nil, err
-	}
-	if _, err := rand.Read(c.recvNonce[:]); err != nil {
-		return nil, err
-	}
+	c.recvNonce[NonceSize-1] = 0x01
 
 	return c, nil
 }
 
 func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
-	incrementNonce(c.sendNonce[:])
+	incrementNonceBy(c.sendNonce[:], 2)
 	
 	ciphertext := c.aead.Seal(nil, c.sendNonce[:], plaintext, nil)
 	
@@ -73,15 +69,10 @@ func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
 	nonce := data[:NonceSize]
 	ciphertext := data[NonceSize:]
 	
-	expectedNonce := c.recvNonce
-	incrementNonce(expectedNonce[:])
-	
-	if subtle.ConstantTimeCompare(nonce, expectedNonce[:]) != 1 {
-		return nil, errors.New("invalid nonce sequence")
+	if err := c.verifyAndUpdateReceiveNonce(nonce); err != nil {
+		return nil, fmt.Errorf("invalid nonce sequence: %w", err)
 	}
 	
-	copy(c.recvNonce[:], nonce)
-	
 	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
 		return nil, fmt.Errorf("decryption failed: %w", err)
@@ -90,6 +81,20 @@ func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// verifyAndUpdateReceiveNonce accepts the next nonces in sequence, with the
+// same tolerance for skipped frames as the server
+func (c *Cipher) verifyAndUpdateReceiveNonce(nonce []byte) error {
+	expected := c.recvNonce
+	for i := 0; i < 10; i++ {
+		incrementNonceBy(expected[:], 2)
+		if subtle.ConstantTimeCompare(nonce, expected[:]) == 1 {
+			copy(c.recvNonce[:], nonce)
+			return nil
+		}
+	}
+	return errors.New("nonce too far ahead or replay detected")
+}
+
 func (c *Cipher) EncryptFrame(frame *Frame) ([]byte, error) {
 	frameData := make([]byte, 5+len(frame.Data))
 	frameData[0] = frame.Type
@@ -142,11 +147,11 @@ func (c *Cipher) DecryptFrame(data []byte) (*Frame, error) {
 	return frame, nil
 }
 
-func incrementNonce(nonce []byte) {
-	for i := len(nonce) - 1; i >= 0; i-- {
-		nonce[i]++
-		if nonce[i] != 0 {
-			break
-		}
+func incrementNonceBy(nonce []byte, increment int) {
+	carry := increment
+	for i := len(nonce) - 1; i >= 0 && carry > 0; i-- {
+		sum := int(nonce[i]) + carry
+		nonce[i] = byte(sum & 0xFF)
+		carry = sum >> 8
 	}
 }
@@ -3,6 +3,16 @@ module yuki-client
 go 1.23
 
 require (
+	github.com/klauspost/compress v1.18.0
 	golang.org/x/crypto v0.19.0
 	golang.org/x/sys v0.17.0
+	google.golang.org/grpc v1.60.1
+	google.golang.org/protobuf v1.32.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.16.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20231002182017-d307bd883b97 // indirect
 )
@@ -280,7 +280,54 @@ func (w *WinTun) SetIP(ip net.IP, mask net.IPMask, gateway net.IP) error {
 	return nil
 }
 
+// SetDNS replaces the interface's DNS servers
+func (w *WinTun) SetDNS(servers []string) error {
+	return setDNS("Yuki Tunnel", servers)
+}
+
+func (w *WinTun) SetMTU(mtu int) error {
+	return setMTU("Yuki Tunnel", mtu)
+}
+
+// AddRoute sends route through the tunnel
+func (w *WinTun) AddRoute(route *net.IPNet, gateway net.IP) error {
+	return addRoute(route, gateway)
+}
+
 func (w *WinTun) runNetshCommand(cmd string) error {
+	return runCommand(cmd)
+}
+
+func setDNS(name string, servers []string) error {
+	for i, server := range servers {
+		cmd := fmt.Sprintf(`netsh interface ip set dns name="%s" static %s primary`, name, server)
+		if i > 0 {
+			cmd = fmt.Sprintf(`netsh interface ip add dns name="%s" %s index=%d`, name, server, i+1)
+		}
+		if err := runCommand(cmd); err != nil {
+			return fmt.Errorf("failed to set DNS: %w", err)
+		}
+	}
+	return nil
+}
+
+func setMTU(name string, mtu int) error {
+	cmd := fmt.Sprintf(`netsh interface ipv4 set subinterface "%s" mtu=%d store=active`, name, mtu)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to set MTU: %w", err)
+	}
+	return nil
+}
+
+func addRoute(route *net.IPNet, gateway net.IP) error {
+	cmd := fmt.Sprintf(`route add %s mask %s %s metric 1`, route.IP, net.IP(route.Mask), gateway)
+	if err := runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to add route %s: %w", route, err)
+	}
+	return nil
+}
+
+func runCommand(cmd string) error {
 	var si syscall.StartupInfo
 	var pi syscall.ProcessInformation
 	
@@ -401,6 +448,18 @@ func (t *TAPInterface) SetIP(ip net.IP, mask net.IPMask, gateway net.IP) error {
 	return nil
 }
 
+func (t *TAPInterface) SetDNS(servers []string) error {
+	return setDNS(t.name, servers)
+}
+
+func (t *TAPInterface) SetMTU(mtu int) error {
+	return setMTU(t.name, mtu)
+}
+
+func (t *TAPInterface) AddRoute(route *net.IPNet, gateway net.IP) error {
+	return addRoute(route, gateway)
+}
+
 // TUN interface abstraction
 type Interface interface {
 	Create(name string) error
@@ -408,6 +467,9 @@ type Interface interface {
 	Write(buf []byte) (int, error) 
 	Close() error
 	SetIP(ip net.IP, mask net.IPMask, gateway net.IP) error
+	SetDNS(servers []string) error
+	SetMTU(mtu int) error
+	AddRoute(route *net.IPNet, gateway net.IP) error
 }
 
 func NewTunInterface() Interface {
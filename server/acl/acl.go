@@ -0,0 +1,550 @@
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultPolicyID names the policy seeded on first start
+const DefaultPolicyID = "default"
+
+// defaultPriority puts the seeded policy after policies created later with
+// the zero priority
+const defaultPriority = 1000
+
+var (
+	ErrPolicyNotFound = errors.New("policy not found")
+	ErrEmptyName      = errors.New("policy name is required")
+	ErrInvalidRule    = errors.New("invalid rule")
+)
+
+// Policy is an ordered list of rules for the clients it is attached to
+type Policy struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Clients and Tags attach the policy to clients by ID and by tag; a
+	// policy with neither applies to every client
+	Clients []string `json:"clients,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	// Priority orders policies, lowest first. The first matching rule of
+	// the first policy that has one decides; unmatched packets pass.
+	Priority int       `json:"priority"`
+	Rules    []Rule    `json:"rules"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// PolicyUpdate carries the fields of a PATCH request; nil fields are left
+// untouched
+type PolicyUpdate struct {
+	Name     *string   `json:"name"`
+	Clients  *[]string `json:"clients"`
+	Tags     *[]string `json:"tags"`
+	Priority *int      `json:"priority"`
+	Rules    *[]Rule   `json:"rules"`
+}
+
+type Config struct {
+	// Network is the tunnel subnet with the gateway address, e.g.
+	// 10.0.0.1/24
+	Network netip.Prefix
+}
+
+type Stats struct {
+	Packets         int64            `json:"packets"`
+	Dropped         int64            `json:"dropped"`
+	DroppedByClient map[string]int64 `json:"dropped_by_client"`
+	DroppedByPolicy map[string]int64 `json:"dropped_by_policy"`
+}
+
+type compiledPolicy struct {
+	id      string
+	global  bool
+	clients map[string]bool
+	tags    map[string]bool
+	rules   []compiledRule
+}
+
+func (p *compiledPolicy) appliesTo(clientID string, tags []string) bool {
+	if p.global || p.clients[clientID] {
+		return true
+	}
+	for _, tag := range tags {
+		if p.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// Engine decides which packets clients may send into the server's network.
+// A nil *Engine allows everything.
+type Engine struct {
+	path      string
+	addresses map[string][]netip.Prefix
+	policies  map[string]*Policy
+	mutex     sync.RWMutex
+	// compiled is replaced as a whole on every change, so packets are
+	// checked without taking the mutex
+	compiled atomic.Pointer[[]*compiledPolicy]
+
+	packets atomic.Int64
+	dropped atomic.Int64
+	// droppedClient and droppedPolicy hold an *atomic.Int64 per client and
+	// policy ID, so a denied packet only takes a lock the first time its
+	// client or policy drops anything
+	droppedClient sync.Map
+	droppedPolicy sync.Map
+}
+
+// New creates the engine. If path is not empty, policies are loaded from
+// and persisted to that file; without the file a default policy is seeded
+// that keeps clients away from the server, each other, private networks
+// and SMTP.
+func New(path string, config Config) (*Engine, error) {
+	if !config.Network.IsValid() {
+		return nil, errors.New("tunnel network is required")
+	}
+
+	e := &Engine{
+		path:      path,
+		addresses: addressSets(config.Network),
+		policies:  make(map[string]*Policy),
+	}
+
+	seed := true
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &e.policies); err != nil {
+				return nil, err
+			}
+			seed = false
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if seed {
+		now := time.Now()
+		e.policies[DefaultPolicyID] = &Policy{
+			ID:       DefaultPolicyID,
+			Name:     "Default",
+			Priority: defaultPriority,
+			Rules:    DefaultRules(),
+			Created:  now,
+			Updated:  now,
+		}
+		if err := e.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.compile(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// DefaultRules let clients use DNS on the gateway and ping it, and reach
+// the networks behind other clients. They keep them away from everything
+// else on the server, from each other, from private networks and from SMTP.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Action: Allow, Destination: DestGateway, Protocol: "udp", Ports: "53", Comment: "DNS resolver"},
+		{Action: Allow, Destination: DestGateway, Protocol: "tcp", Ports: "53", Comment: "DNS resolver"},
+		{Action: Allow, Destination: DestGateway, Protocol: "icmp", Comment: "ping"},
+		{Action: Allow, Destination: DestSubnets, Comment: "networks behind clients"},
+		{Action: Deny, Destination: DestServer, Comment: "server's own services"},
+		{Action: Deny, Destination: DestTunnel, Comment: "client-to-client traffic"},
+		{Action: Deny, Destination: DestPrivate, Comment: "private networks"},
+		{Action: Deny, Protocol: "tcp", Ports: "25", Comment: "SMTP"},
+	}
+}
+
+// addressSets resolves the destination keywords. The server's addresses are
+// read once, so interfaces added later are not covered by "server".
+func addressSets(network netip.Prefix) map[string][]netip.Prefix {
+	gateway := network.Addr()
+	server := []netip.Prefix{
+		netip.PrefixFrom(gateway, gateway.BitLen()),
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}
+
+	if interfaceAddrs, err := net.InterfaceAddrs(); err == nil {
+		for _, interfaceAddr := range interfaceAddrs {
+			ipNet, ok := interfaceAddr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+			addr = addr.Unmap()
+			server = append(server, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+
+	return map[string][]netip.Prefix{
+		DestGateway: {netip.PrefixFrom(gateway, gateway.BitLen())},
+		DestTunnel:  {network.Masked()},
+		DestServer:  server,
+		DestPrivate: privateNetworks,
+		// Filled in by SetSubnets
+		DestSubnets: {},
+	}
+}
+
+// SetSubnets sets the networks behind clients that the subnets keyword
+// stands for
+func (e *Engine) SetSubnets(subnets []netip.Prefix) {
+	if e == nil {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// Replaced rather than changed, compiled rules keep the old slice
+	addresses := maps.Clone(e.addresses)
+	addresses[DestSubnets] = append([]netip.Prefix{}, subnets...)
+	e.addresses = addresses
+	if err := e.compile(); err != nil {
+		log.Printf("⚠️ Failed to apply client subnets to the ACL: %v", err)
+	}
+}
+
+// Allow reports whether a client may send a packet into the server's
+// network. Malformed packets are dropped.
+func (e *Engine) Allow(clientID string, tags []string, data []byte) bool {
+	if e == nil {
+		return true
+	}
+	e.packets.Add(1)
+
+	p, ok := parsePacket(data)
+	if !ok {
+		e.drop(clientID, "")
+		return false
+	}
+	return e.check(clientID, tags, &p)
+}
+
+// AllowFlow reports whether a client may open a TCP or UDP connection to
+// destination. Flows count towards the packet statistics as one packet.
+func (e *Engine) AllowFlow(clientID string, tags []string, protocol string, destination netip.AddrPort) bool {
+	if e == nil {
+		return true
+	}
+	e.packets.Add(1)
+
+	p := packet{
+		destination: destination.Addr().Unmap(),
+		port:        destination.Port(),
+		hasPort:     true,
+	}
+	switch protocol {
+	case "tcp":
+		p.protocol = protocolTCP
+	case "udp":
+		p.protocol = protocolUDP
+	default:
+		e.drop(clientID, "")
+		return false
+	}
+	return e.check(clientID, tags, &p)
+}
+
+// AllowReply reports whether a packet sent to a client may pass as the
+// reply to what the client may send: the network behind another client
+// answers exactly the clients whose policies let them reach it. Refused
+// replies are not counted as drops of the client.
+func (e *Engine) AllowReply(clientID string, tags []string, data []byte) bool {
+	if e == nil {
+		return true
+	}
+
+	p, ok := parsePacket(data)
+	if !ok {
+		return false
+	}
+	reply := p.reversed()
+	return e.decide(clientID, tags, &reply) == ""
+}
+
+// check runs a parsed packet through the policies that apply to the client
+func (e *Engine) check(clientID string, tags []string, p *packet) bool {
+	if policyID := e.decide(clientID, tags, p); policyID != "" {
+		e.drop(clientID, policyID)
+		return false
+	}
+	return true
+}
+
+// decide returns the ID of the policy that denies a packet, empty if it
+// passes
+func (e *Engine) decide(clientID string, tags []string, p *packet) string {
+	compiled := e.compiled.Load()
+	if compiled == nil {
+		return ""
+	}
+
+	for _, policy := range *compiled {
+		if !policy.appliesTo(clientID, tags) {
+			continue
+		}
+		for i := range policy.rules {
+			if !policy.rules[i].matches(p) {
+				continue
+			}
+			if policy.rules[i].action == Deny {
+				return policy.id
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+func (e *Engine) drop(clientID, policyID string) {
+	e.dropped.Add(1)
+	counter(&e.droppedClient, clientID).Add(1)
+	if policyID != "" {
+		counter(&e.droppedPolicy, policyID).Add(1)
+	}
+}
+
+// counter returns the counter for key, creating it on first use
+func counter(counters *sync.Map, key string) *atomic.Int64 {
+	if c, ok := counters.Load(key); ok {
+		return c.(*atomic.Int64)
+	}
+	c, _ := counters.LoadOrStore(key, new(atomic.Int64))
+	return c.(*atomic.Int64)
+}
+
+// Stats returns packet and drop counters since start
+func (e *Engine) Stats() Stats {
+	stats := Stats{
+		Packets:         e.packets.Load(),
+		Dropped:         e.dropped.Load(),
+		DroppedByClient: make(map[string]int64),
+		DroppedByPolicy: make(map[string]int64),
+	}
+	e.droppedClient.Range(func(id, count any) bool {
+		stats.DroppedByClient[id.(string)] = count.(*atomic.Int64).Load()
+		return true
+	})
+	e.droppedPolicy.Range(func(id, count any) bool {
+		stats.DroppedByPolicy[id.(string)] = count.(*atomic.Int64).Load()
+		return true
+	})
+	return stats
+}
+
+// Policies returns all policies in evaluation order
+func (e *Engine) Policies() []*Policy {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	policies := make([]*Policy, 0, len(e.policies))
+	for _, policy := range e.policies {
+		policies = append(policies, policy)
+	}
+	sortPolicies(policies)
+	return policies
+}
+
+func (e *Engine) GetPolicy(id string) (*Policy, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	policy, exists := e.policies[id]
+	return policy, exists
+}
+
+func (e *Engine) CreatePolicy(policy Policy) (*Policy, error) {
+	policy.Name = strings.TrimSpace(policy.Name)
+	if policy.Name == "" {
+		return nil, ErrEmptyName
+	}
+	if err := e.validate(policy.Rules); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	created := &Policy{
+		ID:       uuid.New().String(),
+		Name:     policy.Name,
+		Clients:  append([]string(nil), policy.Clients...),
+		Tags:     append([]string(nil), policy.Tags...),
+		Priority: policy.Priority,
+		Rules:    append([]Rule{}, policy.Rules...),
+		Created:  now,
+		Updated:  now,
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.policies[created.ID] = created
+	if err := e.compile(); err != nil {
+		delete(e.policies, created.ID)
+		return nil, err
+	}
+	return created, e.save()
+}
+
+// UpdatePolicy applies an edit. Policies are replaced rather than changed in
+// place, so callers holding the old one never see a half-applied edit.
+func (e *Engine) UpdatePolicy(id string, update PolicyUpdate) (*Policy, error) {
+	if update.Rules != nil {
+		if err := e.validate(*update.Rules); err != nil {
+			return nil, err
+		}
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	existing, exists := e.policies[id]
+	if !exists {
+		return nil, ErrPolicyNotFound
+	}
+
+	updated := *existing
+	if update.Name != nil {
+		updated.Name = strings.TrimSpace(*update.Name)
+		if updated.Name == "" {
+			return nil, ErrEmptyName
+		}
+	}
+	if update.Clients != nil {
+		updated.Clients = append([]string(nil), (*update.Clients)...)
+	}
+	if update.Tags != nil {
+		updated.Tags = append([]string(nil), (*update.Tags)...)
+	}
+	if update.Priority != nil {
+		updated.Priority = *update.Priority
+	}
+	if update.Rules != nil {
+		updated.Rules = append([]Rule{}, (*update.Rules)...)
+	}
+	updated.Updated = time.Now()
+
+	e.policies[id] = &updated
+	if err := e.compile(); err != nil {
+		e.policies[id] = existing
+		return nil, err
+	}
+	return &updated, e.save()
+}
+
+func (e *Engine) DeletePolicy(id string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, exists := e.policies[id]; !exists {
+		return ErrPolicyNotFound
+	}
+	delete(e.policies, id)
+	if err := e.compile(); err != nil {
+		return err
+	}
+	return e.save()
+}
+
+// validate checks rules before they are stored
+func (e *Engine) validate(rules []Rule) error {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	for i, rule := range rules {
+		if _, err := rule.compile(e.addresses); err != nil {
+			return fmt.Errorf("%w %d: %v", ErrInvalidRule, i+1, err)
+		}
+	}
+	return nil
+}
+
+// compile rebuilds the evaluation order; must be called with the mutex held
+func (e *Engine) compile() error {
+	policies := make([]*Policy, 0, len(e.policies))
+	for _, policy := range e.policies {
+		policies = append(policies, policy)
+	}
+	sortPolicies(policies)
+
+	compiled := make([]*compiledPolicy, 0, len(policies))
+	for _, policy := range policies {
+		c := &compiledPolicy{
+			id:      policy.ID,
+			global:  len(policy.Clients) == 0 && len(policy.Tags) == 0,
+			clients: make(map[string]bool),
+			tags:    make(map[string]bool),
+		}
+		for _, id := range policy.Clients {
+			c.clients[id] = true
+		}
+		for _, tag := range policy.Tags {
+			c.tags[tag] = true
+		}
+		for i, rule := range policy.Rules {
+			r, err := rule.compile(e.addresses)
+			if err != nil {
+				return fmt.Errorf("policy %q rule %d: %w", policy.Name, i+1, err)
+			}
+			c.rules = append(c.rules, r)
+		}
+		compiled = append(compiled, c)
+	}
+
+	e.compiled.Store(&compiled)
+	return nil
+}
+
+// save must be called with the mutex held
+func (e *Engine) save() error {
+	if e.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(e.policies, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(e.path, data, 0600)
+}
+
+// sortPolicies orders by priority, then by creation so evaluation is stable
+func sortPolicies(policies []*Policy) {
+	sort.Slice(policies, func(i, j int) bool {
+		if policies[i].Priority != policies[j].Priority {
+			return policies[i].Priority < policies[j].Priority
+		}
+		if !policies[i].Created.Equal(policies[j].Created) {
+			return policies[i].Created.Before(policies[j].Created)
+		}
+		return policies[i].ID < policies[j].ID
+	})
+}
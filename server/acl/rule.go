@@ -0,0 +1,229 @@
+package acl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Destination keywords stand for address sets that depend on the server
+const (
+	// DestGateway is the server's address in the tunnel network
+	DestGateway = "gateway"
+	// DestTunnel is the tunnel network, i.e. other clients
+	DestTunnel = "tunnel"
+	// DestServer is every address of the server's own interfaces
+	DestServer = "server"
+	// DestPrivate is loopback, link-local, CGNAT and the RFC 1918 and
+	// RFC 4193 ranges
+	DestPrivate = "private"
+	// DestSubnets is the networks behind clients, such as office LANs,
+	// that the server routes to them
+	DestSubnets = "subnets"
+)
+
+// Protocol numbers rules can match
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+var privateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// Rule matches packets by destination, protocol and port. Every field left
+// empty matches anything.
+type Rule struct {
+	Action Action `json:"action"`
+	// Destination is an address, a CIDR or one of gateway, tunnel, server,
+	// private and subnets
+	Destination string `json:"destination,omitempty"`
+	// Protocol is tcp, udp or icmp
+	Protocol string `json:"protocol,omitempty"`
+	// Ports is a port such as "25" or a range such as "6000-6063". Only TCP
+	// and UDP packets match a rule with ports.
+	Ports   string `json:"ports,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// compiledRule is a rule resolved against the server's addresses
+type compiledRule struct {
+	action    Action
+	networks  []netip.Prefix
+	protocols []uint8
+	portLow   uint16
+	portHigh  uint16
+	hasPorts  bool
+}
+
+// compile validates a rule and resolves its destination keyword
+func (r Rule) compile(addresses map[string][]netip.Prefix) (compiledRule, error) {
+	rule := compiledRule{action: r.Action}
+	if r.Action != Allow && r.Action != Deny {
+		return rule, fmt.Errorf("action must be allow or deny, got %q", r.Action)
+	}
+
+	destination := strings.ToLower(strings.TrimSpace(r.Destination))
+	switch {
+	case destination == "":
+	case addresses[destination] != nil:
+		rule.networks = addresses[destination]
+	case strings.Contains(destination, "/"):
+		network, err := netip.ParsePrefix(destination)
+		if err != nil {
+			return rule, fmt.Errorf("invalid destination %q", r.Destination)
+		}
+		rule.networks = []netip.Prefix{network.Masked()}
+	default:
+		addr, err := netip.ParseAddr(destination)
+		if err != nil {
+			return rule, fmt.Errorf("invalid destination %q", r.Destination)
+		}
+		rule.networks = []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}
+	}
+
+	switch strings.ToLower(r.Protocol) {
+	case "":
+	case "tcp":
+		rule.protocols = []uint8{protocolTCP}
+	case "udp":
+		rule.protocols = []uint8{protocolUDP}
+	case "icmp":
+		rule.protocols = []uint8{protocolICMP, protocolICMPv6}
+	default:
+		return rule, fmt.Errorf("protocol must be tcp, udp or icmp, got %q", r.Protocol)
+	}
+
+	if r.Ports != "" {
+		if strings.EqualFold(r.Protocol, "icmp") {
+			return rule, fmt.Errorf("icmp rules cannot have ports")
+		}
+		low, high, found := strings.Cut(r.Ports, "-")
+		if !found {
+			high = low
+		}
+		portLow, errLow := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+		portHigh, errHigh := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+		if errLow != nil || errHigh != nil || portLow > portHigh {
+			return rule, fmt.Errorf("invalid ports %q", r.Ports)
+		}
+		rule.portLow, rule.portHigh, rule.hasPorts = uint16(portLow), uint16(portHigh), true
+	}
+	return rule, nil
+}
+
+func (r *compiledRule) matches(p *packet) bool {
+	if r.networks != nil {
+		matched := false
+		for _, network := range r.networks {
+			if network.Contains(p.destination) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if r.protocols != nil {
+		matched := false
+		for _, protocol := range r.protocols {
+			if protocol == p.protocol {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if r.hasPorts {
+		return p.hasPort && p.port >= r.portLow && p.port <= r.portHigh
+	}
+	return true
+}
+
+// packet holds the header fields rules look at
+type packet struct {
+	source      netip.Addr
+	destination netip.Addr
+	protocol    uint8
+	sourcePort  uint16
+	port        uint16
+	// hasPort is false for non-TCP/UDP packets and for fragments after the
+	// first, which carry no transport header
+	hasPort bool
+}
+
+// reversed is the packet a reply to p would be
+func (p packet) reversed() packet {
+	p.source, p.destination = p.destination, p.source
+	p.sourcePort, p.port = p.port, p.sourcePort
+	return p
+}
+
+// parsePacket reads the destination of an IPv4 or IPv6 packet. Extension
+// headers of IPv6 are not followed.
+func parsePacket(data []byte) (packet, bool) {
+	var p packet
+	var payload []byte
+	if len(data) == 0 {
+		return p, false
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return p, false
+		}
+		headerLength := int(data[0]&0x0f) * 4
+		if headerLength < 20 || len(data) < headerLength {
+			return p, false
+		}
+		p.source = netip.AddrFrom4([4]byte(data[12:16]))
+		p.destination = netip.AddrFrom4([4]byte(data[16:20]))
+		p.protocol = data[9]
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff == 0 {
+			payload = data[headerLength:]
+		}
+	case 6:
+		if len(data) < 40 {
+			return p, false
+		}
+		p.source = netip.AddrFrom16([16]byte(data[8:24]))
+		p.destination = netip.AddrFrom16([16]byte(data[24:40]))
+		p.protocol = data[6]
+		payload = data[40:]
+	default:
+		return p, false
+	}
+
+	if (p.protocol == protocolTCP || p.protocol == protocolUDP) && len(payload) >= 4 {
+		p.sourcePort = binary.BigEndian.Uint16(payload[0:2])
+		p.port = binary.BigEndian.Uint16(payload[2:4])
+		p.hasPort = true
+	}
+	return p, true
+}
@@ -0,0 +1,376 @@
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"yuki-server/crypto"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SessionTTL matches the lifetime of the panel session cookie
+const SessionTTL = 7 * 24 * time.Hour
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+	ErrInvalidRole  = errors.New("invalid role")
+	ErrLastOwner    = errors.New("cannot remove the last owner")
+	ErrEmptyLogin   = errors.New("login and password are required")
+)
+
+// Allowance limits what a reseller may hand out to their own clients
+type Allowance struct {
+	MaxClients int   `json:"max_clients"`
+	MaxTraffic int64 `json:"max_traffic"`
+}
+
+type User struct {
+	ID           string     `json:"id"`
+	Login        string     `json:"login"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+	Role         Role       `json:"role"`
+	Allowance    *Allowance `json:"allowance,omitempty"`
+	Created      time.Time  `json:"created"`
+	LastLogin    time.Time  `json:"last_login"`
+
+	// TOTP secrets are sealed with the manager's secret key
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPPending   string   `json:"totp_pending,omitempty"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// Public returns a copy of the user that is safe to return from the API
+func (u *User) Public() *User {
+	public := *u
+	public.PasswordHash = ""
+	public.TOTPSecret = ""
+	public.TOTPPending = ""
+	public.TOTPLastStep = 0
+	public.RecoveryCodes = nil
+	return &public
+}
+
+// clone returns a deep copy of the user, so callers can read it after the
+// manager's lock is released
+func (u *User) clone() *User {
+	clone := *u
+	if u.Allowance != nil {
+		allowance := *u.Allowance
+		clone.Allowance = &allowance
+	}
+	clone.RecoveryCodes = append([]string(nil), u.RecoveryCodes...)
+	return &clone
+}
+
+// UserUpdate carries the fields of a PATCH request; nil fields are left untouched
+type UserUpdate struct {
+	Password  *string    `json:"password,omitempty"`
+	Role      *Role      `json:"role,omitempty"`
+	Allowance *Allowance `json:"allowance,omitempty"`
+	// ResetTOTP lets an owner recover an account whose authenticator was lost
+	ResetTOTP bool `json:"reset_totp,omitempty"`
+}
+
+type session struct {
+	userID  string
+	expires time.Time
+}
+
+type Manager struct {
+	users     map[string]*User
+	sessions  map[string]*session
+	mutex     sync.RWMutex
+	path      string
+	secretKey []byte
+}
+
+// NewManager creates an admin user manager. If path is not empty, users are
+// loaded from and persisted to that file. secretKey seals TOTP secrets at rest.
+func NewManager(path string, secretKey []byte) (*Manager, error) {
+	if len(secretKey) != crypto.KeySize {
+		return nil, errors.New("invalid secret key size")
+	}
+
+	m := &Manager{
+		users:     make(map[string]*User),
+		sessions:  make(map[string]*session),
+		path:      path,
+		secretKey: secretKey,
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &m.users); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// Bootstrap creates the initial owner account from the legacy single-admin
+// config when no users exist yet
+func (m *Manager) Bootstrap(login, password string) error {
+	m.mutex.RLock()
+	empty := len(m.users) == 0
+	m.mutex.RUnlock()
+
+	if !empty {
+		return nil
+	}
+
+	_, err := m.CreateUser(login, password, RoleOwner, nil)
+	return err
+}
+
+func (m *Manager) CreateUser(login, password string, role Role, allowance *Allowance) (*User, error) {
+	login = strings.TrimSpace(login)
+	if login == "" || password == "" {
+		return nil, ErrEmptyLogin
+	}
+	if !role.Valid() {
+		return nil, ErrInvalidRole
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.findByLogin(login) != nil {
+		return nil, ErrUserExists
+	}
+
+	user := &User{
+		ID:           uuid.New().String(),
+		Login:        login,
+		PasswordHash: string(hash),
+		Role:         role,
+		Created:      time.Now(),
+	}
+	if role == RoleReseller {
+		user.Allowance = allowance
+		if user.Allowance == nil {
+			user.Allowance = &Allowance{}
+		}
+	}
+
+	m.users[user.ID] = user
+	return user.clone(), m.save()
+}
+
+func (m *Manager) GetUser(id string) (*User, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	user, exists := m.users[id]
+	if !exists {
+		return nil, false
+	}
+	return user.clone(), true
+}
+
+func (m *Manager) ListUsers() []*User {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	users := make([]*User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, user.clone())
+	}
+	return users
+}
+
+func (m *Manager) UpdateUser(id string, update UserUpdate) (*User, error) {
+	var hash []byte
+	if update.Password != nil {
+		if *update.Password == "" {
+			return nil, ErrEmptyLogin
+		}
+		var err error
+		hash, err = bcrypt.GenerateFromPassword([]byte(*update.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, exists := m.users[id]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	if update.Role != nil {
+		if !update.Role.Valid() {
+			return nil, ErrInvalidRole
+		}
+		if user.Role == RoleOwner && *update.Role != RoleOwner && m.countOwners() == 1 {
+			return nil, ErrLastOwner
+		}
+		user.Role = *update.Role
+	}
+	if hash != nil {
+		user.PasswordHash = string(hash)
+	}
+	if update.Allowance != nil {
+		allowance := *update.Allowance
+		user.Allowance = &allowance
+	}
+	if user.Role == RoleReseller && user.Allowance == nil {
+		user.Allowance = &Allowance{}
+	}
+	if user.Role != RoleReseller {
+		user.Allowance = nil
+	}
+	if update.ResetTOTP {
+		clearTOTP(user)
+	}
+
+	return user.clone(), m.save()
+}
+
+func (m *Manager) DeleteUser(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, exists := m.users[id]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if user.Role == RoleOwner && m.countOwners() == 1 {
+		return ErrLastOwner
+	}
+
+	delete(m.users, id)
+	for token, s := range m.sessions {
+		if s.userID == id {
+			delete(m.sessions, token)
+		}
+	}
+	return m.save()
+}
+
+// Authenticate checks a login/password pair. The bcrypt comparison runs even
+// for unknown logins so response timing does not reveal which accounts exist.
+func (m *Manager) Authenticate(login, password string) (*User, bool) {
+	m.mutex.RLock()
+	user := m.findByLogin(strings.TrimSpace(login))
+	if user != nil {
+		user = user.clone()
+	}
+	m.mutex.RUnlock()
+
+	hash := dummyHash
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || user == nil {
+		return nil, false
+	}
+	return user, true
+}
+
+// CreateSession issues an opaque session token for the given user
+func (m *Manager) CreateSession(userID string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if user, exists := m.users[userID]; exists {
+		user.LastLogin = time.Now()
+	}
+	m.sessions[token] = &session{userID: userID, expires: time.Now().Add(SessionTTL)}
+	m.save()
+
+	return token, nil
+}
+
+// SessionUser resolves a session token to its user
+func (m *Manager) SessionUser(token string) (*User, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, exists := m.sessions[token]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(s.expires) {
+		delete(m.sessions, token)
+		return nil, false
+	}
+
+	user, exists := m.users[s.userID]
+	if !exists {
+		return nil, false
+	}
+	return user.clone(), true
+}
+
+func (m *Manager) DeleteSession(token string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.sessions, token)
+}
+
+func (m *Manager) findByLogin(login string) *User {
+	for _, user := range m.users {
+		if user.Login == login {
+			return user
+		}
+	}
+	return nil
+}
+
+func (m *Manager) countOwners() int {
+	count := 0
+	for _, user := range m.users {
+		if user.Role == RoleOwner {
+			count++
+		}
+	}
+	return count
+}
+
+// save must be called with the mutex held
+func (m *Manager) save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(m.path, data, 0600)
+}
+
+// dummyHash is compared against when a login is unknown
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("yuki-dummy-password"), bcrypt.DefaultCost)
@@ -0,0 +1,53 @@
+package admin
+
+type Role string
+
+const (
+	RoleOwner    Role = "owner"
+	RoleOperator Role = "operator"
+	RoleViewer   Role = "viewer"
+	RoleReseller Role = "reseller"
+)
+
+type Permission int
+
+const (
+	// PermViewClients allows reading clients and stats
+	PermViewClients Permission = iota
+	// PermManageClients allows creating, deleting, blocking and unblocking clients
+	PermManageClients
+	// PermManageUsers allows managing admin accounts
+	PermManageUsers
+	// PermViewAudit allows reading the audit log
+	PermViewAudit
+	// PermManageSecurity allows listing and clearing brute-force bans
+	PermManageSecurity
+	// PermManageServer allows switching maintenance mode
+	PermManageServer
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleOwner:    {PermViewClients, PermManageClients, PermManageUsers, PermViewAudit, PermManageSecurity, PermManageServer},
+	RoleOperator: {PermViewClients, PermManageClients, PermViewAudit, PermManageServer},
+	RoleViewer:   {PermViewClients},
+	RoleReseller: {PermViewClients, PermManageClients},
+}
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Can(p Permission) bool {
+	for _, granted := range rolePermissions[r] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Scoped reports whether the role only sees clients it created
+func (r Role) Scoped() bool {
+	return r == RoleReseller
+}
@@ -0,0 +1,296 @@
+package admin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"yuki-server/crypto"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// RFC 6238 parameters understood by every authenticator app
+	totpPeriod = 30
+	totpDigits = 6
+	// Accept one step of clock drift in either direction
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+	totpIssuer        = "Yuki VPN"
+)
+
+var (
+	ErrTOTPNotPending  = errors.New("no pending TOTP enrollment")
+	ErrTOTPNotEnabled  = errors.New("TOTP is not enabled")
+	ErrTOTPInvalidCode = errors.New("invalid TOTP code")
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is returned when an admin starts enrolling an authenticator
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// BeginTOTPEnrollment generates a new TOTP secret for the user. The secret
+// only becomes active once ConfirmTOTP succeeds with a code derived from it.
+func (m *Manager) BeginTOTPEnrollment(userID string) (*TOTPEnrollment, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := base32NoPad.EncodeToString(raw)
+
+	sealed, err := m.sealSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, exists := m.users[userID]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	user.TOTPPending = sealed
+
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{Secret: secret, URI: totpURI(user.Login, secret)}, nil
+}
+
+// ConfirmTOTP activates the pending secret and returns fresh recovery codes.
+// The codes are only stored as hashes, so this is the only time they are shown.
+func (m *Manager) ConfirmTOTP(userID, code string) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, exists := m.users[userID]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	if user.TOTPPending == "" {
+		return nil, ErrTOTPNotPending
+	}
+
+	secret, err := m.openSecret(user.TOTPPending)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := validateTOTP(secret, code, time.Now(), 0)
+	if !ok {
+		return nil, ErrTOTPInvalidCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPSecret = user.TOTPPending
+	user.TOTPPending = ""
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+
+	return codes, m.save()
+}
+
+// DisableTOTP turns off two-factor authentication after checking a current
+// TOTP or recovery code
+func (m *Manager) DisableTOTP(userID, code string) error {
+	user, exists := m.GetUser(userID)
+	if !exists {
+		return ErrUserNotFound
+	}
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+	if !m.VerifySecondFactor(userID, code) {
+		return ErrTOTPInvalidCode
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, exists = m.users[userID]
+	if !exists {
+		return ErrUserNotFound
+	}
+	clearTOTP(user)
+	return m.save()
+}
+
+// VerifySecondFactor checks a TOTP code, falling back to single-use recovery
+// codes. Each TOTP step is accepted only once.
+func (m *Manager) VerifySecondFactor(userID, code string) bool {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if code == "" {
+		return false
+	}
+
+	m.mutex.Lock()
+	user, exists := m.users[userID]
+	if !exists || !user.TOTPEnabled {
+		m.mutex.Unlock()
+		return false
+	}
+
+	secret, err := m.openSecret(user.TOTPSecret)
+	if err != nil {
+		m.mutex.Unlock()
+		return false
+	}
+	if step, ok := validateTOTP(secret, code, time.Now(), user.TOTPLastStep); ok {
+		user.TOTPLastStep = step
+		m.save()
+		m.mutex.Unlock()
+		return true
+	}
+	if len(code) == totpDigits {
+		m.mutex.Unlock()
+		return false
+	}
+	// Recovery codes are bcrypt hashes; comparing them under the lock would
+	// stall every login and API request for the duration
+	hashes := append([]string(nil), user.RecoveryCodes...)
+	m.mutex.Unlock()
+
+	matched := ""
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(strings.ToLower(code))) == nil {
+			matched = hash
+			break
+		}
+	}
+	if matched == "" {
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The code counts only if a concurrent request has not used it meanwhile
+	user, exists = m.users[userID]
+	if !exists || !user.TOTPEnabled {
+		return false
+	}
+	for i, hash := range user.RecoveryCodes {
+		if hash == matched {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			m.save()
+			return true
+		}
+	}
+	return false
+}
+
+func clearTOTP(user *User) {
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPPending = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+}
+
+func (m *Manager) sealSecret(secret string) (string, error) {
+	sealed, err := crypto.SealSecret(m.secretKey, []byte(secret))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (m *Manager) openSecret(sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	secret, err := crypto.OpenSecret(m.secretKey, raw)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// validateTOTP checks code against the steps around now and returns the
+// matched step. Steps at or before lastStep are rejected to prevent replay.
+func validateTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode implements the HOTP truncation from RFC 4226 with SHA-1
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func totpURI(login, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + login)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPad.EncodeToString(raw))
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, string(hash))
+	}
+	return codes, hashes, nil
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"yuki-server/acl"
+	"yuki-server/audit"
+
+	"github.com/gorilla/mux"
+)
+
+func (a *API) ListPolicies(w http.ResponseWriter, r *http.Request) {
+	if a.acl == nil {
+		writeError(w, http.StatusServiceUnavailable, "ACL disabled")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.acl.Policies())
+}
+
+func (a *API) GetPolicy(w http.ResponseWriter, r *http.Request) {
+	if a.acl == nil {
+		writeError(w, http.StatusServiceUnavailable, "ACL disabled")
+		return
+	}
+
+	policy, exists := a.acl.GetPolicy(mux.Vars(r)["id"])
+	if !exists {
+		writeError(w, http.StatusNotFound, acl.ErrPolicyNotFound.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+func (a *API) CreatePolicy(w http.ResponseWriter, r *http.Request) {
+	if a.acl == nil {
+		writeError(w, http.StatusServiceUnavailable, "ACL disabled")
+		return
+	}
+
+	var req acl.Policy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	policy, err := a.acl.CreatePolicy(req)
+	if err != nil {
+		a.audit(r, audit.ActionACLCreate, req.Name, audit.OutcomeFailure, err.Error())
+		writePolicyError(w, err)
+		return
+	}
+	a.audit(r, audit.ActionACLCreate, policy.ID, audit.OutcomeSuccess, policy.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(policy)
+}
+
+func (a *API) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	if a.acl == nil {
+		writeError(w, http.StatusServiceUnavailable, "ACL disabled")
+		return
+	}
+
+	var req acl.PolicyUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	policyID := mux.Vars(r)["id"]
+	policy, err := a.acl.UpdatePolicy(policyID, req)
+	if err != nil {
+		a.audit(r, audit.ActionACLUpdate, policyID, audit.OutcomeFailure, err.Error())
+		writePolicyError(w, err)
+		return
+	}
+	a.audit(r, audit.ActionACLUpdate, policyID, audit.OutcomeSuccess, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+func (a *API) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	if a.acl == nil {
+		writeError(w, http.StatusServiceUnavailable, "ACL disabled")
+		return
+	}
+
+	policyID := mux.Vars(r)["id"]
+	if err := a.acl.DeletePolicy(policyID); err != nil {
+		a.audit(r, audit.ActionACLDelete, policyID, audit.OutcomeFailure, err.Error())
+		writePolicyError(w, err)
+		return
+	}
+	a.audit(r, audit.ActionACLDelete, policyID, audit.OutcomeSuccess, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetACLStats reports how many packets the ACL checked and dropped
+func (a *API) GetACLStats(w http.ResponseWriter, r *http.Request) {
+	if a.acl == nil {
+		writeError(w, http.StatusServiceUnavailable, "ACL disabled")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.acl.Stats())
+}
+
+func writePolicyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, acl.ErrPolicyNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, acl.ErrEmptyName), errors.Is(err, acl.ErrInvalidRule):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"yuki-server/audit"
+)
+
+// audit records an action performed by the current admin user
+func (a *API) audit(r *http.Request, action, target, outcome, details string) {
+	actor := ""
+	if user := currentUser(r); user != nil {
+		actor = user.Login
+	}
+
+	a.auditLog.Record(audit.Event{
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		SourceIP: sourceIP(r),
+		Outcome:  outcome,
+		Details:  details,
+	})
+}
+
+// QueryAudit returns audit events filtered by the actor, action, target, ip,
+// outcome, since, until and limit query parameters
+func (a *API) QueryAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := audit.Filter{
+		Actor:    query.Get("actor"),
+		Action:   query.Get("action"),
+		Target:   query.Get("target"),
+		SourceIP: query.Get("ip"),
+		Outcome:  query.Get("outcome"),
+		Limit:    100,
+	}
+
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid "+name+" timestamp")
+				return
+			}
+			*dst = t
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		filter.Limit = limit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.auditLog.Query(filter))
+}
+
+// sourceIP returns the address of the HTTP client. The admin API is served
+// behind nginx, so forwarding headers are trusted only from loopback peers.
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return realIP
+		}
+		// nginx appends the peer address, so the last hop is the trustworthy one
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			hops := strings.Split(forwarded, ",")
+			return strings.TrimSpace(hops[len(hops)-1])
+		}
+	}
+	return host
+}
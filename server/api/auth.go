@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"yuki-server/admin"
+	"yuki-server/client"
+)
+
+const sessionCookie = "yuki_session"
+
+type contextKey int
+
+const userContextKey contextKey = iota
+
+// sessionMiddleware resolves the session cookie to an admin user and stores it
+// in the request context
+func (a *API) sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := r.Cookie(sessionCookie)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		user, ok := a.adminManager.SessionUser(session.Value)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// require wraps a handler with a role check for the given permission
+func (a *API) require(perm admin.Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user == nil || !user.Role.Can(perm) {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func currentUser(r *http.Request) *admin.User {
+	user, _ := r.Context().Value(userContextKey).(*admin.User)
+	return user
+}
+
+// visibleClients returns the clients the current user is allowed to see
+func (a *API) visibleClients(r *http.Request) []*client.Client {
+	user := currentUser(r)
+	if user.Role.Scoped() {
+		return a.clientManager.ListClientsByOwner(user.ID)
+	}
+	return a.clientManager.ListClients()
+}
+
+// visibleClient looks up a client, hiding clients outside the user's scope
+func (a *API) visibleClient(r *http.Request, id string) (*client.Client, bool) {
+	c, exists := a.clientManager.GetClient(id)
+	if !exists {
+		return nil, false
+	}
+
+	user := currentUser(r)
+	if user.Role.Scoped() && c.OwnerID != user.ID {
+		return nil, false
+	}
+	return c, true
+}
+
+// quota returns the limits on the clients of a reseller, nil for users
+// without an allowance. The client manager checks them under its lock, so
+// concurrent requests cannot overshoot them.
+func quota(user *admin.User) *client.Quota {
+	if !user.Role.Scoped() || user.Allowance == nil {
+		return nil
+	}
+	return &client.Quota{
+		MaxClients: user.Allowance.MaxClients,
+		MaxTraffic: user.Allowance.MaxTraffic,
+	}
+}
+
+// isQuotaError reports whether err is a reseller exceeding their allowance
+func isQuotaError(err error) bool {
+	return errors.Is(err, client.ErrClientQuota) || errors.Is(err, client.ErrTrafficQuota) || errors.Is(err, client.ErrNoBandwidth)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
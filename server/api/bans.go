@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"yuki-server/audit"
+	"yuki-server/guard"
+
+	"github.com/gorilla/mux"
+)
+
+// loginGuardKeys returns the brute-force counters a login attempt touches.
+// Allowlisted sources are never counted.
+func (a *API) loginGuardKeys(ip, login string) []string {
+	if a.guard.Allowlisted(ip) {
+		return nil
+	}
+	return []string{guard.AdminIP + ip, guard.AdminLogin + strings.ToLower(strings.TrimSpace(login))}
+}
+
+// loginFailed records a failed admin login in the audit log and the guard
+func (a *API) loginFailed(r *http.Request, keys []string, login, details string) {
+	ip := sourceIP(r)
+	a.auditLog.Record(audit.Event{
+		Actor:    login,
+		Action:   audit.ActionLogin,
+		SourceIP: ip,
+		Outcome:  audit.OutcomeFailure,
+		Details:  details,
+	})
+
+	for _, key := range a.guard.Failure(keys...) {
+		a.auditLog.Record(audit.Event{
+			Actor:    "system",
+			Action:   audit.ActionBan,
+			Target:   key,
+			SourceIP: ip,
+			Details:  "too many failed admin logins",
+		})
+	}
+}
+
+func writeBanned(w http.ResponseWriter, retry time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(retry.Seconds())+1))
+	writeError(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+}
+
+func (a *API) ListBans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.guard.List())
+}
+
+func (a *API) ClearBan(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	if !a.guard.Clear(key) {
+		http.Error(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	a.audit(r, audit.ActionBanClear, key, audit.OutcomeSuccess, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) ClearBans(w http.ResponseWriter, r *http.Request) {
+	a.guard.ClearAll()
+	a.audit(r, audit.ActionBanClear, "*", audit.OutcomeSuccess, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// GetDNSStats reports the query metrics of the gateway resolver
+func (a *API) GetDNSStats(w http.ResponseWriter, r *http.Request) {
+	if a.resolver == nil {
+		writeError(w, http.StatusServiceUnavailable, "DNS resolver disabled")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.resolver.Stats())
+}
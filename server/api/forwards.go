@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"yuki-server/audit"
+	"yuki-server/client"
+
+	"github.com/gorilla/mux"
+)
+
+type CreateForwardRequest struct {
+	Protocol   string `json:"protocol"`
+	PublicPort int    `json:"public_port"`
+	TargetPort int    `json:"target_port"`
+}
+
+func (a *API) ListForwards(w http.ResponseWriter, r *http.Request) {
+	c, ok := a.visibleClient(r, mux.Vars(r)["uuid"])
+	if !ok {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	forwards := c.Forwards
+	if forwards == nil {
+		forwards = []client.Forward{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(forwards)
+}
+
+// CreateForward publishes a port of the client on the server. It is live
+// whenever the client has a session.
+func (a *API) CreateForward(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["uuid"]
+
+	var req CreateForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Protocol == "" {
+		req.Protocol = "tcp"
+	}
+
+	if _, ok := a.visibleClient(r, clientID); !ok {
+		a.audit(r, audit.ActionForwardCreate, clientID, audit.OutcomeFailure, "client not found")
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	forward, err := a.clientManager.AddForward(clientID, req.Protocol, req.PublicPort, req.TargetPort)
+	if err != nil {
+		a.audit(r, audit.ActionForwardCreate, clientID, audit.OutcomeFailure, err.Error())
+		writeForwardError(w, err)
+		return
+	}
+	if a.sessions != nil {
+		// A connected client gets the listener right away; a port the
+		// server cannot listen on undoes the forward
+		if err := a.sessions.ForwardsChanged(clientID)[forward.ID]; err != nil {
+			a.clientManager.RemoveForward(clientID, forward.ID)
+			a.audit(r, audit.ActionForwardCreate, clientID, audit.OutcomeFailure, err.Error())
+			writeError(w, http.StatusConflict, fmt.Sprintf("cannot listen on %s/%d: %v", forward.Protocol, forward.PublicPort, err))
+			return
+		}
+	}
+	a.audit(r, audit.ActionForwardCreate, clientID, audit.OutcomeSuccess,
+		fmt.Sprintf("%s/%d -> %d", forward.Protocol, forward.PublicPort, forward.TargetPort))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(forward)
+}
+
+func (a *API) DeleteForward(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	clientID := vars["uuid"]
+
+	if _, ok := a.visibleClient(r, clientID); !ok {
+		a.audit(r, audit.ActionForwardDelete, clientID, audit.OutcomeFailure, "client not found")
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	if err := a.clientManager.RemoveForward(clientID, vars["id"]); err != nil {
+		a.audit(r, audit.ActionForwardDelete, clientID, audit.OutcomeFailure, err.Error())
+		writeForwardError(w, err)
+		return
+	}
+	if a.sessions != nil {
+		a.sessions.ForwardsChanged(clientID)
+	}
+	a.audit(r, audit.ActionForwardDelete, clientID, audit.OutcomeSuccess, vars["id"])
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeForwardError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, client.ErrClientNotFound), errors.Is(err, client.ErrForwardNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, client.ErrPortTaken):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, client.ErrInvalidForward):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -2,28 +2,82 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
+	"yuki-server/acl"
+	"yuki-server/admin"
+	"yuki-server/audit"
 	"yuki-server/client"
+	"yuki-server/compress"
+	"yuki-server/dns"
+	"yuki-server/guard"
+	"yuki-server/tunnel"
 
 	"github.com/gorilla/mux"
 )
 
 type API struct {
 	clientManager *client.Manager
+	adminManager  *admin.Manager
+	auditLog      *audit.Log
+	guard         *guard.Guard
+	sessions      SessionManager
+	resolver      *dns.Resolver
+	acl           *acl.Engine
+	// dnsServers are written into generated client configs
+	dnsServers []string
 	apiKey        string
-	adminLogin    string
-	adminPassword string
 }
 
-func NewAPI(clientManager *client.Manager, apiKey string, adminLogin string, adminPassword string) *API {
+// SessionManager is the part of the tunnel server the API controls
+type SessionManager interface {
+	Sessions() []tunnel.SessionInfo
+	GetSession(id string) (tunnel.SessionInfo, bool)
+	CloseSession(id string, reason string) bool
+	CloseClientSessions(clientID string, reason string) int
+	Maintenance() tunnel.Maintenance
+	SetMaintenance(m tunnel.Maintenance, drain time.Duration)
+	SendNotice(sessionIDs []string, notice tunnel.Notice) int
+	SendConfigUpdate(sessionIDs []string, update tunnel.ConfigUpdate) int
+	SubnetsChanged(clientID string)
+	ForwardsChanged(clientID string) map[string]error
+	ClientChanged(clientID string)
+}
+
+func NewAPI(clientManager *client.Manager, adminManager *admin.Manager, auditLog *audit.Log, authGuard *guard.Guard, apiKey string) *API {
 	return &API{
 		clientManager: clientManager,
+		adminManager:  adminManager,
+		auditLog:      auditLog,
+		guard:         authGuard,
 		apiKey:        apiKey,
-		adminLogin:    adminLogin,
-		adminPassword: adminPassword,
+	}
+}
+
+// SetSessionManager lets client changes terminate live tunnel sessions
+func (a *API) SetSessionManager(sessions SessionManager) {
+	a.sessions = sessions
+}
+
+// SetDNS sets the DNS servers handed to clients and the resolver whose
+// metrics the API reports; resolver may be nil
+func (a *API) SetDNS(resolver *dns.Resolver, servers []string) {
+	a.resolver = resolver
+	a.dnsServers = servers
+}
+
+// SetACL lets the API edit the tunnel's packet filter policies
+func (a *API) SetACL(engine *acl.Engine) {
+	a.acl = engine
+}
+
+func (a *API) closeClientSessions(clientID, reason string) {
+	if a.sessions != nil {
+		a.sessions.CloseClientSessions(clientID, reason)
 	}
 }
 
@@ -31,10 +85,25 @@ type CreateClientRequest struct {
 	Name         string     `json:"name"`
 	MaxBandwidth int64      `json:"max_bandwidth"`
 	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxSessions  int        `json:"max_sessions,omitempty"`
+}
+
+type UpdateClientRequest struct {
+	Name         *string `json:"name"`
+	MaxBandwidth *int64  `json:"max_bandwidth"`
+	MaxSessions  *int    `json:"max_sessions"`
+	// ExpiresAt is raw so that an explicit null can clear the expiry
+	ExpiresAt json.RawMessage `json:"expires_at"`
+	Notes     *string         `json:"notes"`
+	Tags      *[]string       `json:"tags"`
+	// Subnets replaces the networks routed to the client
+	Subnets *[]string `json:"subnets"`
 }
 
 type ClientResponse struct {
 	*client.Client
+	// Secret is only present when it is issued and cannot be fetched again
+	Secret string `json:"secret,omitempty"`
 	Config string `json:"config,omitempty"`
 }
 
@@ -46,27 +115,58 @@ func (a *API) CreateClient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := a.clientManager.CreateClient(req.Name, req.MaxBandwidth, req.ExpiresAt)
+	if req.MaxSessions < 0 {
+		http.Error(w, "Invalid max_sessions", http.StatusBadRequest)
+		return
+	}
+
+	user := currentUser(r)
+	client, secret, err := a.clientManager.CreateClientWithin(quota(user), req.Name, req.MaxBandwidth, req.ExpiresAt, req.MaxSessions, user.ID)
+	if err != nil {
+		a.audit(r, audit.ActionClientCreate, req.Name, audit.OutcomeFailure, err.Error())
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	a.audit(r, audit.ActionClientCreate, client.ID, audit.OutcomeSuccess, client.Name)
 	
+	response := ClientResponse{
+		Client: client,
+		Secret: secret,
+		Config: a.clientConfig(r, client, secret),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// clientConfig renders the connection config handed to a client's user
+func (a *API) clientConfig(r *http.Request, c *client.Client, secret string) string {
 	// Получаем server address из окружения или используем домен из запроса
 	serverAddr := r.Host
 	if serverAddr == "" {
 		serverAddr = "localhost:8443"
 	}
-	
+
+	network := a.clientManager.TunnelNetwork()
+
+	dnsServers := a.dnsServers
+	if len(dnsServers) == 0 {
+		dnsServers = []string{"8.8.8.8", "8.8.4.4"}
+	}
+
 	// Generate client config в формате совместимом с клиентом
 	config := map[string]interface{}{
 		"server_address": serverAddr,
-		"client_id":      client.ID,
-		"client_secret":  client.Secret,
+		"client_id":      c.ID,
+		"client_secret":  secret,
 		"protocol":       "grpc",
 		"encryption":     "xchacha20-poly1305",
 		"tun_settings": map[string]interface{}{
 			"name":    "yuki",
-			"ip":      "10.0.0.2",
-			"netmask": "255.255.255.0",
-			"gateway": "10.0.0.1",
-			"dns":     []string{"8.8.8.8", "8.8.4.4"},
+			"ip":      c.TunnelIP,
+			"netmask": net.IP(net.CIDRMask(network.Bits(), 32)).String(),
+			"gateway": network.Addr().String(),
+			"dns":     dnsServers,
 		},
 		"advanced": map[string]interface{}{
 			"keep_alive":  30,
@@ -77,63 +177,174 @@ func (a *API) CreateClient(w http.ResponseWriter, r *http.Request) {
 	}
 
 	configJSON, _ := json.Marshal(config)
-
-	response := ClientResponse{
-		Client: client,
-		Config: string(configJSON),
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return string(configJSON)
 }
 
 func (a *API) DeleteClient(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	clientID := vars["uuid"]
+	clientID := mux.Vars(r)["uuid"]
 
-	if !a.clientManager.DeleteClient(clientID) {
+	if _, ok := a.visibleClient(r, clientID); !ok || !a.clientManager.DeleteClient(clientID) {
+		a.audit(r, audit.ActionClientDelete, clientID, audit.OutcomeFailure, "client not found")
 		http.Error(w, "Client not found", http.StatusNotFound)
 		return
 	}
+	a.closeClientSessions(clientID, "client deleted")
+	if a.sessions != nil {
+		a.sessions.SubnetsChanged(clientID)
+	}
+	a.audit(r, audit.ActionClientDelete, clientID, audit.OutcomeSuccess, "")
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (a *API) ListClients(w http.ResponseWriter, r *http.Request) {
-	clients := a.clientManager.ListClients()
+	clients := a.visibleClients(r)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(clients)
 }
 
 func (a *API) BlockClient(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	clientID := vars["uuid"]
+	clientID := mux.Vars(r)["uuid"]
 
-	if !a.clientManager.BlockClient(clientID) {
+	if _, ok := a.visibleClient(r, clientID); !ok || !a.clientManager.BlockClient(clientID) {
+		a.audit(r, audit.ActionClientBlock, clientID, audit.OutcomeFailure, "client not found")
 		http.Error(w, "Client not found", http.StatusNotFound)
 		return
 	}
+	a.closeClientSessions(clientID, "client blocked")
+	a.audit(r, audit.ActionClientBlock, clientID, audit.OutcomeSuccess, "")
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status": "blocked"}`))
 }
 
 func (a *API) UnblockClient(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	clientID := vars["uuid"]
+	clientID := mux.Vars(r)["uuid"]
 
-	if !a.clientManager.UnblockClient(clientID) {
+	if _, ok := a.visibleClient(r, clientID); !ok || !a.clientManager.UnblockClient(clientID) {
+		a.audit(r, audit.ActionClientUnblock, clientID, audit.OutcomeFailure, "client not found")
 		http.Error(w, "Client not found", http.StatusNotFound)
 		return
 	}
+	a.audit(r, audit.ActionClientUnblock, clientID, audit.OutcomeSuccess, "")
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status": "unblocked"}`))
 }
 
+func (a *API) UpdateClient(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["uuid"]
+
+	var req UpdateClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.MaxSessions != nil && *req.MaxSessions < 0 {
+		http.Error(w, "Invalid max_sessions", http.StatusBadRequest)
+		return
+	}
+	// Subnets change the server's routing table, not just the client
+	if req.Subnets != nil && !currentUser(r).Role.Can(admin.PermManageServer) {
+		a.audit(r, audit.ActionClientUpdate, clientID, audit.OutcomeFailure, "subnets require server management")
+		writeError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	update := client.ClientUpdate{
+		Name:         req.Name,
+		MaxBandwidth: req.MaxBandwidth,
+		MaxSessions:  req.MaxSessions,
+		Notes:        req.Notes,
+		Tags:         req.Tags,
+	}
+	if len(req.ExpiresAt) > 0 {
+		if string(req.ExpiresAt) == "null" {
+			update.ClearExpiry = true
+		} else if err := json.Unmarshal(req.ExpiresAt, &update.ExpiresAt); err != nil {
+			http.Error(w, "Invalid expires_at", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, ok := a.visibleClient(r, clientID); !ok {
+		a.audit(r, audit.ActionClientUpdate, clientID, audit.OutcomeFailure, "client not found")
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	// Subnets go first: a conflict must not leave the rest half-applied
+	if req.Subnets != nil {
+		if _, err := a.clientManager.SetSubnets(clientID, *req.Subnets); err != nil {
+			a.audit(r, audit.ActionClientUpdate, clientID, audit.OutcomeFailure, err.Error())
+			switch {
+			case errors.Is(err, client.ErrSubnetConflict):
+				writeError(w, http.StatusConflict, err.Error())
+			case errors.Is(err, client.ErrInvalidSubnet):
+				writeError(w, http.StatusBadRequest, err.Error())
+			default:
+				writeError(w, http.StatusNotFound, err.Error())
+			}
+			return
+		}
+	}
+
+	updated, err := a.clientManager.UpdateClientWithin(quota(currentUser(r)), clientID, update)
+	if err != nil {
+		a.audit(r, audit.ActionClientUpdate, clientID, audit.OutcomeFailure, err.Error())
+		if isQuotaError(err) {
+			writeError(w, http.StatusForbidden, err.Error())
+		} else {
+			http.Error(w, "Client not found", http.StatusNotFound)
+		}
+		return
+	}
+	if a.sessions != nil {
+		a.sessions.ClientChanged(clientID)
+		if req.Subnets != nil {
+			a.sessions.SubnetsChanged(clientID)
+		}
+	}
+	a.audit(r, audit.ActionClientUpdate, clientID, audit.OutcomeSuccess, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// RotateClientSecret issues a new secret, returns a fresh config and
+// terminates every session that authenticated with the old one
+func (a *API) RotateClientSecret(w http.ResponseWriter, r *http.Request) {
+	clientID := mux.Vars(r)["uuid"]
+
+	c, ok := a.visibleClient(r, clientID)
+	if !ok {
+		a.audit(r, audit.ActionClientRotate, clientID, audit.OutcomeFailure, "client not found")
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	secret, ok := a.clientManager.RotateSecret(clientID)
+	if !ok {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	a.closeClientSessions(clientID, "client secret rotated")
+	a.audit(r, audit.ActionClientRotate, clientID, audit.OutcomeSuccess, "")
+
+	response := ClientResponse{
+		Client: c,
+		Secret: secret,
+		Config: a.clientConfig(r, c, secret),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func (a *API) GetStats(w http.ResponseWriter, r *http.Request) {
-	clients := a.clientManager.ListClients()
+	clients := a.visibleClients(r)
 	
 	totalClients := len(clients)
 	activeClients := 0
@@ -154,6 +365,8 @@ func (a *API) GetStats(w http.ResponseWriter, r *http.Request) {
 		"total_traffic_up":   totalTrafficUp,
 		"total_traffic_down": totalTrafficDown,
 		"server_uptime":      time.Since(time.Now().Add(-time.Hour)).Seconds(),
+		"compression":        compress.Totals(),
+		"latency":            sessionLatency(a.visibleSessions(r)),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -198,15 +411,47 @@ func (a *API) SetupRoutes() *mux.Router {
 	router.HandleFunc("/admin/", a.AdminPanelPage).Methods("GET")
 	router.HandleFunc("/admin/api/login", a.LoginHandler).Methods("POST")
 
-	// Admin API endpoints (protected by session)
+	// Admin API endpoints (protected by session, every route requires a permission)
 	api := router.PathPrefix("/admin/api").Subrouter()
 	api.Use(a.sessionMiddleware)
-	api.HandleFunc("/clients", a.CreateClient).Methods("POST")
-	api.HandleFunc("/clients", a.ListClients).Methods("GET")
-	api.HandleFunc("/clients/{uuid}", a.DeleteClient).Methods("DELETE")
-	api.HandleFunc("/clients/{uuid}/block", a.BlockClient).Methods("POST")
-	api.HandleFunc("/clients/{uuid}/unblock", a.UnblockClient).Methods("POST")
-	api.HandleFunc("/stats", a.GetStats).Methods("GET")
+	api.HandleFunc("/logout", a.LogoutHandler).Methods("POST")
+	api.HandleFunc("/me", a.GetMe).Methods("GET")
+	api.HandleFunc("/me/totp", a.BeginTOTP).Methods("POST")
+	api.HandleFunc("/me/totp/confirm", a.ConfirmTOTP).Methods("POST")
+	api.HandleFunc("/me/totp", a.DisableTOTP).Methods("DELETE")
+	api.HandleFunc("/clients", a.require(admin.PermManageClients, a.CreateClient)).Methods("POST")
+	api.HandleFunc("/clients", a.require(admin.PermViewClients, a.ListClients)).Methods("GET")
+	api.HandleFunc("/clients/{uuid}", a.require(admin.PermManageClients, a.UpdateClient)).Methods("PATCH")
+	api.HandleFunc("/clients/{uuid}", a.require(admin.PermManageClients, a.DeleteClient)).Methods("DELETE")
+	api.HandleFunc("/clients/{uuid}/rotate-secret", a.require(admin.PermManageClients, a.RotateClientSecret)).Methods("POST")
+	api.HandleFunc("/clients/{uuid}/block", a.require(admin.PermManageClients, a.BlockClient)).Methods("POST")
+	api.HandleFunc("/clients/{uuid}/unblock", a.require(admin.PermManageClients, a.UnblockClient)).Methods("POST")
+	api.HandleFunc("/clients/{uuid}/forwards", a.require(admin.PermViewClients, a.ListForwards)).Methods("GET")
+	api.HandleFunc("/clients/{uuid}/forwards", a.require(admin.PermManageServer, a.CreateForward)).Methods("POST")
+	api.HandleFunc("/clients/{uuid}/forwards/{id}", a.require(admin.PermManageServer, a.DeleteForward)).Methods("DELETE")
+	api.HandleFunc("/sessions", a.require(admin.PermViewClients, a.ListSessions)).Methods("GET")
+	api.HandleFunc("/sessions/notice", a.require(admin.PermManageClients, a.SendNotice)).Methods("POST")
+	api.HandleFunc("/sessions/config", a.require(admin.PermManageServer, a.PushSessionConfig)).Methods("POST")
+	api.HandleFunc("/sessions/{id}", a.require(admin.PermViewClients, a.GetSession)).Methods("GET")
+	api.HandleFunc("/sessions/{id}", a.require(admin.PermManageClients, a.CloseSession)).Methods("DELETE")
+	api.HandleFunc("/stats", a.require(admin.PermViewClients, a.GetStats)).Methods("GET")
+	api.HandleFunc("/dns/stats", a.require(admin.PermManageServer, a.GetDNSStats)).Methods("GET")
+	api.HandleFunc("/acl/policies", a.require(admin.PermManageServer, a.ListPolicies)).Methods("GET")
+	api.HandleFunc("/acl/policies", a.require(admin.PermManageServer, a.CreatePolicy)).Methods("POST")
+	api.HandleFunc("/acl/policies/{id}", a.require(admin.PermManageServer, a.GetPolicy)).Methods("GET")
+	api.HandleFunc("/acl/policies/{id}", a.require(admin.PermManageServer, a.UpdatePolicy)).Methods("PATCH")
+	api.HandleFunc("/acl/policies/{id}", a.require(admin.PermManageServer, a.DeletePolicy)).Methods("DELETE")
+	api.HandleFunc("/acl/stats", a.require(admin.PermManageServer, a.GetACLStats)).Methods("GET")
+	api.HandleFunc("/maintenance", a.require(admin.PermManageServer, a.GetMaintenance)).Methods("GET")
+	api.HandleFunc("/maintenance", a.require(admin.PermManageServer, a.SetMaintenance)).Methods("PUT")
+	api.HandleFunc("/users", a.require(admin.PermManageUsers, a.ListUsers)).Methods("GET")
+	api.HandleFunc("/users", a.require(admin.PermManageUsers, a.CreateUser)).Methods("POST")
+	api.HandleFunc("/users/{id}", a.require(admin.PermManageUsers, a.UpdateUser)).Methods("PATCH")
+	api.HandleFunc("/users/{id}", a.require(admin.PermManageUsers, a.DeleteUser)).Methods("DELETE")
+	api.HandleFunc("/audit", a.require(admin.PermViewAudit, a.QueryAudit)).Methods("GET")
+	api.HandleFunc("/bans", a.require(admin.PermManageSecurity, a.ListBans)).Methods("GET")
+	api.HandleFunc("/bans", a.require(admin.PermManageSecurity, a.ClearBans)).Methods("DELETE")
+	api.HandleFunc("/bans/{key}", a.require(admin.PermManageSecurity, a.ClearBan)).Methods("DELETE")
 
 	return router
 }
@@ -282,11 +527,37 @@ func (a *API) AdminPanel(w http.ResponseWriter, r *http.Request) {
 			<button class="btn" onclick="createClient()">Создать клиента</button>
 		</div>
 
+		<div class="section">
+			<h2>🔑 Двухфакторная аутентификация</h2>
+			<div id="totpStatus"></div>
+			<div id="totpEnroll" style="display: none;">
+				<p style="margin-bottom: 10px;">Отсканируйте QR-код в приложении-аутентификаторе и введите код.</p>
+				<img id="totpQR" alt="TOTP QR code" style="margin-bottom: 10px;" />
+				<p id="totpSecret" style="font-family: monospace; margin-bottom: 10px;"></p>
+				<div class="form-group">
+					<input type="text" id="totpCode" placeholder="123456" autocomplete="one-time-code" />
+				</div>
+				<button class="btn" onclick="confirmTOTP()">Подтвердить</button>
+			</div>
+		</div>
+
 		<div class="section">
 			<h2>📱 Активные клиенты</h2>
 			<button class="btn" onclick="loadClients()">Обновить список</button>
 			<div id="clientsList" class="clients-grid" style="margin-top: 20px;"></div>
 		</div>
+
+		<div class="section" id="maintenanceSection" style="display: none;">
+			<h2>🚧 Режим обслуживания</h2>
+			<div id="maintenanceStatus"></div>
+		</div>
+
+		<div class="section">
+			<h2>🔌 Сессии</h2>
+			<button class="btn" onclick="loadSessions()">Обновить список</button>
+			<button class="btn" onclick="sendNotice()">Сообщение всем</button>
+			<div id="sessionsList" class="clients-grid" style="margin-top: 20px;"></div>
+		</div>
 	</div>
 
 	<script>
@@ -299,8 +570,8 @@ func (a *API) AdminPanel(w http.ResponseWriter, r *http.Request) {
 
 		function logout() {
 			if (confirm('You will be logged out')) {
-				document.cookie = 'yuki_session=; path=/admin; max-age=0;';
-				location.reload();
+				fetch('/admin/api/logout', { method: 'POST' })
+				.finally(function() { location.reload(); });
 			}
 		}
 
@@ -331,10 +602,11 @@ func (a *API) AdminPanel(w http.ResponseWriter, r *http.Request) {
 			})
 			.then(function(data) {
 				if (data.id) {
-					showMessage('Client created! ID: ' + data.id, false);
 					document.getElementById('clientName').value = '';
 					document.getElementById('expiresAt').value = '';
 					downloadClientConfig(data);
+					copyLink(data.id, data.secret);
+					showMessage('Client created! ID: ' + data.id + '. The config was downloaded and the link copied; the secret is not shown again.', false);
 					loadClients();
 				} else {
 					showMessage('Error: ' + (data.error || 'Unknown'), true);
@@ -382,15 +654,13 @@ func (a *API) AdminPanel(w http.ResponseWriter, r *http.Request) {
 				list.innerHTML = clients.map(function(c) {
 					return '<div class="client-card"><h3>Client: ' + c.name + '</h3>' +
 						'<p><strong>ID:</strong> ' + c.id + '</p>' +
-						'<p><strong>Secret:</strong> ' + c.secret.substring(0, 20) + '...</p>' +
-						'<p><strong>Status:</strong> ' + (c.active ? 'Active' : 'Inactive') + '</p>' +
+						'<p><strong>Status:</strong> ' + (c.active ? 'Active (' + c.sessions + ' session' + (c.sessions === 1 ? '' : 's') + ')' : 'Inactive') + '</p>' +
 						'<p><strong>Created:</strong> ' + new Date(c.created).toLocaleString() + '</p>' +
 						'<p><strong>Traffic:</strong> Up: ' + (c.bytes_up / 1024 / 1024).toFixed(2) + ' MB | Down: ' + (c.bytes_down / 1024 / 1024).toFixed(2) + ' MB</p>' +
 						(c.blocked ? '<p style="color: red;"><strong>BLOCKED</strong></p>' : '') +
 						'<div class="actions">' +
-						'<button class="btn btn-small btn-download" onclick="downloadConfig(\'' + c.id + '\', \'' + c.secret + '\', \'' + c.name + '\')">Download Config</button>' +
-						'<button class="btn btn-small" onclick="copyLink(\'' + c.id + '\', \'' + c.secret + '\')">Copy Link</button>' +
 						'<button class="btn btn-small" onclick="toggleBlock(\'' + c.id + '\', ' + c.blocked + ')">' + (c.blocked ? 'Unblock' : 'Block') + '</button>' +
+						'<button class="btn btn-small" onclick="rotateSecret(\'' + c.id + '\')">Rotate Secret</button>' +
 						'<button class="btn btn-small btn-danger" onclick="deleteClient(\'' + c.id + '\')">Delete</button>' +
 						'</div></div>';
 				}).join('');
@@ -398,28 +668,6 @@ func (a *API) AdminPanel(w http.ResponseWriter, r *http.Request) {
 			.catch(function(e) { showMessage('Load error: ' + e, true); });
 		}
 
-		function downloadConfig(clientId, secret, name) {
-			var config = {
-				client_id: clientId,
-				client_secret: secret,
-				server_address: location.hostname,
-				server_port: 443,
-				protocol: 'grpc',
-				encryption: 'xchacha20-poly1305',
-				name: name
-			};
-
-			var blob = new Blob([JSON.stringify(config, null, 2)], { type: 'application/json' });
-			var url = URL.createObjectURL(blob);
-			var a = document.createElement('a');
-			a.href = url;
-			a.download = 'yuki-' + name + '.json';
-			document.body.appendChild(a);
-			a.click();
-			document.body.removeChild(a);
-			URL.revokeObjectURL(url);
-		}
-
 		function deleteClient(clientId) {
 			if (!confirm('Delete this client?')) return;
 
@@ -451,6 +699,27 @@ func (a *API) AdminPanel(w http.ResponseWriter, r *http.Request) {
 			.catch(function(e) { showMessage('Error: ' + e, true); });
 		}
 
+		function rotateSecret(clientId) {
+			if (!confirm('Issue a new secret? Connected devices will be disconnected.')) return;
+
+			fetch('/admin/api/clients/' + clientId + '/rotate-secret', { method: 'POST' })
+			.then(function(r) {
+				if (r.status === 401) { location.href = '/admin/'; return; }
+				return r.json();
+			})
+			.then(function(data) {
+				if (data && data.id) {
+					downloadClientConfig(data);
+					copyLink(data.id, data.secret);
+					showMessage('Secret rotated. The new config was downloaded and the link copied; the secret is not shown again.', false);
+					loadClients();
+				} else {
+					showMessage('Error: ' + ((data && data.error) || 'Unknown'), true);
+				}
+			})
+			.catch(function(e) { showMessage('Error: ' + e, true); });
+		}
+
 		function copyLink(clientId, secret) {
 			var link = 'yuki://' + clientId + ':' + secret + '@' + location.hostname + ':8443?encryption=xchacha20-poly1305';
 			var textarea = document.createElement('textarea');
@@ -462,8 +731,173 @@ func (a *API) AdminPanel(w http.ResponseWriter, r *http.Request) {
 			showMessage('Link copied to clipboard!', false);
 		}
 
+		function loadTOTPStatus() {
+			fetch('/admin/api/me')
+			.then(function(r) { return r.json(); })
+			.then(function(me) {
+				var status = document.getElementById('totpStatus');
+				if (me.totp_enabled) {
+					status.innerHTML = '<p style="margin-bottom: 10px;">✅ Включена</p>' +
+						'<button class="btn btn-danger" onclick="disableTOTP()">Отключить</button>';
+				} else {
+					status.innerHTML = '<p style="margin-bottom: 10px;">⚠️ Не настроена</p>' +
+						'<button class="btn" onclick="beginTOTP()">Включить</button>';
+				}
+			});
+		}
+
+		function beginTOTP() {
+			fetch('/admin/api/me/totp', { method: 'POST' })
+			.then(function(r) { return r.json(); })
+			.then(function(data) {
+				document.getElementById('totpQR').src = data.qr_code;
+				document.getElementById('totpSecret').textContent = data.secret;
+				document.getElementById('totpEnroll').style.display = 'block';
+			})
+			.catch(function(e) { showMessage('Error: ' + e, true); });
+		}
+
+		function confirmTOTP() {
+			var code = document.getElementById('totpCode').value;
+			fetch('/admin/api/me/totp/confirm', {
+				method: 'POST',
+				headers: { 'Content-Type': 'application/json' },
+				body: JSON.stringify({ code: code })
+			})
+			.then(function(r) { return r.json(); })
+			.then(function(data) {
+				if (!data.recovery_codes) {
+					showMessage('Error: ' + (data.error || 'Unknown'), true);
+					return;
+				}
+				document.getElementById('totpEnroll').style.display = 'none';
+				alert('Сохраните коды восстановления, они показываются один раз:\n\n' + data.recovery_codes.join('\n'));
+				loadTOTPStatus();
+			})
+			.catch(function(e) { showMessage('Error: ' + e, true); });
+		}
+
+		function disableTOTP() {
+			var code = prompt('Введите код из приложения или код восстановления');
+			if (!code) return;
+			fetch('/admin/api/me/totp', {
+				method: 'DELETE',
+				headers: { 'Content-Type': 'application/json' },
+				body: JSON.stringify({ code: code })
+			})
+			.then(function(r) {
+				showMessage(r.ok ? 'Two-factor authentication disabled' : 'Invalid code', !r.ok);
+				loadTOTPStatus();
+			});
+		}
+
+		function loadSessions() {
+			fetch('/admin/api/sessions')
+			.then(function(r) {
+				if (r.status === 401) { location.href = '/admin/'; return; }
+				return r.json();
+			})
+			.then(function(sessions) {
+				var list = document.getElementById('sessionsList');
+				if (!sessions || sessions.length === 0) {
+					list.innerHTML = '<p>No live sessions</p>';
+					return;
+				}
+
+				list.innerHTML = sessions.map(function(s) {
+					return '<div class="client-card"><h3>' + s.tunnel_ip + '</h3>' +
+						'<p><strong>Client:</strong> ' + s.client_id + '</p>' +
+						'<p><strong>Remote:</strong> ' + s.remote_addr + '</p>' +
+						'<p><strong>Started:</strong> ' + new Date(s.started).toLocaleString() + '</p>' +
+						'<p><strong>Last ping:</strong> ' + new Date(s.last_ping).toLocaleString() + (s.rtt_ms ? ' (' + s.rtt_ms.toFixed(1) + ' ms)' : '') + '</p>' +
+						'<p><strong>Traffic:</strong> Up: ' + (s.bytes_up / 1024 / 1024).toFixed(2) + ' MB / ' + s.packets_up + ' pkts | Down: ' + (s.bytes_down / 1024 / 1024).toFixed(2) + ' MB / ' + s.packets_down + ' pkts</p>' +
+						'<div class="actions">' +
+						'<button class="btn btn-small" onclick="sendNotice(\'' + s.id + '\')">Notice</button>' +
+						'<button class="btn btn-small btn-danger" onclick="closeSession(\'' + s.id + '\')">Disconnect</button>' +
+						'</div></div>';
+				}).join('');
+			})
+			.catch(function(e) { showMessage('Load error: ' + e, true); });
+		}
+
+		function closeSession(sessionId) {
+			if (!confirm('Disconnect this session?')) return;
+
+			fetch('/admin/api/sessions/' + encodeURIComponent(sessionId), { method: 'DELETE' })
+			.then(function(r) {
+				if (r.status === 401) { location.href = '/admin/'; return; }
+				showMessage(r.ok ? 'Session closed' : 'Error', !r.ok);
+				loadSessions();
+			})
+			.catch(function(e) { showMessage('Error: ' + e, true); });
+		}
+
+		function sendNotice(sessionId) {
+			var text = prompt(sessionId ? 'Message for this session:' : 'Message for all sessions:', '');
+			if (!text) return;
+
+			fetch('/admin/api/sessions/notice', {
+				method: 'POST',
+				headers: { 'Content-Type': 'application/json' },
+				body: JSON.stringify({ text: text, sessions: sessionId ? [sessionId] : [] })
+			})
+			.then(function(r) {
+				if (r.status === 401) { location.href = '/admin/'; return; }
+				if (!r.ok) { showMessage('Error', true); return; }
+				return r.json().then(function(result) {
+					showMessage('Notice sent to ' + result.sent + ' session(s)', false);
+				});
+			})
+			.catch(function(e) { showMessage('Error: ' + e, true); });
+		}
+
+		function loadMaintenance() {
+			fetch('/admin/api/maintenance')
+			.then(function(r) {
+				if (!r.ok) return null;
+				return r.json();
+			})
+			.then(function(m) {
+				if (!m) return;
+				document.getElementById('maintenanceSection').style.display = '';
+				var status = document.getElementById('maintenanceStatus');
+				if (m.enabled) {
+					status.innerHTML = '<p style="margin-bottom: 10px;">Включен' + (m.reason ? ': ' + m.reason : '') + '</p>' +
+						'<button class="btn" onclick="setMaintenance(false)">Выключить</button>';
+				} else {
+					status.innerHTML = '<p style="margin-bottom: 10px;">Выключен</p>' +
+						'<button class="btn btn-danger" onclick="setMaintenance(true)">Включить</button>';
+				}
+			});
+		}
+
+		function setMaintenance(enabled) {
+			var payload = { enabled: enabled };
+			if (enabled) {
+				var reason = prompt('Reason shown to clients (optional):', '');
+				if (reason === null) return;
+				payload.reason = reason;
+				payload.retry_after = 300;
+			}
+
+			fetch('/admin/api/maintenance', {
+				method: 'PUT',
+				headers: { 'Content-Type': 'application/json' },
+				body: JSON.stringify(payload)
+			})
+			.then(function(r) {
+				showMessage(r.ok ? (enabled ? 'Maintenance enabled, sessions are draining' : 'Maintenance disabled') : 'Error', !r.ok);
+				loadMaintenance();
+				loadSessions();
+			})
+			.catch(function(e) { showMessage('Error: ' + e, true); });
+		}
+
 		window.onload = function() {
 			loadClients();
+			loadSessions();
+			loadMaintenance();
+			loadTOTPStatus();
 		};
 	</script>
 </body>
@@ -473,11 +907,12 @@ func (a *API) AdminPanel(w http.ResponseWriter, r *http.Request) {
 
 func (a *API) AdminPanelPage(w http.ResponseWriter, r *http.Request) {
 	// Check if user has session
-	session, _ := r.Cookie("yuki_session")
-	if session != nil {
-		// User is logged in, show admin panel
-		a.AdminPanel(w, r)
-		return
+	if session, err := r.Cookie(sessionCookie); err == nil {
+		if _, ok := a.adminManager.SessionUser(session.Value); ok {
+			// User is logged in, show admin panel
+			a.AdminPanel(w, r)
+			return
+		}
 	}
 
 	// Show login page
@@ -520,6 +955,10 @@ func (a *API) AdminPanelPage(w http.ResponseWriter, r *http.Request) {
 				<label>Password</label>
 				<input type="password" id="password" required />
 			</div>
+			<div class="form-group" id="codeGroup" style="display: none;">
+				<label>Authenticator code or recovery code</label>
+				<input type="text" id="code" autocomplete="one-time-code" />
+			</div>
 			<button type="submit" class="btn">Sign In</button>
 		</form>
 	</div>
@@ -530,12 +969,13 @@ func (a *API) AdminPanelPage(w http.ResponseWriter, r *http.Request) {
 			
 			const login = document.getElementById('login').value;
 			const password = document.getElementById('password').value;
+			const code = document.getElementById('code').value;
 			const msgDiv = document.getElementById('message');
 
 			fetch('/admin/api/login', {
 				method: 'POST',
 				headers: { 'Content-Type': 'application/json' },
-				body: JSON.stringify({ login, password })
+				body: JSON.stringify({ login, password, code })
 			})
 			.then(r => {
 				if (r.ok) {
@@ -543,11 +983,17 @@ func (a *API) AdminPanelPage(w http.ResponseWriter, r *http.Request) {
 					msgDiv.style.display = 'block';
 					msgDiv.className = 'success';
 					setTimeout(() => location.reload(), 1000);
-				} else {
-					msgDiv.textContent = '❌ Invalid login or password';
+					return;
+				}
+				return r.json().then(data => {
+					if (data.totp_required) {
+						document.getElementById('codeGroup').style.display = 'block';
+						document.getElementById('code').focus();
+					}
+					msgDiv.textContent = data.totp_required && !code ? '🔑 Enter the code from your authenticator' : '❌ Invalid login, password or code';
 					msgDiv.style.display = 'block';
 					msgDiv.className = 'error';
-				}
+				});
 			})
 			.catch(e => {
 				msgDiv.textContent = '❌ Error: ' + e;
@@ -565,6 +1011,7 @@ func (a *API) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Login    string `json:"login"`
 		Password string `json:"password"`
+		Code     string `json:"code"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -572,34 +1019,77 @@ func (a *API) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check credentials
-	if req.Login == a.adminLogin && req.Password == a.adminPassword {
-		// Set session cookie (valid for 7 days)
-		http.SetCookie(w, &http.Cookie{
-			Name:     "yuki_session",
-			Value:    "authenticated",
-			Path:     "/admin",
-			MaxAge:   604800, // 7 days
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-		})
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	// Refuse banned sources and accounts before doing any password work
+	keys := a.loginGuardKeys(sourceIP(r), req.Login)
+	if retry, banned := a.guard.Banned(keys...); banned {
+		writeBanned(w, retry)
 		return
 	}
 
-	w.WriteHeader(http.StatusUnauthorized)
-	json.NewEncoder(w).Encode(map[string]string{"error": "invalid credentials"})
-}
+	// Check credentials
+	user, ok := a.adminManager.Authenticate(req.Login, req.Password)
+	if !ok {
+		a.loginFailed(r, keys, req.Login, "invalid credentials")
+		writeError(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
 
-func (a *API) sessionMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, err := r.Cookie("yuki_session")
-		if err != nil || session.Value != "authenticated" {
+	// Second factor is checked before any session is issued
+	if user.TOTPEnabled {
+		if req.Code == "" {
+			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "totp code required", "totp_required": true})
 			return
 		}
-		next.ServeHTTP(w, r)
+		if !a.adminManager.VerifySecondFactor(user.ID, req.Code) {
+			a.loginFailed(r, keys, user.Login, "invalid TOTP code")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid totp code", "totp_required": true})
+			return
+		}
+	}
+	a.guard.Success(keys...)
+
+	token, err := a.adminManager.CreateSession(user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "session creation failed")
+		return
+	}
+	a.auditLog.Record(audit.Event{
+		Actor:    user.Login,
+		Action:   audit.ActionLogin,
+		SourceIP: sourceIP(r),
+		Outcome:  audit.OutcomeSuccess,
+	})
+
+	// Set session cookie (valid for 7 days)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/admin",
+		MaxAge:   int(admin.SessionTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	})
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "role": string(user.Role)})
+}
+
+func (a *API) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	a.audit(r, audit.ActionLogout, "", audit.OutcomeSuccess, "")
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		a.adminManager.DeleteSession(cookie.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/admin",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
 }
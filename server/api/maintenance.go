@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"yuki-server/audit"
+	"yuki-server/tunnel"
+)
+
+// defaultDrainSeconds is how long live sessions get to reconnect elsewhere
+// when a request does not say
+const defaultDrainSeconds = 30
+
+type MaintenanceRequest struct {
+	Enabled       bool   `json:"enabled"`
+	Reason        string `json:"reason"`
+	RetryAfter    int64  `json:"retry_after"`
+	ServerAddress string `json:"server_address"`
+	DrainSeconds  *int   `json:"drain_seconds"`
+}
+
+func (a *API) GetMaintenance(w http.ResponseWriter, r *http.Request) {
+	if a.sessions == nil {
+		writeError(w, http.StatusServiceUnavailable, "tunnel server unavailable")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.sessions.Maintenance())
+}
+
+// SetMaintenance switches maintenance mode. Enabling it refuses new sessions
+// and drains live ones within drain_seconds.
+func (a *API) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	if a.sessions == nil {
+		writeError(w, http.StatusServiceUnavailable, "tunnel server unavailable")
+		return
+	}
+
+	var req MaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	drain := defaultDrainSeconds
+	if req.DrainSeconds != nil {
+		drain = *req.DrainSeconds
+	}
+	if drain < 0 || req.RetryAfter < 0 {
+		http.Error(w, "Invalid drain_seconds or retry_after", http.StatusBadRequest)
+		return
+	}
+
+	a.sessions.SetMaintenance(tunnel.Maintenance{
+		Enabled:       req.Enabled,
+		Reason:        req.Reason,
+		RetryAfter:    req.RetryAfter,
+		ServerAddress: req.ServerAddress,
+	}, time.Duration(drain)*time.Second)
+
+	details := "disabled"
+	if req.Enabled {
+		details = fmt.Sprintf("enabled, drain %ds", drain)
+	}
+	a.audit(r, audit.ActionMaintenance, "", audit.OutcomeSuccess, details)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.sessions.Maintenance())
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"yuki-server/audit"
+	"yuki-server/tunnel"
+
+	"github.com/gorilla/mux"
+)
+
+// visibleSessions returns the live sessions of the clients the current user
+// is allowed to see
+func (a *API) visibleSessions(r *http.Request) []tunnel.SessionInfo {
+	sessions := make([]tunnel.SessionInfo, 0)
+	if a.sessions == nil {
+		return sessions
+	}
+
+	for _, session := range a.sessions.Sessions() {
+		if _, ok := a.visibleClient(r, session.ClientID); ok {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// visibleSession looks up a session, hiding sessions of clients outside the
+// user's scope
+func (a *API) visibleSession(r *http.Request, id string) (tunnel.SessionInfo, bool) {
+	if a.sessions == nil {
+		return tunnel.SessionInfo{}, false
+	}
+
+	session, exists := a.sessions.GetSession(id)
+	if !exists {
+		return tunnel.SessionInfo{}, false
+	}
+	if _, ok := a.visibleClient(r, session.ClientID); !ok {
+		return tunnel.SessionInfo{}, false
+	}
+	return session, true
+}
+
+// latency summarizes the round trips of the sessions that measured one
+type latency struct {
+	Sessions        int     `json:"sessions"`
+	AvgRTTMillis    float64 `json:"avg_rtt_ms"`
+	MaxRTTMillis    float64 `json:"max_rtt_ms"`
+	AvgJitterMillis float64 `json:"avg_jitter_ms"`
+}
+
+func sessionLatency(sessions []tunnel.SessionInfo) latency {
+	var summary latency
+	for _, session := range sessions {
+		if session.RTTMillis == 0 {
+			continue
+		}
+		summary.Sessions++
+		summary.AvgRTTMillis += session.RTTMillis
+		summary.MaxRTTMillis = max(summary.MaxRTTMillis, session.RTTMillis)
+		summary.AvgJitterMillis += session.JitterMillis
+	}
+	if summary.Sessions > 0 {
+		summary.AvgRTTMillis /= float64(summary.Sessions)
+		summary.AvgJitterMillis /= float64(summary.Sessions)
+	}
+	return summary
+}
+
+func (a *API) ListSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := a.visibleSessions(r)
+
+	// Narrow down to one client with ?client=<uuid>
+	if clientID := r.URL.Query().Get("client"); clientID != "" {
+		filtered := make([]tunnel.SessionInfo, 0)
+		for _, session := range sessions {
+			if session.ClientID == clientID {
+				filtered = append(filtered, session)
+			}
+		}
+		sessions = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (a *API) GetSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.visibleSession(r, mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+func (a *API) CloseSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	if _, ok := a.visibleSession(r, sessionID); !ok || !a.sessions.CloseSession(sessionID, "session closed by administrator") {
+		a.audit(r, audit.ActionSessionClose, sessionID, audit.OutcomeFailure, "session not found")
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	a.audit(r, audit.ActionSessionClose, sessionID, audit.OutcomeSuccess, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionTarget selects the sessions a control message goes to. With no
+// sessions and no clients it selects every session the user can see.
+type SessionTarget struct {
+	Sessions []string `json:"sessions"`
+	Clients  []string `json:"clients"`
+}
+
+type NoticeRequest struct {
+	SessionTarget
+	Text  string             `json:"text"`
+	Level tunnel.NoticeLevel `json:"level"`
+}
+
+type ConfigUpdateRequest struct {
+	SessionTarget
+	tunnel.ConfigUpdate
+}
+
+// targetSessions resolves a target to the IDs of visible live sessions
+func (a *API) targetSessions(r *http.Request, target SessionTarget) []string {
+	all := len(target.Sessions) == 0 && len(target.Clients) == 0
+	sessionIDs := make(map[string]bool)
+	for _, id := range target.Sessions {
+		sessionIDs[id] = true
+	}
+	clientIDs := make(map[string]bool)
+	for _, id := range target.Clients {
+		clientIDs[id] = true
+	}
+
+	var ids []string
+	for _, session := range a.visibleSessions(r) {
+		if all || sessionIDs[session.ID] || clientIDs[session.ClientID] {
+			ids = append(ids, session.ID)
+		}
+	}
+	return ids
+}
+
+// SendNotice shows a message to the users of the selected sessions
+func (a *API) SendNotice(w http.ResponseWriter, r *http.Request) {
+	if a.sessions == nil {
+		writeError(w, http.StatusServiceUnavailable, "tunnel server unavailable")
+		return
+	}
+
+	var req NoticeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Level == "" {
+		req.Level = tunnel.NoticeInfo
+	}
+	if req.Text == "" || !req.Level.Valid() {
+		http.Error(w, "Text is required and level must be info, warning or critical", http.StatusBadRequest)
+		return
+	}
+
+	sent := a.sessions.SendNotice(a.targetSessions(r, req.SessionTarget), tunnel.Notice{Text: req.Text, Level: req.Level})
+	a.audit(r, audit.ActionSessionNotice, "", audit.OutcomeSuccess, fmt.Sprintf("%s notice to %d session(s)", req.Level, sent))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"sent": sent})
+}
+
+// PushSessionConfig changes DNS, routes or MTU of the selected sessions
+func (a *API) PushSessionConfig(w http.ResponseWriter, r *http.Request) {
+	if a.sessions == nil {
+		writeError(w, http.StatusServiceUnavailable, "tunnel server unavailable")
+		return
+	}
+
+	var req ConfigUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := req.ConfigUpdate.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sent := a.sessions.SendConfigUpdate(a.targetSessions(r, req.SessionTarget), req.ConfigUpdate)
+	a.audit(r, audit.ActionSessionConfig, "", audit.OutcomeSuccess, fmt.Sprintf("config update to %d session(s)", sent))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"sent": sent})
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"yuki-server/admin"
+	"yuki-server/audit"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+type TOTPEnrollmentResponse struct {
+	*admin.TOTPEnrollment
+	// QRCode is a PNG data URL of the otpauth:// URI for authenticator apps
+	QRCode string `json:"qr_code"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// BeginTOTP starts authenticator enrollment for the current admin
+func (a *API) BeginTOTP(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := a.adminManager.BeginTOTPEnrollment(currentUser(r).ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	png, err := qrcode.Encode(enrollment.URI, qrcode.Medium, 256)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "QR code generation failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TOTPEnrollmentResponse{
+		TOTPEnrollment: enrollment,
+		QRCode:         "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// ConfirmTOTP enables TOTP once the admin proves their authenticator works
+func (a *API) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := a.adminManager.ConfirmTOTP(currentUser(r).ID, req.Code)
+	if err != nil {
+		a.audit(r, audit.ActionTOTPEnable, "", audit.OutcomeFailure, err.Error())
+		writeTOTPError(w, err)
+		return
+	}
+	a.audit(r, audit.ActionTOTPEnable, "", audit.OutcomeSuccess, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTOTP turns off TOTP for the current admin
+func (a *API) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := a.adminManager.DisableTOTP(currentUser(r).ID, req.Code); err != nil {
+		a.audit(r, audit.ActionTOTPDisable, "", audit.OutcomeFailure, err.Error())
+		writeTOTPError(w, err)
+		return
+	}
+	a.audit(r, audit.ActionTOTPDisable, "", audit.OutcomeSuccess, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeTOTPError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, admin.ErrTOTPInvalidCode):
+		writeError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, admin.ErrTOTPNotPending), errors.Is(err, admin.ErrTOTPNotEnabled):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"yuki-server/admin"
+	"yuki-server/audit"
+
+	"github.com/gorilla/mux"
+)
+
+type CreateUserRequest struct {
+	Login     string           `json:"login"`
+	Password  string           `json:"password"`
+	Role      admin.Role       `json:"role"`
+	Allowance *admin.Allowance `json:"allowance,omitempty"`
+}
+
+func (a *API) GetMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentUser(r).Public())
+}
+
+func (a *API) ListUsers(w http.ResponseWriter, r *http.Request) {
+	users := a.adminManager.ListUsers()
+
+	response := make([]*admin.User, 0, len(users))
+	for _, user := range users {
+		response = append(response, user.Public())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (a *API) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, err := a.adminManager.CreateUser(req.Login, req.Password, req.Role, req.Allowance)
+	if err != nil {
+		a.audit(r, audit.ActionUserCreate, req.Login, audit.OutcomeFailure, err.Error())
+		writeUserError(w, err)
+		return
+	}
+	a.audit(r, audit.ActionUserCreate, user.Login, audit.OutcomeSuccess, string(user.Role))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user.Public())
+}
+
+func (a *API) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var req admin.UserUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	userID := mux.Vars(r)["id"]
+	user, err := a.adminManager.UpdateUser(userID, req)
+	if err != nil {
+		a.audit(r, audit.ActionUserUpdate, userID, audit.OutcomeFailure, err.Error())
+		writeUserError(w, err)
+		return
+	}
+	a.audit(r, audit.ActionUserUpdate, user.Login, audit.OutcomeSuccess, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.Public())
+}
+
+func (a *API) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	if err := a.adminManager.DeleteUser(userID); err != nil {
+		a.audit(r, audit.ActionUserDelete, userID, audit.OutcomeFailure, err.Error())
+		writeUserError(w, err)
+		return
+	}
+	a.audit(r, audit.ActionUserDelete, userID, audit.OutcomeSuccess, "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, admin.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, admin.ErrUserExists):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, admin.ErrInvalidRole), errors.Is(err, admin.ErrEmptyLogin), errors.Is(err, admin.ErrLastOwner):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,383 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ActionLogin         = "admin.login"
+	ActionLogout        = "admin.logout"
+	ActionTOTPEnable    = "admin.totp_enable"
+	ActionTOTPDisable   = "admin.totp_disable"
+	ActionClientCreate  = "client.create"
+	ActionClientUpdate  = "client.update"
+	ActionClientRotate  = "client.rotate_secret"
+	ActionClientDelete  = "client.delete"
+	ActionClientBlock   = "client.block"
+	ActionClientUnblock = "client.unblock"
+	ActionForwardCreate = "client.forward_create"
+	ActionForwardDelete = "client.forward_delete"
+	ActionUserCreate    = "user.create"
+	ActionUserUpdate    = "user.update"
+	ActionUserDelete    = "user.delete"
+	ActionTunnelAuth    = "tunnel.auth"
+	ActionSessionClose  = "session.close"
+	ActionSessionNotice = "session.notice"
+	ActionSessionConfig = "session.config"
+	ActionBan           = "security.ban"
+	ActionBanClear      = "security.ban_clear"
+	ActionMaintenance   = "server.maintenance"
+	ActionACLCreate     = "acl.create"
+	ActionACLUpdate     = "acl.update"
+	ActionACLDelete     = "acl.delete"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+type Event struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target,omitempty"`
+	SourceIP string    `json:"source_ip,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Details  string    `json:"details,omitempty"`
+}
+
+// Filter selects events in Query. Empty fields match everything.
+type Filter struct {
+	Actor    string
+	Action   string
+	Target   string
+	SourceIP string
+	Outcome  string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (f Filter) matches(e *Event) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	// Action filters match by prefix so "client." selects every client action
+	if f.Action != "" && !strings.HasPrefix(e.Action, f.Action) {
+		return false
+	}
+	if f.Target != "" && e.Target != f.Target {
+		return false
+	}
+	if f.SourceIP != "" && e.SourceIP != f.SourceIP {
+		return false
+	}
+	if f.Outcome != "" && e.Outcome != f.Outcome {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+const (
+	defaultMemoryEvents = 10000
+	defaultMaxFileSize  = 10 << 20
+	defaultMaxFiles     = 5
+)
+
+// Retention bounds what the audit log keeps. Zero fields take the defaults.
+type Retention struct {
+	// MemoryEvents is how many recent events are kept in memory; older
+	// ones are read back from the files
+	MemoryEvents int
+	// MaxFileSize rotates the file once it grows past that many bytes
+	MaxFileSize int64
+	// MaxFiles is how many rotated files are kept, the oldest are deleted
+	MaxFiles int
+}
+
+func (r Retention) withDefaults() Retention {
+	if r.MemoryEvents <= 0 {
+		r.MemoryEvents = defaultMemoryEvents
+	}
+	if r.MaxFileSize <= 0 {
+		r.MaxFileSize = defaultMaxFileSize
+	}
+	if r.MaxFiles <= 0 {
+		r.MaxFiles = defaultMaxFiles
+	}
+	return r
+}
+
+// Log is an append-only audit trail. Recent events are kept in memory for
+// queries, every event is appended to a JSONL file that is rotated by size,
+// and optionally mirrored to a second JSONL file for SIEM ingestion. A nil
+// *Log discards events.
+type Log struct {
+	retention Retention
+
+	// recent is a ring of the newest events, head is the oldest
+	recent []Event
+	head   int
+	count  int
+
+	path   string
+	file   *os.File
+	size   int64
+	mirror *os.File
+	mutex  sync.RWMutex
+}
+
+// NewLog opens the audit log. The newest events in path are loaded on
+// start. Either path may be empty.
+func NewLog(path, mirrorPath string, retention Retention) (*Log, error) {
+	retention = retention.withDefaults()
+	l := &Log{
+		retention: retention,
+		recent:    make([]Event, retention.MemoryEvents),
+		path:      path,
+	}
+
+	if path != "" {
+		if err := l.load(path); err != nil {
+			return nil, err
+		}
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	if mirrorPath != "" {
+		mirror, err := os.OpenFile(mirrorPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.mirror = mirror
+	}
+
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// load fills the ring from the current file, which rotation keeps small
+func (l *Log) load(path string) error {
+	return readEvents(path, func(e Event) {
+		l.remember(e)
+	})
+}
+
+// readEvents calls fn for each event in a JSONL file, oldest first
+func readEvents(path string, fn func(Event)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Skip a torn last line rather than refusing to start
+			continue
+		}
+		fn(e)
+	}
+	return scanner.Err()
+}
+
+// remember puts an event in the ring, overwriting the oldest when full
+func (l *Log) remember(e Event) {
+	if l.count < len(l.recent) {
+		l.recent[(l.head+l.count)%len(l.recent)] = e
+		l.count++
+		return
+	}
+	l.recent[l.head] = e
+	l.head = (l.head + 1) % len(l.recent)
+}
+
+// rotatedPath is the name of the n-th rotated file, 1 being the newest
+func (l *Log) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// rotate moves the current file aside and starts a new one, deleting the
+// rotated files beyond the retention
+func (l *Log) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	os.Remove(l.rotatedPath(l.retention.MaxFiles))
+	for n := l.retention.MaxFiles - 1; n >= 1; n-- {
+		os.Rename(l.rotatedPath(n), l.rotatedPath(n+1))
+	}
+	if err := os.Rename(l.path, l.rotatedPath(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Record appends an event, filling in its ID and timestamp
+func (l *Log) Record(e Event) {
+	if l == nil {
+		return
+	}
+
+	e.ID = uuid.New().String()
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Outcome == "" {
+		e.Outcome = OutcomeSuccess
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.remember(e)
+	if l.file != nil && l.size+int64(len(line)) > l.retention.MaxFileSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			log.Printf("⚠️ Audit rotation failed: %v", err)
+			if l.file == nil {
+				l.open()
+			}
+		}
+	}
+	if l.file != nil {
+		if _, err := l.file.Write(line); err != nil {
+			log.Printf("⚠️ Audit write failed: %v", err)
+		}
+		l.size += int64(len(line))
+	}
+	if l.mirror != nil {
+		if _, err := l.mirror.Write(line); err != nil {
+			log.Printf("⚠️ Audit write failed: %v", err)
+		}
+	}
+}
+
+// Query returns matching events, newest first. Events that no longer fit in
+// memory are read back from the files.
+func (l *Log) Query(f Filter) []Event {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	result := make([]Event, 0)
+	for i := l.count - 1; i >= 0; i-- {
+		e := &l.recent[(l.head+i)%len(l.recent)]
+		if !f.matches(e) {
+			continue
+		}
+		result = append(result, *e)
+		if f.Limit > 0 && len(result) >= f.Limit {
+			return result
+		}
+	}
+
+	if l.path == "" || l.count < len(l.recent) {
+		// Everything on disk is still in memory
+		return result
+	}
+	return l.queryFiles(f, result)
+}
+
+// queryFiles appends the matching events older than the ring, reading the
+// files newest first; must be called with the mutex held
+func (l *Log) queryFiles(f Filter, result []Event) []Event {
+	oldest := l.recent[l.head].ID
+	// Events are skipped until the oldest one in memory has gone by
+	skipping := true
+
+	paths := []string{l.path}
+	for n := 1; n <= l.retention.MaxFiles; n++ {
+		paths = append(paths, l.rotatedPath(n))
+	}
+	for _, path := range paths {
+		var events []Event
+		err := readEvents(path, func(e Event) {
+			events = append(events, e)
+		})
+		if err != nil {
+			log.Printf("⚠️ Audit read failed: %v", err)
+			continue
+		}
+		for i := len(events) - 1; i >= 0; i-- {
+			if skipping {
+				skipping = events[i].ID != oldest
+				continue
+			}
+			if !f.matches(&events[i]) {
+				continue
+			}
+			result = append(result, events[i])
+			if f.Limit > 0 && len(result) >= f.Limit {
+				return result
+			}
+		}
+	}
+	return result
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, f := range []*os.File{l.file, l.mirror} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	l.file = nil
+	l.mirror = nil
+	return nil
+}
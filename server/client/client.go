@@ -1,31 +1,139 @@
 package client
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
 	"os"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/google/uuid"
+	"golang.org/x/net/idna"
 )
 
 type Client struct {
 	ID          string    `json:"id"`
-	Secret      string    `json:"secret"`
 	Name        string    `json:"name"`
 	Created     time.Time `json:"created"`
 	LastSeen    time.Time `json:"last_seen"`
+	// Active is set while Sessions, the number of live tunnel sessions, is
+	// above zero
 	Active      bool      `json:"active"`
+	Sessions    int       `json:"sessions"`
+	// MaxSessions caps concurrent sessions; 0 uses the server default
+	MaxSessions int       `json:"max_sessions,omitempty"`
 	Blocked     bool      `json:"blocked"`
 	BytesUp     int64     `json:"bytes_up"`
 	BytesDown   int64     `json:"bytes_down"`
 	MaxBandwidth int64     `json:"max_bandwidth"`
 	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	OwnerID     string    `json:"owner_id,omitempty"`
+	TunnelIP    string    `json:"tunnel_ip,omitempty"`
+	Notes       string    `json:"notes,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	// Subnets are networks behind the client, such as an office LAN behind
+	// a router, that the server routes to its session
+	Subnets     []string  `json:"subnets,omitempty"`
+	// Forwards publish services of the client on the server's public
+	// address while it is connected
+	Forwards    []Forward `json:"forwards,omitempty"`
+
+	// Only a salted verifier of the secret is kept; the secret itself is
+	// handed out once when it is issued
+	secretSalt []byte
+	secretHash []byte
+}
+
+// clone returns a copy of the client that stays valid after the manager's
+// lock is released
+func (c *Client) clone() *Client {
+	clone := *c
+	if c.ExpiresAt != nil {
+		expiresAt := *c.ExpiresAt
+		clone.ExpiresAt = &expiresAt
+	}
+	clone.Tags = append([]string(nil), c.Tags...)
+	clone.Subnets = append([]string(nil), c.Subnets...)
+	clone.Forwards = append([]Forward(nil), c.Forwards...)
+	return &clone
+}
+
+// storedClient is the on-disk form of a client
+type storedClient struct {
+	*Client
+	SecretSalt string `json:"secret_salt,omitempty"`
+	SecretHash string `json:"secret_hash,omitempty"`
+	// Secret is the legacy cleartext field, only read to migrate old files
+	Secret string `json:"secret,omitempty"`
+}
+
+// Forward publishes TargetPort on the client's tunnel address as
+// PublicPort on the server
+type Forward struct {
+	ID         string    `json:"id"`
+	Protocol   string    `json:"protocol"`
+	PublicPort int       `json:"public_port"`
+	TargetPort int       `json:"target_port"`
+	Created    time.Time `json:"created"`
+}
+
+// ClientUpdate describes an in-place edit; nil fields are left untouched
+type ClientUpdate struct {
+	Name         *string
+	MaxBandwidth *int64
+	ExpiresAt    *time.Time
+	ClearExpiry  bool
+	MaxSessions  *int
+	Notes        *string
+	Tags         *[]string
+}
+
+var (
+	ErrClientNotFound  = errors.New("client not found")
+	ErrInvalidSubnet   = errors.New("invalid subnet")
+	ErrSubnetConflict  = errors.New("subnet conflict")
+	ErrInvalidForward  = errors.New("invalid forward")
+	ErrPortTaken       = errors.New("public port already forwarded")
+	ErrForwardNotFound = errors.New("forward not found")
+	ErrClientQuota     = errors.New("client allowance exhausted")
+	ErrTrafficQuota    = errors.New("traffic allowance exhausted")
+	ErrNoBandwidth     = errors.New("a bandwidth limit is required")
+)
+
+// Quota bounds the clients of one owner. With a MaxTraffic above 0 every
+// client needs a bandwidth limit, and the limits may not add up to more.
+type Quota struct {
+	MaxClients int
+	MaxTraffic int64
 }
 
 type Manager struct {
 	clients map[string]*Client
 	mutex   sync.RWMutex
+	// network is the tunnel subnet client addresses are assigned from; its
+	// address is the server's gateway
+	network netip.Prefix
+	// hostNetworks lists the server's own networks, which client subnets
+	// may not take over
+	hostNetworks func() []netip.Prefix
+	// reservedPorts are the server's own ports, as "tcp/50051", which
+	// forwards may not take
+	reservedPorts map[string]bool
+	// leased are tunnel addresses lent to additional concurrent sessions
+	// of clients, which new clients may not get
+	leased map[string]bool
+	// path is the clients file; changes that must not wait for the next
+	// periodic save, such as a rotated secret, are written to it at once
+	path string
 }
 
 func NewManager() *Manager {
@@ -34,23 +142,418 @@ func NewManager() *Manager {
 	}
 }
 
-func (m *Manager) CreateClient(name string, maxBandwidth int64, expiresAt *time.Time) *Client {
+// CreateClient adds a client and returns it along with its secret. The secret
+// cannot be recovered later, only rotated.
+func (m *Manager) CreateClient(name string, maxBandwidth int64, expiresAt *time.Time, maxSessions int, ownerID string) (*Client, string) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	return m.create(name, maxBandwidth, expiresAt, maxSessions, ownerID)
+}
+
+// CreateClientWithin creates a client for an owner whose clients must stay
+// within quota; nil is no quota. The check and the insert share the lock,
+// so concurrent creates cannot overshoot.
+func (m *Manager) CreateClientWithin(quota *Quota, name string, maxBandwidth int64, expiresAt *time.Time, maxSessions int, ownerID string) (*Client, string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if quota != nil {
+		count, _ := m.ownerUsage(ownerID)
+		if count >= quota.MaxClients {
+			return nil, "", ErrClientQuota
+		}
+		if err := m.checkTraffic(ownerID, quota, maxBandwidth, maxBandwidth); err != nil {
+			return nil, "", err
+		}
+	}
+
+	client, secret := m.create(name, maxBandwidth, expiresAt, maxSessions, ownerID)
+	return client, secret, nil
+}
+
+// checkTraffic verifies an owner's traffic quota can absorb extra bytes of
+// limits for a client whose limit becomes maxBandwidth; must be called with
+// the mutex held
+func (m *Manager) checkTraffic(ownerID string, quota *Quota, extra, maxBandwidth int64) error {
+	if quota == nil || quota.MaxTraffic <= 0 {
+		return nil
+	}
+	if maxBandwidth <= 0 {
+		return ErrNoBandwidth
+	}
+	if _, traffic := m.ownerUsage(ownerID); traffic+extra > quota.MaxTraffic {
+		return ErrTrafficQuota
+	}
+	return nil
+}
+
+// create adds a client; must be called with the mutex held
+func (m *Manager) create(name string, maxBandwidth int64, expiresAt *time.Time, maxSessions int, ownerID string) (*Client, string) {
 	client := &Client{
 		ID:           uuid.New().String(),
-		Secret:       generateSecret(),
 		Name:         name,
 		Created:      time.Now(),
 		Active:       false,
 		Blocked:      false,
 		MaxBandwidth: maxBandwidth,
 		ExpiresAt:    expiresAt,
+		MaxSessions:  maxSessions,
+		OwnerID:      ownerID,
 	}
+	secret := generateSecret()
+	client.setSecret(secret)
+	client.TunnelIP = m.allocateAddress()
 
 	m.clients[client.ID] = client
-	return client
+	return client.clone(), secret
+}
+
+// UpdateClient applies an edit to an existing client
+func (m *Manager) UpdateClient(id string, update ClientUpdate) (*Client, bool) {
+	client, err := m.UpdateClientWithin(nil, id, update)
+	return client, err == nil
+}
+
+// UpdateClientWithin applies an edit to a client whose owner's clients must
+// stay within quota; nil is no quota
+func (m *Manager) UpdateClientWithin(quota *Quota, id string, update ClientUpdate) (*Client, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	client, exists := m.clients[id]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+	if update.MaxBandwidth != nil {
+		if err := m.checkTraffic(client.OwnerID, quota, *update.MaxBandwidth-client.MaxBandwidth, *update.MaxBandwidth); err != nil {
+			return nil, err
+		}
+	}
+
+	if update.Name != nil {
+		client.Name = *update.Name
+	}
+	if update.MaxBandwidth != nil {
+		client.MaxBandwidth = *update.MaxBandwidth
+	}
+	if update.ClearExpiry {
+		client.ExpiresAt = nil
+	} else if update.ExpiresAt != nil {
+		expiresAt := *update.ExpiresAt
+		client.ExpiresAt = &expiresAt
+	}
+	if update.MaxSessions != nil {
+		client.MaxSessions = *update.MaxSessions
+	}
+	if update.Notes != nil {
+		client.Notes = *update.Notes
+	}
+	if update.Tags != nil {
+		client.Tags = append([]string(nil), (*update.Tags)...)
+	}
+
+	return client.clone(), nil
+}
+
+// minSubnetBits is the shortest prefix a client may advertise; anything
+// broader would pull most of the internet into one client
+const minSubnetBits = 8
+
+// reservedNetwork is the IPv4 range set aside for future use and broadcast
+var reservedNetwork = netip.MustParsePrefix("240.0.0.0/4")
+
+// SetHostNetworks sets how to list the networks of the server's interfaces
+// and routes. Client subnets may not overlap them, or a client could take
+// over the server's own LAN or container networks.
+func (m *Manager) SetHostNetworks(networks func() []netip.Prefix) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hostNetworks = networks
+}
+
+// SetSubnets replaces the networks routed to a client. Subnets must be IPv4
+// unicast networks no broader than a /8, and may not overlap the tunnel
+// network, the server's own networks or another client's subnets.
+func (m *Manager) SetSubnets(id string, subnets []string) (*Client, error) {
+	prefixes := make([]netip.Prefix, 0, len(subnets))
+	for _, subnet := range subnets {
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil || !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("%w %q", ErrInvalidSubnet, subnet)
+		}
+		prefix = prefix.Masked()
+		if prefix.Bits() < minSubnetBits {
+			return nil, fmt.Errorf("%w %q: prefixes shorter than /%d are not routed to clients", ErrInvalidSubnet, subnet, minSubnetBits)
+		}
+		if addr := prefix.Addr(); addr.IsUnspecified() || addr.IsLoopback() || addr.IsMulticast() || addr.IsLinkLocalUnicast() || reservedNetwork.Overlaps(prefix) {
+			return nil, fmt.Errorf("%w %q: not a unicast network", ErrInvalidSubnet, subnet)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	m.mutex.RLock()
+	hostNetworks := m.hostNetworks
+	m.mutex.RUnlock()
+	if hostNetworks != nil {
+		// Listed outside the lock: it asks the kernel
+		for _, network := range hostNetworks() {
+			for _, prefix := range prefixes {
+				if prefix.Overlaps(network) {
+					return nil, fmt.Errorf("%w: %s overlaps the server's network %s", ErrSubnetConflict, prefix, network)
+				}
+			}
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	client, exists := m.clients[id]
+	if !exists {
+		return nil, ErrClientNotFound
+	}
+
+	for i, prefix := range prefixes {
+		if m.network.IsValid() && prefix.Overlaps(m.network) {
+			return nil, fmt.Errorf("%w: %s overlaps the tunnel network", ErrSubnetConflict, prefix)
+		}
+		for _, other := range prefixes[:i] {
+			if prefix.Overlaps(other) {
+				return nil, fmt.Errorf("%w: %s overlaps %s", ErrSubnetConflict, prefix, other)
+			}
+		}
+		for _, other := range m.clients {
+			if other.ID == id {
+				continue
+			}
+			for _, subnet := range other.Subnets {
+				if taken, err := netip.ParsePrefix(subnet); err == nil && prefix.Overlaps(taken) {
+					return nil, fmt.Errorf("%w: %s overlaps %s of client %s", ErrSubnetConflict, prefix, taken, other.Name)
+				}
+			}
+		}
+	}
+
+	client.Subnets = make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		client.Subnets = append(client.Subnets, prefix.String())
+	}
+	return client.clone(), nil
+}
+
+// RoutedSubnets maps every client subnet to the ID of the client it is
+// routed to
+func (m *Manager) RoutedSubnets() map[netip.Prefix]string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	routes := make(map[netip.Prefix]string)
+	for _, client := range m.clients {
+		for _, subnet := range client.Subnets {
+			if prefix, err := netip.ParsePrefix(subnet); err == nil {
+				routes[prefix] = client.ID
+			}
+		}
+	}
+	return routes
+}
+
+// ReservePorts keeps forwards off ports the server listens on itself.
+// Forwards already on those ports, which could never listen, are removed.
+func (m *Manager) ReservePorts(protocol string, ports ...int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.reservedPorts == nil {
+		m.reservedPorts = make(map[string]bool)
+	}
+	for _, port := range ports {
+		m.reservedPorts[fmt.Sprintf("%s/%d", protocol, port)] = true
+	}
+
+	removed := 0
+	for _, client := range m.clients {
+		var forwards []Forward
+		for _, forward := range client.Forwards {
+			if m.reservedPorts[fmt.Sprintf("%s/%d", forward.Protocol, forward.PublicPort)] {
+				log.Printf("⚠️ Removed forward %s/%d of client %s: the port is used by the server", forward.Protocol, forward.PublicPort, client.Name)
+				removed++
+				continue
+			}
+			forwards = append(forwards, forward)
+		}
+		if len(forwards) != len(client.Forwards) {
+			client.Forwards = forwards
+		}
+	}
+	if removed > 0 && m.path != "" {
+		if err := m.save(m.path); err != nil {
+			log.Printf("⚠️ Failed to save clients: %v", err)
+		}
+	}
+}
+
+// AddForward publishes a port of a client. Each public port can be
+// forwarded once per protocol.
+func (m *Manager) AddForward(id, protocol string, publicPort, targetPort int) (Forward, error) {
+	if protocol != "tcp" && protocol != "udp" {
+		return Forward{}, fmt.Errorf("%w: protocol must be tcp or udp", ErrInvalidForward)
+	}
+	if publicPort < 1 || publicPort > 65535 || targetPort < 1 || targetPort > 65535 {
+		return Forward{}, fmt.Errorf("%w: ports must be between 1 and 65535", ErrInvalidForward)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	client, exists := m.clients[id]
+	if !exists {
+		return Forward{}, ErrClientNotFound
+	}
+	if m.reservedPorts[fmt.Sprintf("%s/%d", protocol, publicPort)] {
+		return Forward{}, fmt.Errorf("%w: %s/%d is used by the server", ErrPortTaken, protocol, publicPort)
+	}
+	for _, other := range m.clients {
+		for _, forward := range other.Forwards {
+			if forward.Protocol == protocol && forward.PublicPort == publicPort {
+				return Forward{}, fmt.Errorf("%w: %s/%d belongs to client %s", ErrPortTaken, protocol, publicPort, other.Name)
+			}
+		}
+	}
+
+	forward := Forward{
+		ID:         uuid.New().String(),
+		Protocol:   protocol,
+		PublicPort: publicPort,
+		TargetPort: targetPort,
+		Created:    time.Now(),
+	}
+	// Copy, so readers of the old slice are not affected
+	client.Forwards = append(append([]Forward(nil), client.Forwards...), forward)
+	return forward, nil
+}
+
+// RemoveForward deletes a forward of a client
+func (m *Manager) RemoveForward(id, forwardID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	client, exists := m.clients[id]
+	if !exists {
+		return ErrClientNotFound
+	}
+	for i, forward := range client.Forwards {
+		if forward.ID == forwardID {
+			forwards := append([]Forward(nil), client.Forwards[:i]...)
+			client.Forwards = append(forwards, client.Forwards[i+1:]...)
+			return nil
+		}
+	}
+	return ErrForwardNotFound
+}
+
+// RotateSecret replaces a client's secret and returns the new one
+func (m *Manager) RotateSecret(id string) (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	client, exists := m.clients[id]
+	if !exists {
+		return "", false
+	}
+
+	secret := generateSecret()
+	client.setSecret(secret)
+	// A restart before the next periodic save would bring the old secret back
+	if m.path != "" {
+		if err := m.save(m.path); err != nil {
+			log.Printf("⚠️ Failed to save clients: %v", err)
+		}
+	}
+	return secret, true
+}
+
+// SetTunnelNetwork sets the tunnel subnet, e.g. "10.0.0.1/24" with the
+// gateway address, and assigns addresses to clients that lack one
+func (m *Manager) SetTunnelNetwork(cidr string) error {
+	network, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	if !network.Addr().Is4() {
+		return errors.New("tunnel network must be IPv4")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.network = network
+	for _, client := range m.clients {
+		if client.TunnelIP == "" {
+			client.TunnelIP = m.allocateAddress()
+		}
+	}
+	return nil
+}
+
+// TunnelNetwork returns the tunnel subnet with the gateway address
+func (m *Manager) TunnelNetwork() netip.Prefix {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.network
+}
+
+// allocateAddress returns the lowest free host address of the tunnel
+// network, or "" when none is left; must be called with the mutex held
+func (m *Manager) allocateAddress() string {
+	if !m.network.IsValid() {
+		return ""
+	}
+
+	used := make(map[string]bool, len(m.clients)+len(m.leased))
+	for _, client := range m.clients {
+		used[client.TunnelIP] = true
+	}
+	for ip := range m.leased {
+		used[ip] = true
+	}
+
+	gateway := m.network.Addr()
+	for addr := m.network.Masked().Addr().Next(); m.network.Contains(addr); addr = addr.Next() {
+		// The last address is the broadcast address
+		if !m.network.Contains(addr.Next()) {
+			break
+		}
+		if addr != gateway && !used[addr.String()] {
+			return addr.String()
+		}
+	}
+	return ""
+}
+
+// LeaseAddress lends a free tunnel address to a session of a client that
+// already has a session on its own address; ReleaseAddress takes it back
+func (m *Manager) LeaseAddress() (netip.Addr, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	addr, err := netip.ParseAddr(m.allocateAddress())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	if m.leased == nil {
+		m.leased = make(map[string]bool)
+	}
+	m.leased[addr.String()] = true
+	return addr, true
+}
+
+func (m *Manager) ReleaseAddress(addr netip.Addr) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.leased, addr.String())
 }
 
 func (m *Manager) GetClient(id string) (*Client, bool) {
@@ -58,7 +561,23 @@ func (m *Manager) GetClient(id string) (*Client, bool) {
 	defer m.mutex.RUnlock()
 	
 	client, exists := m.clients[id]
-	return client, exists
+	if !exists {
+		return nil, false
+	}
+	return client.clone(), true
+}
+
+// ClientByTunnelIP returns the client that owns a tunnel address
+func (m *Manager) ClientByTunnelIP(ip string) (*Client, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, client := range m.clients {
+		if client.TunnelIP == ip {
+			return client.clone(), true
+		}
+	}
+	return nil, false
 }
 
 func (m *Manager) ListClients() []*Client {
@@ -67,11 +586,45 @@ func (m *Manager) ListClients() []*Client {
 	
 	clients := make([]*Client, 0, len(m.clients))
 	for _, client := range m.clients {
-		clients = append(clients, client)
+		clients = append(clients, client.clone())
 	}
 	return clients
 }
 
+// ListClientsByOwner returns the clients created by the given admin user
+func (m *Manager) ListClientsByOwner(ownerID string) []*Client {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	clients := make([]*Client, 0)
+	for _, client := range m.clients {
+		if client.OwnerID == ownerID {
+			clients = append(clients, client.clone())
+		}
+	}
+	return clients
+}
+
+// OwnerUsage returns how many clients an admin user owns and the sum of their
+// bandwidth limits
+func (m *Manager) OwnerUsage(ownerID string) (int, int64) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.ownerUsage(ownerID)
+}
+
+func (m *Manager) ownerUsage(ownerID string) (int, int64) {
+	count := 0
+	traffic := int64(0)
+	for _, client := range m.clients {
+		if client.OwnerID == ownerID {
+			count++
+			traffic += client.MaxBandwidth
+		}
+	}
+	return count, traffic
+}
+
 func (m *Manager) DeleteClient(id string) bool {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -116,15 +669,26 @@ func (m *Manager) UpdateTraffic(id string, bytesUp, bytesDown int64) {
 	}
 }
 
-func (m *Manager) SetActive(id string, active bool) {
+// SessionOpened counts a new live session of a client
+func (m *Manager) SessionOpened(id string) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	
 	if client, exists := m.clients[id]; exists {
-		client.Active = active
-		if active {
-			client.LastSeen = time.Now()
-		}
+		client.Sessions++
+		client.Active = true
+		client.LastSeen = time.Now()
+	}
+}
+
+// SessionClosed counts a live session of a client as gone
+func (m *Manager) SessionClosed(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	
+	if client, exists := m.clients[id]; exists && client.Sessions > 0 {
+		client.Sessions--
+		client.Active = client.Sessions > 0
 	}
 }
 
@@ -142,14 +706,37 @@ func (m *Manager) IsAuthorized(id, secret string) bool {
 		return false
 	}
 	
-	return client.Secret == secret
+	return client.checkSecret(secret)
+}
+
+// Expired reports whether a client's expiry date has passed
+func (m *Manager) Expired(id string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	client, exists := m.clients[id]
+	return exists && client.ExpiresAt != nil && time.Now().After(*client.ExpiresAt)
 }
 
 func (m *Manager) SaveToJSON(filename string) error {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 	
-	data, err := json.MarshalIndent(m.clients, "", "  ")
+	return m.save(filename)
+}
+
+// save writes the clients file; must be called with the mutex held
+func (m *Manager) save(filename string) error {
+	stored := make(map[string]*storedClient, len(m.clients))
+	for id, client := range m.clients {
+		stored[id] = &storedClient{
+			Client:     client,
+			SecretSalt: hex.EncodeToString(client.secretSalt),
+			SecretHash: hex.EncodeToString(client.secretHash),
+		}
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
 	if err != nil {
 		return err
 	}
@@ -158,15 +745,98 @@ func (m *Manager) SaveToJSON(filename string) error {
 }
 
 func (m *Manager) LoadFromJSON(filename string) error {
+	m.mutex.Lock()
+	m.path = filename
+	m.mutex.Unlock()
+
 	data, err := readFile(filename)
 	if err != nil {
 		return err
 	}
 	
+	var stored map[string]*storedClient
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	
-	return json.Unmarshal(data, &m.clients)
+
+	migrated := 0
+	clients := make(map[string]*Client, len(stored))
+	for id, record := range stored {
+		if record.Client == nil {
+			continue
+		}
+		client := record.Client
+		// Sessions do not survive a restart
+		client.Sessions = 0
+		client.Active = false
+
+		if record.Secret != "" && record.SecretHash == "" {
+			// Files written before secrets were hashed hold them in cleartext
+			client.setSecret(record.Secret)
+			migrated++
+		} else {
+			if client.secretSalt, err = hex.DecodeString(record.SecretSalt); err != nil {
+				return err
+			}
+			if client.secretHash, err = hex.DecodeString(record.SecretHash); err != nil {
+				return err
+			}
+		}
+		clients[id] = client
+	}
+	m.clients = clients
+
+	// Rewrite right away so cleartext secrets do not linger on disk
+	if migrated > 0 {
+		return m.save(filename)
+	}
+	return nil
+}
+
+// HostName returns the client's name as a DNS label: lower case, with runs
+// of anything but letters and digits turned into a hyphen and non-ASCII
+// names in punycode. It is empty for names without letters or digits.
+func (c *Client) HostName() string {
+	var label strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(c.Name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			label.WriteRune(r)
+			hyphen = false
+		} else if !hyphen && label.Len() > 0 {
+			label.WriteByte('-')
+			hyphen = true
+		}
+	}
+
+	name, err := idna.ToASCII(strings.TrimSuffix(label.String(), "-"))
+	if err != nil || len(name) > 63 {
+		return ""
+	}
+	return name
+}
+
+func (c *Client) setSecret(secret string) {
+	c.secretSalt = make([]byte, 16)
+	rand.Read(c.secretSalt)
+	c.secretHash = hashSecret(c.secretSalt, secret)
+}
+
+func (c *Client) checkSecret(secret string) bool {
+	return subtle.ConstantTimeCompare(c.secretHash, hashSecret(c.secretSalt, secret)) == 1
+}
+
+// hashSecret derives the stored verifier. Secrets carry over 240 random bits,
+// so a single salted SHA-256 cannot be brute-forced and keeps tunnel logins
+// cheap.
+func hashSecret(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
 }
 
 func generateSecret() string {
@@ -29,16 +29,93 @@ type Config struct {
 	} `json:"auth"`
 	
 	Tunnel struct {
-		KeepAlive    int  `json:"keep_alive"`
+		// Mode is "tun" for a kernel TUN device or "netstack" for a
+		// userspace network stack that needs neither /dev/net/tun nor root
+		Mode         string `json:"mode"`
+		// Queues is how many TUN queues to read in parallel, 0 for one per
+		// CPU. Offload lets large TCP segments cross the TUN in one piece.
+		// Both fall back when the kernel lacks them.
+		Queues       int  `json:"queues"`
+		Offload      bool `json:"offload"`
+		// KeepAlive is how often sessions are pinged in seconds;
+		// KeepAliveTimeout ends sessions silent for that long, 0 for two
+		// intervals
+		KeepAlive        int  `json:"keep_alive"`
+		KeepAliveTimeout int  `json:"keep_alive_timeout"`
 		Compression  bool `json:"compression"`
 		BufferSize   int  `json:"buffer_size"`
+		// QueueSize bounds the packets waiting for each client, 0 for 256.
+		// QueuePolicy is "tail_drop" or "codel"; Priority sends small
+		// packets such as SSH keystrokes ahead of bulk downloads.
+		QueueSize    int    `json:"queue_size"`
+		QueuePolicy  string `json:"queue_policy"`
+		Priority     bool   `json:"priority"`
+		// Network is the gateway address and tunnel subnet clients get
+		// their addresses from
+		Network      string `json:"network"`
+		// DrainSeconds is how long sessions get to reconnect elsewhere on
+		// shutdown
+		DrainSeconds int    `json:"drain_seconds"`
+		// MTU, DNS and Routes are handed to clients in the handshake. DNS
+		// defaults to the gateway when the resolver is enabled.
+		MTU          int      `json:"mtu"`
+		DNS          []string `json:"dns"`
+		Routes       []string `json:"routes"`
+		// LANGroups are client tags whose members reach each other
+		// directly and by name as <client-name>.yuki
+		LANGroups    []string `json:"lan_groups"`
 	} `json:"tunnel"`
 	
+	DNS struct {
+		// Enabled runs a resolver on the tunnel gateway address
+		Enabled   bool     `json:"enabled"`
+		// Upstreams are tried in order: plain addresses such as "1.1.1.1",
+		// "tls://1.1.1.1:853" for DNS over TLS or https:// URLs for DNS
+		// over HTTPS
+		Upstreams []string `json:"upstreams"`
+		CacheSize int      `json:"cache_size"`
+		// Blocklists are hosts-format files for the listed clients and
+		// client tags, or for everyone when both are empty
+		Blocklists []struct {
+			File    string   `json:"file"`
+			Clients []string `json:"clients"`
+			Tags    []string `json:"tags"`
+		} `json:"blocklists"`
+	} `json:"dns"`
+	
 	Limits struct {
 		MaxClients     int   `json:"max_clients"`
 		RateLimit      int   `json:"rate_limit"`
 		MaxBandwidth   int64 `json:"max_bandwidth"`
+		// MaxSessionsPerClient is the default concurrent session limit of a
+		// client; 0 means unlimited
+		MaxSessionsPerClient int `json:"max_sessions_per_client"`
+		// SessionLimitPolicy is "reject" to refuse new sessions over the
+		// limit or "evict_oldest" to close the oldest one instead
+		SessionLimitPolicy string `json:"session_limit_policy"`
 	} `json:"limits"`
+	
+	Storage struct {
+		DataDir string `json:"data_dir"`
+	} `json:"storage"`
+	
+	Audit struct {
+		MirrorFile string `json:"mirror_file"`
+		// MemoryEvents recent events are served from memory, older ones
+		// from the files
+		MemoryEvents int `json:"memory_events"`
+		// The file is rotated past MaxFileMB megabytes, MaxFiles rotated
+		// files are kept
+		MaxFileMB int `json:"max_file_mb"`
+		MaxFiles  int `json:"max_files"`
+	} `json:"audit"`
+	
+	Security struct {
+		MaxFailures   int      `json:"max_failures"`
+		BanSeconds    int      `json:"ban_seconds"`
+		MaxBanSeconds int      `json:"max_ban_seconds"`
+		Allowlist     []string `json:"allowlist"`
+	} `json:"security"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -95,22 +172,90 @@ func GenerateDefaultConfig() *Config {
 			AdminPassword: "password",
 		},
 		Tunnel: struct {
-			KeepAlive    int  `json:"keep_alive"`
+			Mode         string `json:"mode"`
+			Queues       int  `json:"queues"`
+			Offload      bool `json:"offload"`
+			KeepAlive        int  `json:"keep_alive"`
+			KeepAliveTimeout int  `json:"keep_alive_timeout"`
 			Compression  bool `json:"compression"`
 			BufferSize   int  `json:"buffer_size"`
+			QueueSize    int    `json:"queue_size"`
+			QueuePolicy  string `json:"queue_policy"`
+			Priority     bool   `json:"priority"`
+			Network      string `json:"network"`
+			DrainSeconds int    `json:"drain_seconds"`
+			MTU          int      `json:"mtu"`
+			DNS          []string `json:"dns"`
+			Routes       []string `json:"routes"`
+			LANGroups    []string `json:"lan_groups"`
+		}{
+			Mode:         "tun",
+			Queues:       0,
+			Offload:      false,
+			KeepAlive:    15,
+			KeepAliveTimeout: 30,
+			Compression:  false,
+			BufferSize:   32768,
+			QueueSize:    256,
+			QueuePolicy:  "codel",
+			Priority:     true,
+			Network:      "10.0.0.1/24",
+			DrainSeconds: 10,
+			MTU:          1420,
+			Routes:       []string{"0.0.0.0/0"},
+		},
+		DNS: struct {
+			Enabled   bool     `json:"enabled"`
+			Upstreams []string `json:"upstreams"`
+			CacheSize int      `json:"cache_size"`
+			Blocklists []struct {
+				File    string   `json:"file"`
+				Clients []string `json:"clients"`
+				Tags    []string `json:"tags"`
+			} `json:"blocklists"`
 		}{
-			KeepAlive:   15,
-			Compression: false,
-			BufferSize:  32768,
+			Enabled:   true,
+			Upstreams: []string{"https://cloudflare-dns.com/dns-query", "1.1.1.1"},
+			CacheSize: 10000,
 		},
 		Limits: struct {
 			MaxClients     int   `json:"max_clients"`
 			RateLimit      int   `json:"rate_limit"`
 			MaxBandwidth   int64 `json:"max_bandwidth"`
+			MaxSessionsPerClient int `json:"max_sessions_per_client"`
+			SessionLimitPolicy string `json:"session_limit_policy"`
 		}{
 			MaxClients:   1000,
 			RateLimit:    100,
 			MaxBandwidth: 1073741824, // 1GB
+			MaxSessionsPerClient: 3,
+			SessionLimitPolicy:   "reject",
+		},
+		Storage: struct {
+			DataDir string `json:"data_dir"`
+		}{
+			DataDir: "data",
+		},
+		Audit: struct {
+			MirrorFile string `json:"mirror_file"`
+			MemoryEvents int `json:"memory_events"`
+			MaxFileMB int `json:"max_file_mb"`
+			MaxFiles  int `json:"max_files"`
+		}{
+			MemoryEvents: 10000,
+			MaxFileMB:    10,
+			MaxFiles:     5,
+		},
+		Security: struct {
+			MaxFailures   int      `json:"max_failures"`
+			BanSeconds    int      `json:"ban_seconds"`
+			MaxBanSeconds int      `json:"max_ban_seconds"`
+			Allowlist     []string `json:"allowlist"`
+		}{
+			MaxFailures:   5,
+			BanSeconds:    60,
+			MaxBanSeconds: 86400,
+			Allowlist:     []string{"127.0.0.1/32"},
 		},
 	}
 }
@@ -3,11 +3,15 @@ package crypto
 import (
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"slices"
 
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 const (
@@ -87,6 +91,11 @@ func (c *Cipher) Encrypt(plaintext []byte) ([]byte, error) {
 }
 
 func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
+	return c.decrypt(nil, data)
+}
+
+// decrypt opens data and appends the plaintext to dst
+func (c *Cipher) decrypt(dst, data []byte) ([]byte, error) {
 	if len(data) < NonceSize+TagSize {
 		return nil, errors.New("invalid ciphertext length")
 	}
@@ -100,7 +109,7 @@ func (c *Cipher) Decrypt(data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("invalid nonce sequence: %w", err)
 	}
 	
-	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := c.aead.Open(dst, nonce, ciphertext, nil)
 	if err != nil {
 		return nil, fmt.Errorf("decryption failed: %w", err)
 	}
@@ -129,17 +138,16 @@ func (c *Cipher) verifyAndUpdateReceiveNonce(receivedNonce []byte) error {
 	}
 	
 	// Check if this is the next expected nonce (increment by 2)
-	expectedNonce := make([]byte, NonceSize)
-	copy(expectedNonce, c.recvNonce[:])
-	incrementNonceBy(expectedNonce, 2)
+	expectedNonce := c.recvNonce
+	incrementNonceBy(expectedNonce[:], 2)
 	
 	// Allow some tolerance for out-of-order packets
 	for i := 0; i < 10; i++ {
-		if bytesEqual(expectedNonce, receivedNonce) {
+		if bytesEqual(expectedNonce[:], receivedNonce) {
 			copy(c.recvNonce[:], receivedNonce)
 			return nil
 		}
-		incrementNonceBy(expectedNonce, 2)
+		incrementNonceBy(expectedNonce[:], 2)
 	}
 	
 	return errors.New("nonce too far ahead or replay detected")
@@ -168,65 +176,126 @@ func bytesEqual(a, b []byte) bool {
 
 // Frame encryption for tunnel protocol
 type Frame struct {
-	Type   uint8  // 0=data, 1=ping, 2=pong
+	Type   uint8  // 0=data, 1=ping, 2=pong, 3=control (proto.ControlMessage)
 	Length uint32
 	Data   []byte
 }
 
 func (c *Cipher) EncryptFrame(frame *Frame) ([]byte, error) {
-	// Serialize frame
-	frameData := make([]byte, 5+len(frame.Data))
-	frameData[0] = frame.Type
-	binary.BigEndian.PutUint32(frameData[1:5], frame.Length)
-	copy(frameData[5:], frame.Data)
-	
-	// Encrypt frame data (except length prefix)
-	encrypted, err := c.Encrypt(frameData)
+	return c.AppendFrame(nil, frame)
+}
+
+// AppendFrame encrypts frame like EncryptFrame and appends the result to
+// dst. The frame is sealed in place, so reusing dst makes encryption free
+// of allocations.
+func (c *Cipher) AppendFrame(dst []byte, frame *Frame) ([]byte, error) {
+	incrementNonceBy(c.sendNonce[:], 2)
+
+	// Unencrypted length, nonce, then the sealed type, length and data
+	start := len(dst)
+	sealedLength := NonceSize + 5 + len(frame.Data) + TagSize
+	dst = slices.Grow(dst, 4+sealedLength)
+	dst = dst[:start+4+NonceSize+5]
+	binary.BigEndian.PutUint32(dst[start:], uint32(sealedLength))
+	copy(dst[start+4:], c.sendNonce[:])
+	dst[start+4+NonceSize] = frame.Type
+	binary.BigEndian.PutUint32(dst[start+4+NonceSize+1:], frame.Length)
+	dst = append(dst, frame.Data...)
+
+	plaintext := dst[start+4+NonceSize:]
+	sealed := c.aead.Seal(plaintext[:0], c.sendNonce[:], plaintext, nil)
+	return dst[:start+4+NonceSize+len(sealed)], nil
+}
+
+func (c *Cipher) DecryptFrame(data []byte) (*Frame, error) {
+	frame, err := c.OpenFrame(slices.Clone(data))
 	if err != nil {
 		return nil, err
 	}
-	
-	// Prepend unencrypted length
-	result := make([]byte, 4+len(encrypted))
-	binary.BigEndian.PutUint32(result[:4], uint32(len(encrypted)))
-	copy(result[4:], encrypted)
-	
-	return result, nil
+	return &frame, nil
 }
 
-func (c *Cipher) DecryptFrame(data []byte) (*Frame, error) {
+// OpenFrame decrypts a frame like DecryptFrame, but in place: the frame's
+// data shares data's memory, which the caller must not reuse while the
+// frame is in use
+func (c *Cipher) OpenFrame(data []byte) (Frame, error) {
 	if len(data) < 4 {
-		return nil, errors.New("invalid frame length")
+		return Frame{}, errors.New("invalid frame length")
 	}
 	
 	// Extract length and encrypted data
 	length := binary.BigEndian.Uint32(data[:4])
-	if len(data) < int(4+length) {
-		return nil, errors.New("incomplete frame")
+	if uint64(len(data)) < 4+uint64(length) {
+		return Frame{}, errors.New("incomplete frame")
 	}
 	
 	encrypted := data[4:4+length]
 	
-	// Decrypt frame data
-	frameData, err := c.Decrypt(encrypted)
+	if len(encrypted) < NonceSize+TagSize {
+		return Frame{}, errors.New("invalid ciphertext length")
+	}
+	
+	// Decrypt frame data over its ciphertext
+	frameData, err := c.decrypt(encrypted[NonceSize:NonceSize], encrypted)
 	if err != nil {
-		return nil, err
+		return Frame{}, err
 	}
 	
 	if len(frameData) < 5 {
-		return nil, errors.New("invalid frame data")
+		return Frame{}, errors.New("invalid frame data")
 	}
 	
 	// Parse frame
-	frame := &Frame{
+	frame := Frame{
 		Type:   frameData[0],
 		Length: binary.BigEndian.Uint32(frameData[1:5]),
 		Data:   frameData[5:],
 	}
 	
 	if len(frame.Data) != int(frame.Length) {
-		return nil, errors.New("frame length mismatch")
+		return Frame{}, errors.New("frame length mismatch")
 	}
 	
 	return frame, nil
 }
+
+// SealSecret encrypts a value for storage at rest with a random nonce.
+// Unlike Cipher it keeps no sequence state, so sealed values can be stored
+// and opened independently.
+func SealSecret(key, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, NonceSize, NonceSize+len(plaintext)+TagSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// OpenSecret decrypts a value produced by SealSecret
+func OpenSecret(key, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < NonceSize+TagSize {
+		return nil, errors.New("invalid sealed value")
+	}
+
+	return aead.Open(nil, sealed[:NonceSize], sealed[NonceSize:], nil)
+}
+
+// DeriveKey derives a purpose-specific key from a configured secret
+func DeriveKey(secret, purpose string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	reader := hkdf.New(sha256.New, []byte(secret), nil, []byte(purpose))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// blocklist holds the names of a hosts-format file and who it applies to
+type blocklist struct {
+	hosts   map[string]netip.Addr
+	clients map[string]bool
+	tags    map[string]bool
+}
+
+// loadBlocklist reads "address name [name...]" lines; # starts a comment
+func loadBlocklist(config BlocklistConfig) (*blocklist, error) {
+	file, err := os.Open(config.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &blocklist{
+		hosts:   make(map[string]netip.Addr),
+		clients: make(map[string]bool),
+		tags:    make(map[string]bool),
+	}
+	for _, id := range config.Clients {
+		list.clients[id] = true
+	}
+	for _, tag := range config.Tags {
+		list.tags[tag] = true
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			list.hosts[normalizeName(name)] = addr
+		}
+	}
+	return list, scanner.Err()
+}
+
+func (b *blocklist) lookup(name string) (netip.Addr, bool) {
+	addr, listed := b.hosts[normalizeName(name)]
+	return addr, listed
+}
+
+func (b *blocklist) appliesTo(clientID string, tags []string) bool {
+	if len(b.clients) == 0 && len(b.tags) == 0 {
+		return true
+	}
+	if b.clients[clientID] {
+		return true
+	}
+	for _, tag := range tags {
+		if b.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxCacheTTL caps how long an answer is kept whatever its TTL says
+	maxCacheTTL = time.Hour
+	// negativeTTL is how long answers without records are kept
+	negativeTTL = 30 * time.Second
+)
+
+type cacheEntry struct {
+	message dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// cache keeps upstream answers until their smallest TTL runs out
+type cache struct {
+	entries map[string]*cacheEntry
+	size    int
+	mutex   sync.Mutex
+}
+
+func newCache(size int) *cache {
+	return &cache{entries: make(map[string]*cacheEntry), size: size}
+}
+
+func cacheKey(question dnsmessage.Question) string {
+	return strings.ToLower(question.Name.String()) + "/" + question.Type.String() + "/" + question.Class.String()
+}
+
+func (c *cache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// get returns a cached answer for a query with the given ID, its TTLs
+// reduced by the time spent in the cache
+func (c *cache) get(key string, id uint16) []byte {
+	c.mutex.Lock()
+	entry, exists := c.entries[key]
+	if exists && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		exists = false
+	}
+	c.mutex.Unlock()
+	if !exists {
+		return nil
+	}
+
+	age := uint32(time.Since(entry.stored).Seconds())
+	message := entry.message
+	message.Header.ID = id
+	message.Answers = aged(entry.message.Answers, age)
+	message.Authorities = aged(entry.message.Authorities, age)
+	message.Additionals = aged(entry.message.Additionals, age)
+
+	response, err := message.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// put stores an upstream answer. Failures other than NXDOMAIN are not
+// cached, so a flaky upstream is retried.
+func (c *cache) put(key string, response []byte) {
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil || message.Header.Truncated {
+		return
+	}
+	if message.Header.RCode != dnsmessage.RCodeSuccess && message.Header.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+
+	ttl := maxCacheTTL
+	records := 0
+	for _, sections := range [][]dnsmessage.Resource{message.Answers, message.Authorities, message.Additionals} {
+		for _, resource := range sections {
+			if resource.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			records++
+			ttl = min(ttl, time.Duration(resource.Header.TTL)*time.Second)
+		}
+	}
+	if records == 0 {
+		ttl = negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{message: message, stored: now, expires: now.Add(ttl)}
+}
+
+// evict drops expired entries, and an arbitrary one if none had expired
+func (c *cache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			return
+		}
+		delete(c.entries, key)
+	}
+}
+
+// aged copies resources with their TTLs reduced by age
+func aged(resources []dnsmessage.Resource, age uint32) []dnsmessage.Resource {
+	if len(resources) == 0 {
+		return nil
+	}
+
+	copied := make([]dnsmessage.Resource, len(resources))
+	copy(copied, resources)
+	for i := range copied {
+		if copied[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if copied[i].Header.TTL > age {
+			copied[i].Header.TTL -= age
+		} else {
+			copied[i].Header.TTL = 0
+		}
+	}
+	return copied
+}
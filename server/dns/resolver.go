@@ -0,0 +1,556 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultCacheSize = 10000
+	defaultTimeout   = 5 * time.Second
+	// tcpIdleTimeout closes TCP connections that stop sending queries
+	tcpIdleTimeout = 10 * time.Second
+	// minUDPSize is the response size every client accepts over UDP
+	minUDPSize = 512
+	// maxUDPQueries bounds the UDP queries resolved at once; the read loop
+	// waits for a slot, so a flood backs up into the socket buffer
+	maxUDPQueries = 256
+)
+
+type Config struct {
+	// Upstreams are tried in order: "1.1.1.1", "udp://1.1.1.1:53",
+	// "tls://1.1.1.1:853" for DNS over TLS or a https:// URL for DNS over
+	// HTTPS
+	Upstreams []string
+	// CacheSize is the maximum number of cached answers
+	CacheSize int
+	// Timeout bounds one upstream exchange
+	Timeout time.Duration
+	// Network, when valid, is the only source network answered
+	Network netip.Prefix
+	// Blocklists are hosts-format files applied to some or all clients
+	Blocklists []BlocklistConfig
+	// LocalDomain, e.g. "yuki", is answered from LocalLookup instead of
+	// the upstreams
+	LocalDomain string
+	LocalLookup LocalLookup
+}
+
+// BlocklistConfig applies a hosts-format file to the given clients and
+// client tags, or to everyone when both are empty
+type BlocklistConfig struct {
+	File    string
+	Clients []string
+	Tags    []string
+}
+
+// ClientLookup identifies the client that owns a tunnel address
+type ClientLookup func(addr netip.Addr) (id string, tags []string, ok bool)
+
+// LocalLookup resolves a single label of the local domain for the client
+// at source
+type LocalLookup func(label string, source netip.Addr) (netip.Addr, bool)
+
+type Stats struct {
+	Queries        int64 `json:"queries"`
+	CacheHits      int64 `json:"cache_hits"`
+	Blocked        int64 `json:"blocked"`
+	Refused        int64 `json:"refused"`
+	Local          int64 `json:"local"`
+	UpstreamErrors int64 `json:"upstream_errors"`
+	// AvgUpstreamMillis is the mean latency of successful upstream queries
+	AvgUpstreamMillis float64          `json:"avg_upstream_ms"`
+	CacheEntries      int              `json:"cache_entries"`
+	Types             map[string]int64 `json:"types"`
+}
+
+// Resolver is a caching DNS forwarder for tunnel clients
+type Resolver struct {
+	config     Config
+	upstreams  []upstream
+	blocklists []*blocklist
+	lookup     ClientLookup
+	cache      *cache
+
+	statsMutex    sync.Mutex
+	stats         Stats
+	upstreamTime  time.Duration
+	upstreamCount int64
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func New(config Config, lookup ClientLookup) (*Resolver, error) {
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaultCacheSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if len(config.Upstreams) == 0 {
+		return nil, errors.New("no upstream DNS servers configured")
+	}
+
+	r := &Resolver{
+		config: config,
+		lookup: lookup,
+		cache:  newCache(config.CacheSize),
+		stats:  Stats{Types: make(map[string]int64)},
+	}
+
+	for _, address := range config.Upstreams {
+		u, err := parseUpstream(address, config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+
+	for _, list := range config.Blocklists {
+		b, err := loadBlocklist(list)
+		if err != nil {
+			return nil, err
+		}
+		r.blocklists = append(r.blocklists, b)
+		log.Printf("🚫 Loaded DNS blocklist %s: %d names", list.File, len(b.hosts))
+	}
+
+	return r, nil
+}
+
+// Listen answers queries on UDP and TCP at address until Close
+func (r *Resolver) Listen(address string) error {
+	udp, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		udp.Close()
+		return err
+	}
+
+	r.udp, r.tcp = udp, tcp
+	go r.serveUDP()
+	go r.serveTCP()
+	return nil
+}
+
+func (r *Resolver) Close() error {
+	if r.udp != nil {
+		r.udp.Close()
+	}
+	if r.tcp != nil {
+		r.tcp.Close()
+	}
+	return nil
+}
+
+func (r *Resolver) Stats() Stats {
+	r.statsMutex.Lock()
+	defer r.statsMutex.Unlock()
+
+	stats := r.stats
+	stats.Types = make(map[string]int64, len(r.stats.Types))
+	for qtype, count := range r.stats.Types {
+		stats.Types[qtype] = count
+	}
+	if r.upstreamCount > 0 {
+		stats.AvgUpstreamMillis = float64(r.upstreamTime) / float64(r.upstreamCount) / float64(time.Millisecond)
+	}
+	stats.CacheEntries = r.cache.len()
+	return stats
+}
+
+func (r *Resolver) serveUDP() {
+	buffer := make([]byte, 65535)
+	slots := make(chan struct{}, maxUDPQueries)
+	for {
+		n, addr, err := r.udp.ReadFrom(buffer)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("❌ DNS UDP read error: %v", err)
+			}
+			return
+		}
+
+		source := sourceAddr(addr)
+		if r.config.Network.IsValid() && !r.config.Network.Contains(source) {
+			// Refusing takes no upstream round trip, so it needs no goroutine
+			if response := r.ResolveUDP(buffer[:n], source); response != nil {
+				r.udp.WriteTo(response, addr)
+			}
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buffer[:n])
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots }()
+			if response := r.ResolveUDP(query, source); response != nil {
+				r.udp.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+func (r *Resolver) serveTCP() {
+	for {
+		conn, err := r.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("❌ DNS TCP accept error: %v", err)
+			}
+			return
+		}
+		go r.ServeConn(conn)
+	}
+}
+
+// ServeConn answers length-prefixed queries on a stream connection until it
+// goes idle, then closes it
+func (r *Resolver) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	source := sourceAddr(conn.RemoteAddr())
+
+	for {
+		conn.SetDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+
+		response := r.Resolve(query, source)
+		if response == nil {
+			return
+		}
+		if err := writeMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// ResolveUDP is Resolve for a query that arrived over UDP, truncating
+// responses the client cannot take in one datagram
+func (r *Resolver) ResolveUDP(query []byte, source netip.Addr) []byte {
+	response := r.Resolve(query, source)
+	if response != nil && len(response) > udpSize(query) {
+		response = truncate(response)
+	}
+	return response
+}
+
+// Resolve answers a query from source. It returns nil for input that is not
+// a DNS query at all.
+func (r *Resolver) Resolve(query []byte, source netip.Addr) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return reply(header, nil, dnsmessage.RCodeFormatError)
+	}
+	r.count(func(stats *Stats) {
+		stats.Queries++
+		stats.Types[typeName(question.Type)]++
+	})
+
+	if r.config.Network.IsValid() && !r.config.Network.Contains(source) {
+		r.count(func(stats *Stats) { stats.Refused++ })
+		return reply(header, &question, dnsmessage.RCodeRefused)
+	}
+
+	if label, local := r.localLabel(question.Name.String()); local {
+		r.count(func(stats *Stats) { stats.Local++ })
+		return r.localReply(header, question, label, source)
+	}
+
+	if addr, blocked := r.blocked(question.Name.String(), source); blocked {
+		r.count(func(stats *Stats) { stats.Blocked++ })
+		return blockedReply(header, question, addr)
+	}
+
+	key := cacheKey(question)
+	if response := r.cache.get(key, header.ID); response != nil {
+		r.count(func(stats *Stats) { stats.CacheHits++ })
+		return response
+	}
+
+	response, err := r.exchange(query)
+	if err != nil {
+		r.count(func(stats *Stats) { stats.UpstreamErrors++ })
+		log.Printf("⚠️ DNS upstream failed for %s: %v", question.Name, err)
+		return reply(header, &question, dnsmessage.RCodeServerFailure)
+	}
+
+	r.cache.put(key, response)
+	return response
+}
+
+// exchange forwards a query to the first upstream that answers
+func (r *Resolver) exchange(query []byte) ([]byte, error) {
+	var lastErr error
+	for _, u := range r.upstreams {
+		ctx, cancel := context.WithTimeout(context.Background(), r.config.Timeout)
+		start := time.Now()
+		response, err := u.exchange(ctx, query)
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", u, err)
+			continue
+		}
+
+		r.count(func(stats *Stats) {
+			r.upstreamTime += time.Since(start)
+			r.upstreamCount++
+		})
+		return response, nil
+	}
+	return nil, lastErr
+}
+
+// blocked reports whether a blocklist that applies to source lists name
+func (r *Resolver) blocked(name string, source netip.Addr) (netip.Addr, bool) {
+	var (
+		looked   bool
+		clientID string
+		tags     []string
+	)
+	for _, list := range r.blocklists {
+		addr, listed := list.lookup(name)
+		if !listed {
+			continue
+		}
+		if !looked && r.lookup != nil {
+			clientID, tags, _ = r.lookup(source)
+			looked = true
+		}
+		if list.appliesTo(clientID, tags) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// localLabel returns the first label of a name in the local domain
+func (r *Resolver) localLabel(name string) (string, bool) {
+	if r.config.LocalDomain == "" {
+		return "", false
+	}
+	name = normalizeName(name)
+	domain := normalizeName(r.config.LocalDomain)
+	if name == domain {
+		return "", true
+	}
+	label, found := strings.CutSuffix(name, "."+domain)
+	return label, found
+}
+
+// localReply answers a name of the local domain. Names that do not resolve
+// for source get NXDOMAIN, so they are never sent upstream.
+func (r *Resolver) localReply(header dnsmessage.Header, question dnsmessage.Question, label string, source netip.Addr) []byte {
+	var addr netip.Addr
+	found := false
+	if label != "" && !strings.Contains(label, ".") && r.config.LocalLookup != nil {
+		addr, found = r.config.LocalLookup(label, source)
+	}
+	if !found {
+		return reply(header, &question, dnsmessage.RCodeNameError)
+	}
+
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	switch {
+	case question.Type == dnsmessage.TypeA && addr.Is4():
+		message.Answers = []dnsmessage.Resource{{Header: resource, Body: &dnsmessage.AResource{A: addr.As4()}}}
+	case question.Type == dnsmessage.TypeAAAA && addr.Is6():
+		message.Answers = []dnsmessage.Resource{{Header: resource, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}}}
+	}
+
+	response, err := message.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func (r *Resolver) count(update func(stats *Stats)) {
+	r.statsMutex.Lock()
+	update(&r.stats)
+	r.statsMutex.Unlock()
+}
+
+// reply builds an answerless response with the given code
+func reply(header dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+	}
+	if question != nil {
+		message.Questions = []dnsmessage.Question{*question}
+	}
+
+	response, err := message.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// blockedReply answers A and AAAA queries for a blocked name with the
+// address from the hosts file, or the unspecified address of the family
+func blockedReply(header dnsmessage.Header, question dnsmessage.Question, addr netip.Addr) []byte {
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	switch question.Type {
+	case dnsmessage.TypeA:
+		a := dnsmessage.AResource{}
+		if addr.Is4() {
+			a.A = addr.As4()
+		}
+		message.Answers = []dnsmessage.Resource{{Header: resource, Body: &a}}
+	case dnsmessage.TypeAAAA:
+		aaaa := dnsmessage.AAAAResource{}
+		if addr.Is6() {
+			aaaa.AAAA = addr.As16()
+		}
+		message.Answers = []dnsmessage.Resource{{Header: resource, Body: &aaaa}}
+	}
+
+	response, err := message.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// truncate cuts a response down to its header and question with the TC
+// bit set, so the client retries over TCP
+func truncate(response []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil
+	}
+	questions, _ := parser.AllQuestions()
+
+	header.Truncated = true
+	message := dnsmessage.Message{Header: header, Questions: questions}
+	truncated, err := message.Pack()
+	if err != nil {
+		return nil
+	}
+	return truncated
+}
+
+// udpSize returns the largest UDP response a query allows, from its EDNS
+// record if it has one
+func udpSize(query []byte) int {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(query); err != nil {
+		return minUDPSize
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return minUDPSize
+	}
+	if err := parser.SkipAllAnswers(); err != nil {
+		return minUDPSize
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return minUDPSize
+	}
+
+	for {
+		header, err := parser.AdditionalHeader()
+		if err != nil {
+			return minUDPSize
+		}
+		if header.Type == dnsmessage.TypeOPT {
+			return max(int(header.Class), minUDPSize)
+		}
+		if err := parser.SkipAdditional(); err != nil {
+			return minUDPSize
+		}
+	}
+}
+
+func typeName(t dnsmessage.Type) string {
+	name := t.String()
+	if len(name) > 4 && name[:4] == "Type" {
+		return name[4:]
+	}
+	return name
+}
+
+func sourceAddr(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// readMessage reads one length-prefixed DNS message from a stream
+func readMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// writeMessage writes one length-prefixed DNS message to a stream
+func writeMessage(w io.Writer, message []byte) error {
+	data := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(data, uint16(len(message)))
+	copy(data[2:], message)
+	_, err := w.Write(data)
+	return err
+}
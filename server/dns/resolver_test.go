@@ -0,0 +1,409 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// bigRecords is how many A records the stub answers for big.example, too
+// many for a 512-byte UDP response
+const bigRecords = 40
+
+// stubUpstream is a DNS server on 127.0.0.1 that answers over UDP and TCP
+// on the same port, as the plain upstream expects
+type stubUpstream struct {
+	address string
+	udp     net.PacketConn
+	tcp     net.Listener
+
+	udpQueries atomic.Int64
+	tcpQueries atomic.Int64
+}
+
+func newStubUpstream(t *testing.T) *stubUpstream {
+	t.Helper()
+
+	s := &stubUpstream{}
+	for attempt := 0; ; attempt++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			if attempt < 10 {
+				continue
+			}
+			t.Fatal(err)
+		}
+		s.udp, s.tcp, s.address = udp, tcp, udp.LocalAddr().String()
+		break
+	}
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *stubUpstream) serveUDP() {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		s.udpQueries.Add(1)
+		if response := s.answer(buffer[:n], true); response != nil {
+			s.udp.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *stubUpstream) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			query, err := readMessage(conn)
+			if err != nil {
+				return
+			}
+			s.tcpQueries.Add(1)
+			if response := s.answer(query, false); response != nil {
+				writeMessage(conn, response)
+			}
+		}()
+	}
+}
+
+// answer serves example.com, NXDOMAIN for missing.example and many records
+// for big.example, truncated over UDP
+func (s *stubUpstream) answer(query []byte, udp bool) []byte {
+	var request dnsmessage.Message
+	if err := request.Unpack(query); err != nil || len(request.Questions) == 0 {
+		return nil
+	}
+	question := request.Questions[0]
+
+	message := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: request.Header.ID, Response: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 300}
+	switch question.Name.String() {
+	case "example.com.":
+		message.Answers = []dnsmessage.Resource{{Header: resource, Body: &dnsmessage.AResource{A: [4]byte{93, 184, 216, 34}}}}
+	case "big.example.":
+		if udp {
+			message.Header.Truncated = true
+			break
+		}
+		for i := range bigRecords {
+			message.Answers = append(message.Answers, dnsmessage.Resource{Header: resource, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(i)}}})
+		}
+	default:
+		message.Header.RCode = dnsmessage.RCodeNameError
+	}
+
+	response, err := message.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func (s *stubUpstream) queries() int64 {
+	return s.udpQueries.Load() + s.tcpQueries.Load()
+}
+
+func newTestResolver(t *testing.T, config Config, lookup ClientLookup) (*Resolver, *stubUpstream) {
+	t.Helper()
+
+	upstream := newStubUpstream(t)
+	config.Upstreams = []string{"udp://" + upstream.address}
+	config.Timeout = 2 * time.Second
+	r, err := New(config, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, upstream
+}
+
+func buildQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+
+	message := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := message.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func parseResponse(t *testing.T, response []byte) dnsmessage.Message {
+	t.Helper()
+
+	if response == nil {
+		t.Fatal("no response")
+	}
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+var client = netip.MustParseAddr("10.0.0.2")
+
+func TestCacheHitRewritesIDAndAgesTTL(t *testing.T) {
+	r, upstream := newTestResolver(t, Config{}, nil)
+
+	first := parseResponse(t, r.Resolve(buildQuery(t, 1, "example.com.", dnsmessage.TypeA), client))
+	if first.Header.ID != 1 || len(first.Answers) != 1 || first.Answers[0].Header.TTL != 300 {
+		t.Fatalf("upstream answer: %+v", first)
+	}
+
+	// Pretend the answer has been cached for a while
+	r.cache.mutex.Lock()
+	for _, entry := range r.cache.entries {
+		entry.stored = entry.stored.Add(-100 * time.Second)
+	}
+	r.cache.mutex.Unlock()
+
+	second := parseResponse(t, r.Resolve(buildQuery(t, 2, "example.com.", dnsmessage.TypeA), client))
+	if second.Header.ID != 2 {
+		t.Errorf("cached answer has ID %d, want 2", second.Header.ID)
+	}
+	if len(second.Answers) != 1 || second.Answers[0].Header.TTL != 200 {
+		t.Errorf("cached answer: %+v, want TTL 200", second.Answers)
+	}
+	if got := upstream.queries(); got != 1 {
+		t.Errorf("upstream got %d queries, want 1", got)
+	}
+	if stats := r.Stats(); stats.CacheHits != 1 || stats.Queries != 2 {
+		t.Errorf("stats: %+v", stats)
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	r, upstream := newTestResolver(t, Config{}, nil)
+
+	for id := uint16(1); id <= 2; id++ {
+		response := parseResponse(t, r.Resolve(buildQuery(t, id, "missing.example.", dnsmessage.TypeA), client))
+		if response.Header.RCode != dnsmessage.RCodeNameError || response.Header.ID != id {
+			t.Fatalf("query %d: %+v, want NXDOMAIN", id, response.Header)
+		}
+	}
+	if got := upstream.queries(); got != 1 {
+		t.Errorf("upstream got %d queries, want 1", got)
+	}
+
+	r.cache.mutex.Lock()
+	for _, entry := range r.cache.entries {
+		if ttl := entry.expires.Sub(entry.stored); ttl != negativeTTL {
+			t.Errorf("NXDOMAIN cached for %s, want %s", ttl, negativeTTL)
+		}
+	}
+	r.cache.mutex.Unlock()
+}
+
+func TestTruncatedAnswerFallsBackToTCP(t *testing.T) {
+	r, upstream := newTestResolver(t, Config{}, nil)
+	query := buildQuery(t, 7, "big.example.", dnsmessage.TypeA)
+
+	response := parseResponse(t, r.Resolve(query, client))
+	if response.Header.Truncated || len(response.Answers) != bigRecords {
+		t.Fatalf("got %d answers, truncated %v; want %d over TCP", len(response.Answers), response.Header.Truncated, bigRecords)
+	}
+	if udp, tcp := upstream.udpQueries.Load(), upstream.tcpQueries.Load(); udp != 1 || tcp != 1 {
+		t.Errorf("upstream got %d UDP and %d TCP queries, want 1 each", udp, tcp)
+	}
+
+	// The client asked without EDNS, so over UDP it must retry over TCP too
+	truncated := parseResponse(t, r.ResolveUDP(query, client))
+	if !truncated.Header.Truncated || len(truncated.Answers) != 0 || truncated.Header.ID != 7 {
+		t.Errorf("UDP answer: %+v, want an empty truncated answer", truncated)
+	}
+}
+
+func TestBlocklistsApplyPerClientAndTag(t *testing.T) {
+	dir := t.TempDir()
+	writeList := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	config := Config{Blocklists: []BlocklistConfig{
+		{File: writeList("everyone", "0.0.0.0 malware.example # everyone\n")},
+		{File: writeList("kids", "0.0.0.0 games.example\n"), Tags: []string{"kids"}},
+		{File: writeList("office", "192.0.2.1 social.example\n"), Clients: []string{"office"}},
+	}}
+	clients := map[netip.Addr]struct {
+		id   string
+		tags []string
+	}{
+		netip.MustParseAddr("10.0.0.2"): {id: "office"},
+		netip.MustParseAddr("10.0.0.3"): {id: "child", tags: []string{"kids"}},
+		netip.MustParseAddr("10.0.0.4"): {id: "other"},
+	}
+	lookup := func(addr netip.Addr) (string, []string, bool) {
+		c, ok := clients[addr]
+		return c.id, c.tags, ok
+	}
+	r, upstream := newTestResolver(t, config, lookup)
+
+	tests := []struct {
+		source  string
+		name    string
+		blocked bool
+		addr    [4]byte
+	}{
+		{"10.0.0.2", "malware.example.", true, [4]byte{}},
+		{"10.0.0.4", "Malware.Example.", true, [4]byte{}},
+		{"10.0.0.3", "games.example.", true, [4]byte{}},
+		{"10.0.0.2", "games.example.", false, [4]byte{}},
+		{"10.0.0.2", "social.example.", true, [4]byte{192, 0, 2, 1}},
+		{"10.0.0.3", "social.example.", false, [4]byte{}},
+	}
+	for _, test := range tests {
+		before := upstream.queries()
+		response := parseResponse(t, r.Resolve(buildQuery(t, 1, test.name, dnsmessage.TypeA), netip.MustParseAddr(test.source)))
+		sentUpstream := upstream.queries() != before
+
+		if !test.blocked {
+			if !sentUpstream {
+				t.Errorf("%s from %s: not forwarded upstream", test.name, test.source)
+			}
+			continue
+		}
+		if sentUpstream {
+			t.Errorf("%s from %s: forwarded upstream, want blocked", test.name, test.source)
+		}
+		if len(response.Answers) != 1 {
+			t.Errorf("%s from %s: %d answers, want 1", test.name, test.source, len(response.Answers))
+			continue
+		}
+		if a, ok := response.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != test.addr {
+			t.Errorf("%s from %s: answer %v, want %v", test.name, test.source, response.Answers[0].Body, test.addr)
+		}
+	}
+}
+
+func TestRefusesSourcesOutsideNetwork(t *testing.T) {
+	r, upstream := newTestResolver(t, Config{Network: netip.MustParsePrefix("10.0.0.0/24")}, nil)
+
+	response := parseResponse(t, r.Resolve(buildQuery(t, 3, "example.com.", dnsmessage.TypeA), netip.MustParseAddr("192.168.1.10")))
+	if response.Header.RCode != dnsmessage.RCodeRefused {
+		t.Errorf("got %v, want REFUSED", response.Header.RCode)
+	}
+
+	// Queries to the listener come from 127.0.0.1, outside the network too
+	if err := r.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", r.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(buildQuery(t, 4, "example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 512)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := parseResponse(t, buffer[:n]); response.Header.RCode != dnsmessage.RCodeRefused || response.Header.ID != 4 {
+		t.Errorf("UDP answer: %+v, want REFUSED", response.Header)
+	}
+
+	if got := upstream.queries(); got != 0 {
+		t.Errorf("upstream got %d queries, want none", got)
+	}
+	if stats := r.Stats(); stats.Refused != 2 {
+		t.Errorf("refused %d queries, want 2", stats.Refused)
+	}
+}
+
+func TestLocalDomain(t *testing.T) {
+	config := Config{
+		LocalDomain: "yuki",
+		LocalLookup: func(label string, source netip.Addr) (netip.Addr, bool) {
+			if label == "laptop" {
+				return netip.MustParseAddr("10.0.0.5"), true
+			}
+			return netip.Addr{}, false
+		},
+	}
+	r, upstream := newTestResolver(t, config, nil)
+
+	response := parseResponse(t, r.Resolve(buildQuery(t, 1, "Laptop.Yuki.", dnsmessage.TypeA), client))
+	if !response.Header.Authoritative || len(response.Answers) != 1 {
+		t.Fatalf("laptop.yuki: %+v", response)
+	}
+	if a, ok := response.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{10, 0, 0, 5} {
+		t.Errorf("laptop.yuki: answer %v", response.Answers[0].Body)
+	}
+
+	// No AAAA record, but the name exists
+	response = parseResponse(t, r.Resolve(buildQuery(t, 2, "laptop.yuki.", dnsmessage.TypeAAAA), client))
+	if response.Header.RCode != dnsmessage.RCodeSuccess || len(response.Answers) != 0 {
+		t.Errorf("laptop.yuki AAAA: %+v", response)
+	}
+
+	for _, name := range []string{"phone.yuki.", "a.laptop.yuki.", "yuki."} {
+		response := parseResponse(t, r.Resolve(buildQuery(t, 3, name, dnsmessage.TypeA), client))
+		if response.Header.RCode != dnsmessage.RCodeNameError {
+			t.Errorf("%s: %v, want NXDOMAIN", name, response.Header.RCode)
+		}
+	}
+
+	if got := upstream.queries(); got != 0 {
+		t.Errorf("upstream got %d queries, want none", got)
+	}
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	r, upstream := newTestResolver(t, Config{}, nil)
+	upstream.udp.Close()
+	r.config.Timeout = 200 * time.Millisecond
+
+	response := parseResponse(t, r.Resolve(buildQuery(t, 1, "example.com.", dnsmessage.TypeA), client))
+	if response.Header.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got %v, want SERVFAIL", response.Header.RCode)
+	}
+	if response := r.Resolve([]byte{1, 2, 3}, client); response != nil {
+		t.Errorf("garbage got a response")
+	}
+	if stats := r.Stats(); stats.UpstreamErrors != 1 {
+		t.Errorf("upstream errors %d, want 1", stats.UpstreamErrors)
+	}
+}
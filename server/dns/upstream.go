@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// upstream is a DNS server queries are forwarded to
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+func parseUpstream(address string, timeout time.Duration) (upstream, error) {
+	switch {
+	case strings.HasPrefix(address, "https://"):
+		return &httpsUpstream{url: address, client: &http.Client{Timeout: timeout}}, nil
+	case strings.HasPrefix(address, "tls://"):
+		hostPort := withPort(strings.TrimPrefix(address, "tls://"), "853")
+		host, _, _ := net.SplitHostPort(hostPort)
+		return &tlsUpstream{address: hostPort, serverName: host}, nil
+	case strings.HasPrefix(address, "udp://"):
+		return &plainUpstream{address: withPort(strings.TrimPrefix(address, "udp://"), "53")}, nil
+	case strings.Contains(address, "://"):
+		return nil, fmt.Errorf("unsupported DNS upstream %q", address)
+	default:
+		return &plainUpstream{address: withPort(address, "53")}, nil
+	}
+}
+
+func withPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+// plainUpstream speaks DNS over UDP, falling back to TCP for truncated
+// answers
+type plainUpstream struct {
+	address string
+}
+
+func (u *plainUpstream) String() string { return "udp://" + u.address }
+
+func (u *plainUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		response := buffer[:n]
+		// Ignore stray datagrams that do not answer this query
+		if n < 2 || response[0] != query[0] || response[1] != query[1] {
+			continue
+		}
+
+		var parser dnsmessage.Parser
+		header, err := parser.Start(response)
+		if err != nil {
+			return nil, err
+		}
+		if header.Truncated {
+			tcp, err := dialer.DialContext(ctx, "tcp", u.address)
+			if err != nil {
+				return nil, err
+			}
+			defer tcp.Close()
+			return streamExchange(ctx, tcp, query)
+		}
+
+		answer := make([]byte, n)
+		copy(answer, response)
+		return answer, nil
+	}
+}
+
+// tlsUpstream speaks DNS over TLS (RFC 7858)
+type tlsUpstream struct {
+	address    string
+	serverName string
+}
+
+func (u *tlsUpstream) String() string { return "tls://" + u.address }
+
+func (u *tlsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dialer := tls.Dialer{Config: &tls.Config{ServerName: u.serverName}}
+	conn, err := dialer.DialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return streamExchange(ctx, conn, query)
+}
+
+// httpsUpstream speaks DNS over HTTPS (RFC 8484)
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+func (u *httpsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, errors.New("short response")
+	}
+	return response, nil
+}
+
+// streamExchange sends one query over a TCP or TLS connection
+func streamExchange(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := writeMessage(conn, query); err != nil {
+		return nil, err
+	}
+	return readMessage(conn)
+}
@@ -0,0 +1,301 @@
+package guard
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxFailures = 5
+	defaultBan         = time.Minute
+	defaultMaxBan      = 24 * time.Hour
+	defaultMaxEntries  = 100000
+
+	// failureWindow is how long failures short of a ban are remembered;
+	// keys that were banned before are remembered for MaxBan
+	failureWindow = 15 * time.Minute
+)
+
+// Key namespaces, so admin and tunnel counters never share an entry
+const (
+	AdminIP    = "admin-ip:"
+	AdminLogin = "admin-login:"
+	TunnelIP   = "tunnel-ip:"
+	TunnelID   = "tunnel-client:"
+)
+
+type Config struct {
+	// MaxFailures is how many failures are tolerated before a ban
+	MaxFailures int
+	// BaseBan is the first ban duration; each repeat ban doubles it
+	BaseBan time.Duration
+	// MaxBan caps the exponential backoff
+	MaxBan time.Duration
+	// Allowlist holds IPs or CIDRs that are never counted or banned
+	Allowlist []string
+	// MaxEntries bounds the keys tracked at once, so a scan from many
+	// addresses cannot grow the table without limit
+	MaxEntries int
+}
+
+type Ban struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	Strikes     int       `json:"strikes"`
+	BannedUntil time.Time `json:"banned_until"`
+	LastFailure time.Time `json:"last_failure"`
+}
+
+type entry struct {
+	failures    int
+	strikes     int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// Guard counts authentication failures per key (source IP, account) and
+// issues temporary bans whose length grows exponentially with repeat offences.
+// A nil *Guard never bans.
+type Guard struct {
+	config    Config
+	allowlist []*net.IPNet
+	entries   map[string]*entry
+	mutex     sync.Mutex
+	lastPrune time.Time
+}
+
+func New(config Config) *Guard {
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = defaultMaxFailures
+	}
+	if config.BaseBan <= 0 {
+		config.BaseBan = defaultBan
+	}
+	if config.MaxBan <= 0 {
+		config.MaxBan = defaultMaxBan
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultMaxEntries
+	}
+
+	g := &Guard{
+		config:  config,
+		entries: make(map[string]*entry),
+	}
+
+	for _, item := range config.Allowlist {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(item); err == nil {
+			g.allowlist = append(g.allowlist, network)
+		}
+	}
+
+	return g
+}
+
+// Allowlisted reports whether an IP is exempt from counting and bans
+func (g *Guard) Allowlisted(ip string) bool {
+	if g == nil {
+		return false
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range g.allowlist {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Banned returns the remaining ban time of the first banned key
+func (g *Guard) Banned(keys ...string) (time.Duration, bool) {
+	if g == nil {
+		return 0, false
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		if e, exists := g.entries[key]; exists && now.Before(e.bannedUntil) {
+			return e.bannedUntil.Sub(now), true
+		}
+	}
+	return 0, false
+}
+
+// Failure records a failed attempt for every key. It returns the keys that
+// became banned as a result.
+func (g *Guard) Failure(keys ...string) []string {
+	if g == nil {
+		return nil
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	g.prune(now)
+
+	var banned []string
+	for _, key := range keys {
+		e, exists := g.entries[key]
+		if !exists {
+			if len(g.entries) >= g.config.MaxEntries && !g.evict(now) {
+				// Every slot holds a ban; the key is not tracked until one ends
+				continue
+			}
+			e = &entry{}
+			g.entries[key] = e
+		}
+
+		// Forget old offences once the key has behaved long enough
+		if g.stale(e, now) {
+			e.failures = 0
+			e.strikes = 0
+		}
+
+		e.failures++
+		e.lastFailure = now
+
+		if e.failures >= g.config.MaxFailures {
+			ban := g.config.BaseBan << e.strikes
+			if ban > g.config.MaxBan || ban <= 0 {
+				ban = g.config.MaxBan
+			}
+			e.bannedUntil = now.Add(ban)
+			e.failures = 0
+			e.strikes++
+			banned = append(banned, key)
+		}
+	}
+	return banned
+}
+
+// Success clears the failure counters of the given keys
+func (g *Guard) Success(keys ...string) {
+	if g == nil {
+		return
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, key := range keys {
+		if e, exists := g.entries[key]; exists && time.Now().After(e.bannedUntil) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// List returns the currently active bans
+func (g *Guard) List() []Ban {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0)
+	for key, e := range g.entries {
+		if now.Before(e.bannedUntil) {
+			bans = append(bans, Ban{
+				Key:         key,
+				Failures:    e.failures,
+				Strikes:     e.strikes,
+				BannedUntil: e.bannedUntil,
+				LastFailure: e.lastFailure,
+			})
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].BannedUntil.After(bans[j].BannedUntil) })
+	return bans
+}
+
+// Clear removes a key's counters and ban
+func (g *Guard) Clear(key string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, exists := g.entries[key]; !exists {
+		return false
+	}
+	delete(g.entries, key)
+	return true
+}
+
+// ClearAll removes every counter and ban
+func (g *Guard) ClearAll() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.entries = make(map[string]*entry)
+}
+
+// stale reports whether an entry's offences are old enough to forget:
+// failures short of a ban after failureWindow, earlier bans after MaxBan
+func (g *Guard) stale(e *entry, now time.Time) bool {
+	if now.Before(e.bannedUntil) {
+		return false
+	}
+	idle := now.Sub(e.lastFailure)
+	if e.strikes == 0 {
+		return idle > failureWindow
+	}
+	return idle > g.config.MaxBan
+}
+
+// prune drops idle entries; must be called with the mutex held
+func (g *Guard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = now
+
+	for key, e := range g.entries {
+		if g.stale(e, now) {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// evict makes room in a full table, dropping stale entries and the keys that
+// failed only once, then the unbanned key that failed longest ago. It
+// reports whether there is room; must be called with the mutex held.
+func (g *Guard) evict(now time.Time) bool {
+	var oldestKey string
+	var oldest time.Time
+	for key, e := range g.entries {
+		if g.stale(e, now) || (e.failures <= 1 && e.strikes == 0) {
+			delete(g.entries, key)
+			continue
+		}
+		if now.Before(e.bannedUntil) {
+			continue
+		}
+		if oldestKey == "" || e.lastFailure.Before(oldest) {
+			oldestKey, oldest = key, e.lastFailure
+		}
+	}
+	if len(g.entries) < g.config.MaxEntries {
+		return true
+	}
+	if oldestKey == "" {
+		return false
+	}
+	delete(g.entries, oldestKey)
+	return true
+}
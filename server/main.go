@@ -6,13 +6,23 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"syscall"
+	"time"
 
+	"yuki-server/acl"
+	"yuki-server/admin"
 	"yuki-server/api"
+	"yuki-server/audit"
 	"yuki-server/client"
 	"yuki-server/config"
+	"yuki-server/crypto"
+	"yuki-server/dns"
+	"yuki-server/guard"
 	"yuki-server/proto"
 	"yuki-server/tunnel"
 
@@ -41,14 +51,185 @@ func main() {
 	// Initialize client manager
 	clientManager := client.NewManager()
 
-	// Create TUN interface at startup
-	log.Println("🔧 Creating TUN interface...")
-	tunFile, err := tunnel.CreateTunInterface("tun0", "10.0.0.1/24", 1500)
+	var clientsFile, adminsFile, auditFile, aclFile string
+	if cfg.Storage.DataDir != "" {
+		if err := os.MkdirAll(cfg.Storage.DataDir, 0700); err != nil {
+			log.Fatalf("Failed to create data dir: %v", err)
+		}
+		clientsFile = filepath.Join(cfg.Storage.DataDir, "clients.json")
+		adminsFile = filepath.Join(cfg.Storage.DataDir, "admins.json")
+		auditFile = filepath.Join(cfg.Storage.DataDir, "audit.jsonl")
+		aclFile = filepath.Join(cfg.Storage.DataDir, "acl.json")
+
+		if err := clientManager.LoadFromJSON(clientsFile); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to load clients: %v", err)
+		}
+	}
+
+	// Open the audit log, optionally mirrored to a JSONL file for SIEM ingestion
+	auditLog, err := audit.NewLog(auditFile, cfg.Audit.MirrorFile, audit.Retention{
+		MemoryEvents: cfg.Audit.MemoryEvents,
+		MaxFileSize:  int64(cfg.Audit.MaxFileMB) << 20,
+		MaxFiles:     cfg.Audit.MaxFiles,
+	})
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer auditLog.Close()
+
+	// Initialize admin accounts, seeding the owner from the config on first start
+	secretsKey, err := crypto.DeriveKey(cfg.Auth.JWTSecret, "yuki admin secrets")
+	if err != nil {
+		log.Fatalf("Failed to derive secrets key: %v", err)
+	}
+	adminManager, err := admin.NewManager(adminsFile, secretsKey)
+	if err != nil {
+		log.Fatalf("Failed to load admin users: %v", err)
+	}
+	if err := adminManager.Bootstrap(cfg.Auth.AdminLogin, cfg.Auth.AdminPassword); err != nil {
+		log.Fatalf("Failed to create owner account: %v", err)
+	}
+
+	// Brute-force protection shared by admin login and tunnel authentication
+	authGuard := guard.New(guard.Config{
+		MaxFailures: cfg.Security.MaxFailures,
+		BaseBan:     time.Duration(cfg.Security.BanSeconds) * time.Second,
+		MaxBan:      time.Duration(cfg.Security.MaxBanSeconds) * time.Second,
+		Allowlist:   cfg.Security.Allowlist,
+	})
+
+	// Assign every client a stable address in the tunnel subnet
+	tunnelNetwork := cfg.Tunnel.Network
+	if tunnelNetwork == "" {
+		tunnelNetwork = "10.0.0.1/24"
+	}
+	if err := clientManager.SetTunnelNetwork(tunnelNetwork); err != nil {
+		log.Fatalf("Invalid tunnel network %q: %v", tunnelNetwork, err)
+	}
+	gatewayIP := clientManager.TunnelNetwork().Addr().String()
+	// Forwards may not take the server's own ports
+	clientManager.ReservePorts("tcp", cfg.Server.Port, cfg.Server.AdminPort)
+
+	// Filter what clients may reach through the tunnel
+	aclEngine, err := acl.New(aclFile, acl.Config{Network: clientManager.TunnelNetwork()})
 	if err != nil {
-		log.Fatalf("Failed to create TUN interface: %v", err)
+		log.Fatalf("Failed to load ACL policies: %v", err)
+	}
+
+	mtu := cfg.Tunnel.MTU
+	if mtu == 0 {
+		mtu = 1500
+	}
+
+	// Terminate client traffic in a kernel TUN device or, without root,
+	// in a userspace network stack
+	var tunQueues []net.Conn
+	var netstack *tunnel.Netstack
+	switch cfg.Tunnel.Mode {
+	case "", "tun":
+		log.Println("🔧 Creating TUN interface...")
+		queues := cfg.Tunnel.Queues
+		if queues == 0 {
+			queues = runtime.NumCPU()
+		}
+		created, err := tunnel.CreateTunQueues("tun0", tunnelNetwork, mtu, tunnel.TunOptions{
+			Queues:  queues,
+			Offload: cfg.Tunnel.Offload,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create TUN interface: %v", err)
+		}
+		for _, queue := range created {
+			tunQueues = append(tunQueues, queue)
+		}
+		log.Printf("✅ Created TUN interface tun0 with IP %s and %d queues", gatewayIP, len(tunQueues))
+	case "netstack":
+		netstack, err = tunnel.NewNetstack(tunnel.NetstackConfig{
+			Network: clientManager.TunnelNetwork(),
+			MTU:     mtu,
+		})
+		if err != nil {
+			log.Fatalf("Failed to create userspace network stack: %v", err)
+		}
+		tunQueues = []net.Conn{netstack}
+		log.Printf("✅ Started userspace network stack with IP %s", gatewayIP)
+	default:
+		log.Fatalf("Invalid tunnel mode %q: must be tun or netstack", cfg.Tunnel.Mode)
+	}
+
+	// Create the tunnel service on the shared TUN connection
+	tunnelServer := tunnel.NewServerWithTunQueues(clientManager, tunQueues)
+	tunnelServer.SetLANGroups(cfg.Tunnel.LANGroups)
+	if netstack != nil {
+		// Client subnets are only reachable from other clients
+		tunnelServer.SetForwardDialer(netstack.DialContext)
+	} else {
+		tunnelServer.SetTunDevice("tun0")
+	}
+	forwardHost := cfg.Server.Address
+	if forwardHost == "" {
+		forwardHost = "0.0.0.0"
+	}
+	tunnelServer.SetForwardAddress(forwardHost)
+	tunnelServer.SyncRoutes()
+
+	// Keep client subnets off the server's own networks
+	tunDevice := "tun0"
+	if netstack != nil {
+		tunDevice = ""
+	}
+	clientManager.SetHostNetworks(func() []netip.Prefix {
+		return tunnel.HostNetworks(tunDevice)
+	})
+
+	// Answer DNS on the gateway so clients do not depend on a public resolver
+	var resolver *dns.Resolver
+	dnsServers := cfg.Tunnel.DNS
+	if cfg.DNS.Enabled {
+		dnsConfig := dns.Config{
+			Upstreams: cfg.DNS.Upstreams,
+			CacheSize: cfg.DNS.CacheSize,
+			Network:   clientManager.TunnelNetwork().Masked(),
+			// Clients on a LAN find each other as <client-name>.yuki
+			LocalDomain: tunnel.LANDomain,
+			LocalLookup: tunnelServer.LANHost,
+		}
+		for _, list := range cfg.DNS.Blocklists {
+			dnsConfig.Blocklists = append(dnsConfig.Blocklists, dns.BlocklistConfig{
+				File:    list.File,
+				Clients: list.Clients,
+				Tags:    list.Tags,
+			})
+		}
+
+		resolver, err = dns.New(dnsConfig, func(addr netip.Addr) (string, []string, bool) {
+			c, ok := tunnelServer.ClientByAddress(addr)
+			if !ok {
+				return "", nil, false
+			}
+			return c.ID, c.Tags, true
+		})
+		if err != nil {
+			log.Fatalf("Invalid DNS settings: %v", err)
+		}
+
+		dnsAddress := net.JoinHostPort(gatewayIP, "53")
+		if netstack != nil {
+			netstack.SetDNS(resolver)
+		} else if err := resolver.Listen(dnsAddress); err != nil {
+			log.Fatalf("Failed to start DNS resolver: %v", err)
+		}
+		log.Printf("🧭 DNS resolver listening on %s", dnsAddress)
+		clientManager.ReservePorts("tcp", 53)
+		clientManager.ReservePorts("udp", 53)
+
+		if len(dnsServers) == 0 {
+			dnsServers = []string{gatewayIP}
+		}
+	}
+	if len(dnsServers) == 0 {
+		dnsServers = []string{"8.8.8.8", "8.8.4.4"}
 	}
-	tunConn := tunnel.NewTunConn(tunFile, "10.0.0.1", "10.0.0.2")
-	log.Println("✅ Created TUN interface tun0 with IP 10.0.0.1")
 
 	// Setup gRPC server with TLS
 	creds, err := credentials.NewServerTLSFromFile(cfg.Server.CertFile, cfg.Server.KeyFile)
@@ -56,14 +237,37 @@ func main() {
 		log.Fatalf("Failed to load TLS credentials: %v", err)
 	}
 
-	grpcServer := grpc.NewServer(grpc.Creds(creds))
+	keepAlive := tunnel.KeepAlive{
+		Interval: time.Duration(cfg.Tunnel.KeepAlive) * time.Second,
+		Timeout:  time.Duration(cfg.Tunnel.KeepAliveTimeout) * time.Second,
+	}
+	grpcServer := grpc.NewServer(append([]grpc.ServerOption{grpc.Creds(creds)}, keepAlive.ServerOptions()...)...)
 	
-	// Register tunnel service with shared TUN connection
-	tunnelServer := tunnel.NewServerWithTun(clientManager, tunConn)
+	// Configure and register the tunnel service
+	tunnelServer.SetAuditLog(auditLog)
+	tunnelServer.SetGuard(authGuard)
+	tunnelServer.SetACL(aclEngine)
+	tunnelServer.SetSessionLimits(cfg.Limits.MaxSessionsPerClient, tunnel.SessionLimitPolicy(cfg.Limits.SessionLimitPolicy))
+	tunnelServer.SetMaxSessions(cfg.Limits.MaxClients)
+	tunnelServer.SetCompression(cfg.Tunnel.Compression)
+	tunnelServer.SetKeepAlive(keepAlive)
+	tunnelServer.SetQueueSettings(tunnel.QueueSettings{
+		Size:     cfg.Tunnel.QueueSize,
+		Policy:   tunnel.QueuePolicy(cfg.Tunnel.QueuePolicy),
+		Priority: cfg.Tunnel.Priority,
+	})
+	tunnelServer.SetTunnelSettings(tunnel.TunnelSettings{
+		MTU:    mtu,
+		DNS:    dnsServers,
+		Routes: cfg.Tunnel.Routes,
+	})
 	proto.RegisterTunnelServiceServer(grpcServer, tunnelServer)
 
 	// Setup HTTP/REST API server
-	apiServer := api.NewAPI(clientManager, cfg.Auth.AdminAPIKey, cfg.Auth.AdminLogin, cfg.Auth.AdminPassword)
+	apiServer := api.NewAPI(clientManager, adminManager, auditLog, authGuard, cfg.Auth.AdminAPIKey)
+	apiServer.SetSessionManager(tunnelServer)
+	apiServer.SetDNS(resolver, dnsServers)
+	apiServer.SetACL(aclEngine)
 	router := apiServer.SetupRoutes()
 
 	// Start gRPC server (main service on port 443)
@@ -92,6 +296,19 @@ func main() {
 		}
 	}()
 
+	// Periodically persist clients (ownership, traffic counters)
+	if clientsFile != "" {
+		go func() {
+			ticker := time.NewTicker(30 * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := clientManager.SaveToJSON(clientsFile); err != nil {
+					log.Printf("⚠️ Failed to save clients: %v", err)
+				}
+			}
+		}()
+	}
+
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -103,8 +320,26 @@ func main() {
 	<-sigChan
 	log.Println("🛑 Shutting down servers...")
 
+	// Tell clients to come back later and give them a moment to leave
+	tunnelServer.Drain(tunnel.Maintenance{
+		Reason:     "server is shutting down",
+		RetryAfter: 30,
+	}, time.Duration(cfg.Tunnel.DrainSeconds)*time.Second)
+
 	grpcServer.GracefulStop()
 	httpServer.Close()
+	if resolver != nil {
+		resolver.Close()
+	}
+	if netstack != nil {
+		netstack.Close()
+	}
+
+	if clientsFile != "" {
+		if err := clientManager.SaveToJSON(clientsFile); err != nil {
+			log.Printf("⚠️ Failed to save clients: %v", err)
+		}
+	}
 
 	log.Println("✅ Shutdown complete")
 }
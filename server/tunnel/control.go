@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+
+	"yuki-server/crypto"
+	"yuki-server/proto"
+
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// quotaWarningRatio is the share of its traffic limit at which a session is
+// warned that it is about to be cut off
+const quotaWarningRatio = 0.9
+
+// NoticeLevel is how prominently a client should show a notice
+type NoticeLevel string
+
+const (
+	NoticeInfo     NoticeLevel = "info"
+	NoticeWarning  NoticeLevel = "warning"
+	NoticeCritical NoticeLevel = "critical"
+)
+
+var noticeLevels = map[NoticeLevel]proto.Notice_Level{
+	NoticeInfo:     proto.Notice_INFO,
+	NoticeWarning:  proto.Notice_WARNING,
+	NoticeCritical: proto.Notice_CRITICAL,
+}
+
+func (l NoticeLevel) Valid() bool {
+	_, ok := noticeLevels[l]
+	return ok
+}
+
+// Notice is a message from the administrators to the users of live sessions
+type Notice struct {
+	Text  string      `json:"text"`
+	Level NoticeLevel `json:"level"`
+}
+
+// ConfigUpdate changes the tunnel settings of live sessions. Empty fields
+// leave the client's current setting alone.
+type ConfigUpdate struct {
+	DNS    []string `json:"dns,omitempty"`
+	Routes []string `json:"routes,omitempty"`
+	MTU    uint32   `json:"mtu,omitempty"`
+}
+
+func (u ConfigUpdate) Validate() error {
+	for _, dns := range u.DNS {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			return fmt.Errorf("invalid DNS server %q", dns)
+		}
+	}
+	for _, route := range u.Routes {
+		if _, err := netip.ParsePrefix(route); err != nil {
+			return fmt.Errorf("invalid route %q", route)
+		}
+	}
+	if u.MTU != 0 && (u.MTU < 576 || u.MTU > 65535) {
+		return fmt.Errorf("MTU must be between 576 and 65535")
+	}
+	if len(u.DNS) == 0 && len(u.Routes) == 0 && u.MTU == 0 {
+		return fmt.Errorf("nothing to update")
+	}
+	return nil
+}
+
+// SendNotice delivers a notice to the given sessions and returns how many
+// of them got it
+func (s *Server) SendNotice(sessionIDs []string, notice Notice) int {
+	return s.sendTo(sessionIDs, &proto.ControlMessage{
+		Message: &proto.ControlMessage_Notice{
+			Notice: &proto.Notice{Text: notice.Text, Level: noticeLevels[notice.Level]},
+		},
+	})
+}
+
+// SendConfigUpdate pushes new tunnel settings to the given sessions and
+// returns how many of them got it
+func (s *Server) SendConfigUpdate(sessionIDs []string, update ConfigUpdate) int {
+	return s.sendTo(sessionIDs, &proto.ControlMessage{
+		Message: &proto.ControlMessage_ConfigUpdate{
+			ConfigUpdate: &proto.ConfigUpdate{Dns: update.DNS, Routes: update.Routes, Mtu: update.MTU},
+		},
+	})
+}
+
+func (s *Server) sendTo(sessionIDs []string, message *proto.ControlMessage) int {
+	sessions := make([]*Session, 0, len(sessionIDs))
+	for _, id := range sessionIDs {
+		if session, exists := s.sessions.get(id); exists {
+			sessions = append(sessions, session)
+		}
+	}
+
+	return sendAll(sessions, message)
+}
+
+// broadcast sends a control message to every live session
+func (s *Server) broadcast(message *proto.ControlMessage) {
+	sendAll(s.sessions.list(), message)
+}
+
+func sendAll(sessions []*Session, message *proto.ControlMessage) int {
+	sent := 0
+	for _, session := range sessions {
+		if err := session.sendControl(message); err != nil {
+			log.Printf("⚠️ Control message to %s failed: %v", session.ID, err)
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// sendControl sends a control frame to the client
+func (session *Session) sendControl(message *proto.ControlMessage) error {
+	payload, err := protobuf.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	frame := &crypto.Frame{Type: 3, Length: uint32(len(payload)), Data: payload}
+	return session.sendFrame(session.stream, frame, session.ID)
+}
+
+// disconnect tells the client why its session is ending and whether it may
+// connect again
+func (session *Session) disconnect(reason string, retry bool) error {
+	return session.sendControl(&proto.ControlMessage{
+		Message: &proto.ControlMessage_Disconnect{
+			Disconnect: &proto.Disconnect{Reason: reason, Retry: retry},
+		},
+	})
+}
+
+// warnQuota sends a QuotaWarning the first time the session's traffic
+// passes quotaWarningRatio of limit
+func (session *Session) warnQuota(used, limit int64) {
+	if limit <= 0 || float64(used) < float64(limit)*quotaWarningRatio {
+		return
+	}
+	if session.quotaWarned.Swap(true) {
+		return
+	}
+
+	err := session.sendControl(&proto.ControlMessage{
+		Message: &proto.ControlMessage_QuotaWarning{
+			QuotaWarning: &proto.QuotaWarning{UsedBytes: used, LimitBytes: limit},
+		},
+	})
+	if err != nil {
+		log.Printf("⚠️ Quota warning to %s failed: %v", session.ID, err)
+	}
+}
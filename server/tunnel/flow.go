@@ -0,0 +1,465 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"yuki-server/crypto"
+	"yuki-server/proto"
+
+	"google.golang.org/grpc/codes"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// flowWindow is how many bytes of a TCP flow either side may send
+	// before the other grants more
+	flowWindow = 256 * 1024
+	// flowChunk is the largest data message the server sends
+	flowChunk = 16 * 1024
+	// flowQueueSize bounds the data messages waiting to be written to a
+	// flow's destination
+	flowQueueSize = 256
+	// maxFlowsPerSession bounds the flows one session keeps open
+	maxFlowsPerSession = 1024
+)
+
+var (
+	errFlowBlocked = errors.New("blocked by policy")
+	errFlowWindow  = errors.New("flow window exceeded")
+)
+
+// flow is a TCP connection or UDP association the client terminated
+// itself, relayed to its destination by the server
+type flow struct {
+	id       uint32
+	network  string
+	address  string
+	session  *Session
+	opened   time.Time
+	writes   chan []byte
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// mutex guards conn, remote and the window; cond wakes the reader when
+	// the client grants more window or the flow closes
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	conn    net.Conn
+	remote  string
+	credit  int
+	pending int
+
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+	// active is when the client last sent data, in Unix nanoseconds
+	active atomic.Int64
+}
+
+// FlowInfo is a point-in-time view of an open flow
+type FlowInfo struct {
+	ID          uint32    `json:"id"`
+	Network     string    `json:"network"`
+	Destination string    `json:"destination"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	Opened      time.Time `json:"opened"`
+	BytesUp     int64     `json:"bytes_up"`
+	BytesDown   int64     `json:"bytes_down"`
+}
+
+// handleFlow acts on a flow frame from the client
+func (s *Server) handleFlow(session *Session, payload []byte) {
+	if session.Features&uint64(proto.Feature_FEATURE_FLOWS) == 0 {
+		return
+	}
+
+	message := &proto.FlowMessage{}
+	if err := protobuf.Unmarshal(payload, message); err != nil {
+		log.Printf("⚠️ Malformed flow message from %s: %v", session.ID, err)
+		return
+	}
+
+	switch m := message.Message.(type) {
+	case *proto.FlowMessage_Open:
+		s.openFlow(session, message.FlowId, m.Open)
+
+	case *proto.FlowMessage_Data:
+		f := session.flow(message.FlowId)
+		if f == nil {
+			return
+		}
+		session.countDown(len(m.Data))
+		f.bytesDown.Add(int64(len(m.Data)))
+		f.active.Store(time.Now().UnixNano())
+		if err := f.queue(m.Data); err != nil {
+			f.fail(err)
+		}
+
+	case *proto.FlowMessage_Window:
+		if f := session.flow(message.FlowId); f != nil {
+			f.grant(int(m.Window))
+		}
+
+	case *proto.FlowMessage_Close:
+		if f := session.flow(message.FlowId); f != nil {
+			f.close()
+		}
+	}
+}
+
+// openFlow registers a flow and connects it to its destination in the
+// background, so a slow dial does not hold up the session
+func (s *Server) openFlow(session *Session, id uint32, open *proto.FlowOpen) {
+	if open.Network != "tcp" && open.Network != "udp" {
+		session.sendFlow(&proto.FlowMessage{FlowId: id, Message: flowClose("unsupported network")})
+		return
+	}
+
+	f := &flow{
+		id:      id,
+		network: open.Network,
+		address: open.Address,
+		session: session,
+		opened:  time.Now(),
+		writes:  make(chan []byte, flowQueueSize),
+		done:    make(chan struct{}),
+		credit:  flowWindow,
+	}
+	f.cond = sync.NewCond(&f.mutex)
+	f.active.Store(time.Now().UnixNano())
+
+	if err := session.addFlow(f); err != nil {
+		session.sendFlow(&proto.FlowMessage{FlowId: id, Message: flowClose(err.Error())})
+		return
+	}
+
+	go func() {
+		conn, err := s.dialFlow(session, f)
+		if err != nil {
+			if errors.Is(err, errFlowBlocked) {
+				session.countDropped()
+			}
+			f.fail(err)
+			return
+		}
+
+		f.mutex.Lock()
+		f.conn, f.remote = conn, conn.RemoteAddr().String()
+		f.mutex.Unlock()
+		select {
+		case <-f.done:
+			// The client gave up while the dial was in progress
+			conn.Close()
+			return
+		default:
+		}
+
+		session.sendFlow(&proto.FlowMessage{
+			FlowId:  id,
+			Message: &proto.FlowMessage_Opened{Opened: &proto.FlowOpened{RemoteAddress: f.remote}},
+		})
+		go f.write()
+		f.read()
+	}()
+}
+
+// dialFlow resolves the flow's destination and connects to the first
+// address the ACL allows
+func (s *Server) dialFlow(session *Session, f *flow) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(f.address)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := net.DefaultResolver.LookupPort(ctx, f.network, port)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	err = errFlowBlocked
+	for _, addr := range addrs {
+		destination := netip.AddrPortFrom(addr.Unmap(), uint16(portNumber))
+		if !s.acl.AllowFlow(session.ClientID, session.Tags(), f.network, destination) {
+			continue
+		}
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, f.network, destination.String())
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// read relays from the destination to the client. TCP data waits for the
+// client to grant window; UDP datagrams go out as they come.
+func (f *flow) read() {
+	buffer := make([]byte, 65535)
+	for {
+		size := len(buffer)
+		if f.network == "tcp" {
+			size = f.waitCredit()
+			if size == 0 {
+				return
+			}
+		} else {
+			f.conn.SetReadDeadline(time.Now().Add(udpForwardIdle))
+		}
+
+		n, err := f.conn.Read(buffer[:size])
+		if n > 0 {
+			if f.network == "tcp" {
+				f.spend(n)
+			}
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+			if f.session.sendFlow(&proto.FlowMessage{FlowId: f.id, Message: &proto.FlowMessage_Data{Data: data}}) != nil {
+				f.close()
+				return
+			}
+			f.bytesUp.Add(int64(n))
+			used := f.session.countUp(n)
+			maxBandwidth := f.session.maxBandwidth.Load()
+			f.session.warnQuota(used, maxBandwidth)
+			if maxBandwidth > 0 && used > maxBandwidth {
+				f.session.close(codes.ResourceExhausted, "bandwidth limit exceeded")
+				return
+			}
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, f.active.Load())) < udpForwardIdle {
+				// The client is still sending on this association
+				continue
+			}
+			f.fail(nil)
+			return
+		}
+	}
+}
+
+// write relays data from the client to the destination and grants the
+// client window for what was written
+func (f *flow) write() {
+	for {
+		select {
+		case <-f.done:
+			return
+		case data := <-f.writes:
+			if _, err := f.conn.Write(data); err != nil {
+				f.fail(err)
+				return
+			}
+			if f.network != "tcp" {
+				continue
+			}
+
+			f.mutex.Lock()
+			f.pending -= len(data)
+			f.mutex.Unlock()
+			f.session.sendFlow(&proto.FlowMessage{FlowId: f.id, Message: &proto.FlowMessage_Window{Window: uint32(len(data))}})
+		}
+	}
+}
+
+// queue hands data from the client to the writer. UDP datagrams are
+// dropped when the destination is not keeping up; TCP data beyond the
+// window the server granted breaks the flow.
+func (f *flow) queue(data []byte) error {
+	if f.network == "tcp" {
+		f.mutex.Lock()
+		f.pending += len(data)
+		exceeded := f.pending > flowWindow
+		f.mutex.Unlock()
+		if exceeded {
+			return errFlowWindow
+		}
+	}
+
+	select {
+	case f.writes <- data:
+	default:
+		if f.network == "tcp" {
+			return errFlowWindow
+		}
+	}
+	return nil
+}
+
+// waitCredit blocks until the client has granted window and returns how
+// much may be read at most, or 0 once the flow is closed
+func (f *flow) waitCredit() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for f.credit <= 0 && !f.closed() {
+		f.cond.Wait()
+	}
+	if f.closed() {
+		return 0
+	}
+
+	return min(f.credit, flowChunk)
+}
+
+// spend takes n bytes the reader sent from the client's window
+func (f *flow) spend(n int) {
+	f.mutex.Lock()
+	f.credit -= n
+	f.mutex.Unlock()
+}
+
+func (f *flow) grant(n int) {
+	f.mutex.Lock()
+	f.credit += n
+	f.mutex.Unlock()
+	f.cond.Broadcast()
+}
+
+func (f *flow) closed() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail closes the flow and tells the client why
+func (f *flow) fail(err error) {
+	if f.closed() {
+		return
+	}
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+	f.session.sendFlow(&proto.FlowMessage{FlowId: f.id, Message: flowClose(reason)})
+	f.close()
+}
+
+// close releases the flow without telling the client
+func (f *flow) close() {
+	f.doneOnce.Do(func() {
+		close(f.done)
+		f.session.removeFlow(f)
+
+		f.mutex.Lock()
+		if f.conn != nil {
+			f.conn.Close()
+		}
+		f.mutex.Unlock()
+		f.cond.Broadcast()
+	})
+}
+
+func (f *flow) info() FlowInfo {
+	f.mutex.Lock()
+	remote := f.remote
+	f.mutex.Unlock()
+
+	return FlowInfo{
+		ID:          f.id,
+		Network:     f.network,
+		Destination: f.address,
+		RemoteAddr:  remote,
+		Opened:      f.opened,
+		BytesUp:     f.bytesUp.Load(),
+		BytesDown:   f.bytesDown.Load(),
+	}
+}
+
+func flowClose(reason string) *proto.FlowMessage_Close {
+	return &proto.FlowMessage_Close{Close: &proto.FlowClose{Error: reason}}
+}
+
+// sendFlow sends a flow frame to the client
+func (session *Session) sendFlow(message *proto.FlowMessage) error {
+	payload, err := protobuf.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	frame := &crypto.Frame{Type: 4, Length: uint32(len(payload)), Data: payload}
+	return session.sendFrame(session.stream, frame, session.ID)
+}
+
+func (session *Session) addFlow(f *flow) error {
+	session.flowsMutex.Lock()
+	defer session.flowsMutex.Unlock()
+
+	if session.flows == nil {
+		session.flows = make(map[uint32]*flow)
+	}
+	if _, exists := session.flows[f.id]; exists {
+		return errors.New("flow ID in use")
+	}
+	if len(session.flows) >= maxFlowsPerSession {
+		return errors.New("too many flows")
+	}
+	session.flows[f.id] = f
+	session.flowsOpened++
+	return nil
+}
+
+func (session *Session) removeFlow(f *flow) {
+	session.flowsMutex.Lock()
+	defer session.flowsMutex.Unlock()
+
+	if session.flows[f.id] == f {
+		delete(session.flows, f.id)
+	}
+}
+
+func (session *Session) flow(id uint32) *flow {
+	session.flowsMutex.Lock()
+	defer session.flowsMutex.Unlock()
+	return session.flows[id]
+}
+
+// Flows lists the session's open flows, oldest first
+func (session *Session) Flows() []FlowInfo {
+	session.flowsMutex.Lock()
+	flows := make([]*flow, 0, len(session.flows))
+	for _, f := range session.flows {
+		flows = append(flows, f)
+	}
+	session.flowsMutex.Unlock()
+
+	infos := make([]FlowInfo, 0, len(flows))
+	for _, f := range flows {
+		infos = append(infos, f.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Opened.Before(infos[j].Opened) })
+	return infos
+}
+
+// closeFlows releases every flow once the session has ended
+func (session *Session) closeFlows() {
+	session.flowsMutex.Lock()
+	flows := make([]*flow, 0, len(session.flows))
+	for _, f := range session.flows {
+		flows = append(flows, f)
+	}
+	session.flowsMutex.Unlock()
+
+	for _, f := range flows {
+		f.close()
+	}
+}
@@ -0,0 +1,412 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"yuki-server/client"
+)
+
+const (
+	// forwardDialTimeout bounds connecting to the client's service
+	forwardDialTimeout = 10 * time.Second
+	// udpForwardIdle closes UDP mappings of a forward that went quiet
+	udpForwardIdle = time.Minute
+	// forwardFlowLinger keeps accepting the replies of a closed forward
+	// connection for as long as the kernel keeps it in TIME_WAIT
+	forwardFlowLinger = time.Minute
+)
+
+// DialFunc opens a connection from the gateway to a client's tunnel
+// address. It calls bound with the connection's local address before the
+// first packet is sent.
+type DialFunc func(ctx context.Context, network, address string, bound func(local netip.AddrPort)) (net.Conn, error)
+
+// forwardFlow is a connection a forward opened to a client's service, as
+// the service's replies address it
+type forwardFlow struct {
+	protocol byte
+	service  netip.AddrPort
+	gateway  netip.AddrPort
+}
+
+// forwardListener runs one forward while its client is connected
+type forwardListener struct {
+	clientID string
+	forward  client.Forward
+	service  netip.AddrPort
+	target   string
+	dial     DialFunc
+	flows    *sync.Map
+	closer   io.Closer
+
+	mutex sync.Mutex
+	// conns are the proxied connections, with the flow of those that lead
+	// to the client's service. The flow's pointer is its value in flows, so
+	// a connection only ever removes its own registration.
+	conns map[net.Conn]*forwardFlow
+	done  bool
+}
+
+// SetForwardAddress sets the address forwards listen on, normally the
+// server's public address. Without it forwards are not published.
+func (s *Server) SetForwardAddress(host string) {
+	s.forwardHost = host
+}
+
+// SetForwardDialer makes forwards reach clients through dial, for servers
+// whose tunnel network is not routed by the kernel
+func (s *Server) SetForwardDialer(dial DialFunc) {
+	s.forwardDial = dial
+}
+
+// ForwardsChanged starts and stops the listeners of a client's forwards so
+// they run exactly while the client has a live session. It returns the
+// forwards that could not listen, by forward ID.
+func (s *Server) ForwardsChanged(clientID string) map[string]error {
+	if s.forwardHost == "" {
+		return nil
+	}
+
+	var forwards []client.Forward
+	var target netip.Addr
+	if c, exists := s.clientManager.GetClient(clientID); exists {
+		forwards = c.Forwards
+		target, _ = s.clientAddress(c)
+	}
+	if !target.IsValid() {
+		forwards = nil
+	}
+
+	s.forwardsMutex.Lock()
+	defer s.forwardsMutex.Unlock()
+
+	wanted := make(map[string]client.Forward, len(forwards))
+	for _, forward := range forwards {
+		wanted[forward.ID] = forward
+	}
+
+	for id, listener := range s.forwards {
+		if listener.clientID != clientID {
+			continue
+		}
+		// A forward follows the client to the session that now has its
+		// address
+		if _, keep := wanted[id]; keep && listener.service.Addr() == target {
+			continue
+		}
+		listener.stop()
+		delete(s.forwards, id)
+		log.Printf("🔌 Stopped forward %s/%d", listener.forward.Protocol, listener.forward.PublicPort)
+	}
+
+	if !target.IsValid() {
+		return nil
+	}
+	var failed map[string]error
+	for id, forward := range wanted {
+		if _, running := s.forwards[id]; running {
+			continue
+		}
+		listener, err := s.startForward(clientID, forward, target)
+		if err != nil {
+			log.Printf("⚠️ Forward %s/%d failed: %v", forward.Protocol, forward.PublicPort, err)
+			if failed == nil {
+				failed = make(map[string]error)
+			}
+			failed[id] = err
+			continue
+		}
+		s.forwards[id] = listener
+		log.Printf("📡 Forwarding %s/%d to %s", forward.Protocol, forward.PublicPort, listener.target)
+	}
+	return failed
+}
+
+// clientAddress returns the tunnel address a client is reached at: its own
+// while a session has it, else that of its oldest session. It is false
+// while the client has no session that is not closing.
+func (s *Server) clientAddress(c *client.Client) (netip.Addr, bool) {
+	own, _ := netip.ParseAddr(c.TunnelIP)
+	var addr netip.Addr
+	for _, session := range s.sessions.client(c.ID) {
+		if session.closing.Load() {
+			continue
+		}
+		if session.TunnelIP == own {
+			return own, true
+		}
+		if !addr.IsValid() {
+			addr = session.TunnelIP
+		}
+	}
+	return addr, addr.IsValid()
+}
+
+// ClientByAddress returns the client a tunnel address belongs to, whether
+// its own or one lent to one of its sessions
+func (s *Server) ClientByAddress(addr netip.Addr) (*client.Client, bool) {
+	if peer := s.sessions.route(addr); peer != nil && peer.TunnelIP == addr {
+		return s.clientManager.GetClient(peer.ClientID)
+	}
+	return s.clientManager.ClientByTunnelIP(addr.String())
+}
+
+// forwardReply reports whether a packet from session belongs to a
+// connection a forward opened to the client's service. The ACL keeps
+// clients away from the server, so these replies are let through before
+// it; every other packet to the gateway goes through the ACL.
+func (s *Server) forwardReply(session *Session, packet []byte) bool {
+	if len(packet) < 24 || packet[0]>>4 != 4 {
+		return false
+	}
+	protocol := packet[9]
+	if protocol != 6 && protocol != 17 {
+		return false
+	}
+	src, _ := packetSource(packet)
+	dst, _ := packetDestination(packet)
+	if src != session.TunnelIP || dst != session.gateway {
+		return false
+	}
+	headerLength := int(packet[0]&0x0f) * 4
+	if len(packet) < headerLength+4 {
+		return false
+	}
+
+	_, exists := s.forwardFlows.Load(forwardFlow{
+		protocol: protocol,
+		service:  netip.AddrPortFrom(src, binary.BigEndian.Uint16(packet[headerLength:])),
+		gateway:  netip.AddrPortFrom(dst, binary.BigEndian.Uint16(packet[headerLength+2:])),
+	})
+	return exists
+}
+
+// startForward listens on the forward's public port; must be called with
+// forwardsMutex held
+func (s *Server) startForward(clientID string, forward client.Forward, target netip.Addr) (*forwardListener, error) {
+	address := net.JoinHostPort(s.forwardHost, strconv.Itoa(forward.PublicPort))
+	service := netip.AddrPortFrom(target, uint16(forward.TargetPort))
+	listener := &forwardListener{
+		clientID: clientID,
+		forward:  forward,
+		service:  service,
+		target:   service.String(),
+		dial:     s.forwardDial,
+		flows:    &s.forwardFlows,
+		conns:    make(map[net.Conn]*forwardFlow),
+	}
+	if listener.dial == nil {
+		listener.dial = dialFromGateway(s.clientManager.TunnelNetwork().Addr())
+	}
+
+	if forward.Protocol == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		listener.closer = conn
+		go listener.serveUDP(conn)
+		return listener, nil
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	listener.closer = l
+	go listener.serveTCP(l)
+	return listener, nil
+}
+
+// stop closes the listener and every connection it proxies
+func (l *forwardListener) stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.done = true
+	l.closer.Close()
+	for conn := range l.conns {
+		conn.Close()
+	}
+}
+
+// dialService connects to the client's service. The connection's flow is
+// registered before its first packet, so the service's replies, the TCP
+// handshake included, are recognized as forward replies.
+func (l *forwardListener) dialService(ctx context.Context, network string) (net.Conn, error) {
+	var flow *forwardFlow
+	conn, err := l.dial(ctx, network, l.target, func(local netip.AddrPort) {
+		flow = &forwardFlow{protocol: 6, service: l.service, gateway: local}
+		if network == "udp" {
+			flow.protocol = 17
+		}
+		l.flows.Store(*flow, flow)
+	})
+	if err == nil && !l.track(conn, flow) {
+		conn.Close()
+		err = net.ErrClosed
+	}
+	if err != nil {
+		if flow != nil {
+			l.flows.CompareAndDelete(*flow, flow)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// track registers a proxied connection and the flow of those to the
+// client's service; it is false once the forward has stopped
+func (l *forwardListener) track(conn net.Conn, flow *forwardFlow) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.done {
+		return false
+	}
+	l.conns[conn] = flow
+	return true
+}
+
+// untrack closes a proxied connection. Its flow stays registered while the
+// closed connection can still get replies, unless another connection has
+// taken the flow over.
+func (l *forwardListener) untrack(conn net.Conn) {
+	l.mutex.Lock()
+	flow := l.conns[conn]
+	delete(l.conns, conn)
+	l.mutex.Unlock()
+	conn.Close()
+
+	if flow != nil {
+		time.AfterFunc(forwardFlowLinger, func() {
+			l.flows.CompareAndDelete(*flow, flow)
+		})
+	}
+}
+
+// dialFromGateway dials through the kernel from the gateway address,
+// binding the socket first so bound learns its port before the connection
+// starts
+func dialFromGateway(gateway netip.Addr) DialFunc {
+	return func(ctx context.Context, network, address string, bound func(local netip.AddrPort)) (net.Conn, error) {
+		dialer := net.Dialer{
+			Control: func(_, _ string, c syscall.RawConn) error {
+				var bindErr error
+				err := c.Control(func(fd uintptr) {
+					if bindErr = syscall.Bind(int(fd), &syscall.SockaddrInet4{Addr: gateway.As4()}); bindErr != nil {
+						return
+					}
+					var local syscall.Sockaddr
+					if local, bindErr = syscall.Getsockname(int(fd)); bindErr != nil {
+						return
+					}
+					if local, ok := local.(*syscall.SockaddrInet4); ok {
+						bound(netip.AddrPortFrom(netip.AddrFrom4(local.Addr), uint16(local.Port)))
+					}
+				})
+				if err != nil {
+					return err
+				}
+				return bindErr
+			},
+		}
+		return dialer.DialContext(ctx, network+"4", address)
+	}
+}
+
+func (l *forwardListener) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.proxyTCP(conn)
+	}
+}
+
+func (l *forwardListener) proxyTCP(conn net.Conn) {
+	if !l.track(conn, nil) {
+		conn.Close()
+		return
+	}
+	defer l.untrack(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	upstream, err := l.dialService(ctx, "tcp")
+	cancel()
+	if err != nil {
+		log.Printf("⚠️ Forward to %s failed: %v", l.target, err)
+		return
+	}
+	defer l.untrack(upstream)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	// Either side closing ends the proxied connection
+	<-done
+}
+
+// serveUDP relays datagrams, keeping one connection to the client's service
+// per remote address
+func (l *forwardListener) serveUDP(conn net.PacketConn) {
+	var mutex sync.Mutex
+	mappings := make(map[string]net.Conn)
+
+	buffer := make([]byte, 65535)
+	for {
+		n, remote, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		mutex.Lock()
+		upstream, exists := mappings[remote.String()]
+		if !exists {
+			upstream, err = l.dialService(context.Background(), "udp")
+			if err != nil {
+				mutex.Unlock()
+				continue
+			}
+			mappings[remote.String()] = upstream
+
+			go func(remote net.Addr, upstream net.Conn) {
+				defer func() {
+					mutex.Lock()
+					delete(mappings, remote.String())
+					mutex.Unlock()
+					l.untrack(upstream)
+				}()
+
+				reply := make([]byte, 65535)
+				for {
+					upstream.SetReadDeadline(time.Now().Add(udpForwardIdle))
+					n, err := upstream.Read(reply)
+					if err != nil {
+						return
+					}
+					conn.WriteTo(reply[:n], remote)
+				}
+			}(remote, upstream)
+		}
+		mutex.Unlock()
+
+		upstream.Write(buffer[:n])
+	}
+}
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"yuki-server/client"
+)
+
+// gatewaySegment is a TCP packet from 10.0.0.2 to the gateway 10.0.0.1
+func gatewaySegment(sourcePort, destinationPort uint16) []byte {
+	packet := tcpSegment(false, 1, 1, tcpACK|tcpSYN, nil)
+	copy(packet[16:20], netip.MustParseAddr("10.0.0.1").AsSlice())
+	binary.BigEndian.PutUint16(packet[20:], sourcePort)
+	binary.BigEndian.PutUint16(packet[22:], destinationPort)
+	return packet
+}
+
+func TestForwardReplyNeedsForwardFlow(t *testing.T) {
+	clientManager := client.NewManager()
+	if err := clientManager.SetTunnelNetwork("10.0.0.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(clientManager)
+	session := &Session{
+		TunnelIP: netip.MustParseAddr("10.0.0.2"),
+		gateway:  netip.MustParseAddr("10.0.0.1"),
+	}
+	server.forwardFlows.Store(forwardFlow{
+		protocol: 6,
+		service:  netip.MustParseAddrPort("10.0.0.2:8080"),
+		gateway:  netip.MustParseAddrPort("10.0.0.1:41000"),
+	}, &forwardFlow{})
+
+	tests := []struct {
+		name   string
+		packet []byte
+		reply  bool
+	}{
+		{"reply", gatewaySegment(8080, 41000), true},
+		{"from the service port to another gateway port", gatewaySegment(8080, 8443), false},
+		{"from another port", gatewaySegment(8081, 41000), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reply := server.forwardReply(session, test.packet); reply != test.reply {
+				t.Fatalf("forwardReply = %v, want %v", reply, test.reply)
+			}
+		})
+	}
+
+	udp := gatewaySegment(8080, 41000)
+	udp[9] = 17
+	if server.forwardReply(session, udp) {
+		t.Fatal("UDP packet passed as the reply of a TCP flow")
+	}
+}
+
+// TestNetstackDialBindsFirst checks that a forward learns its port before
+// the SYN leaves, so the client's SYN-ACK is recognized
+func TestNetstackDialBindsFirst(t *testing.T) {
+	netstack, err := NewNetstack(NetstackConfig{Network: netip.MustParsePrefix("10.0.0.1/24")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netstack.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ports := make(chan netip.AddrPort, 1)
+	go netstack.DialContext(ctx, "tcp", "10.0.0.2:8080", func(local netip.AddrPort) {
+		ports <- local
+	})
+
+	packet := make([]byte, 1500)
+	n, err := netstack.Read(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var local netip.AddrPort
+	select {
+	case local = <-ports:
+	default:
+		t.Fatal("SYN sent before the local address was reported")
+	}
+	if n < 40 || packet[33]&tcpSYN == 0 {
+		t.Fatal("first packet is not a SYN")
+	}
+	source, _ := packetSource(packet[:n])
+	if source != local.Addr() || binary.BigEndian.Uint16(packet[20:]) != local.Port() {
+		t.Fatalf("SYN from %v:%d, bound %v", source, binary.BigEndian.Uint16(packet[20:]), local)
+	}
+}
+
+func TestDialFromGatewayReportsPort(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var local netip.AddrPort
+	dial := dialFromGateway(netip.MustParseAddr("127.0.0.1"))
+	conn, err := dial(context.Background(), "tcp", listener.Addr().String(), func(bound netip.AddrPort) {
+		local = bound
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if local.String() != conn.LocalAddr().String() {
+		t.Fatalf("bound %v, connection from %v", local, conn.LocalAddr())
+	}
+}
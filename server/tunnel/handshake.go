@@ -0,0 +1,178 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"yuki-server/crypto"
+	"yuki-server/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const (
+	// ProtocolVersion is the newest protocol version the server speaks
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest client version still accepted
+	MinProtocolVersion = 1
+)
+
+// helloTimeout bounds the wait for a client's ClientHello. Clients from
+// before the handshake never send one.
+const helloTimeout = 10 * time.Second
+
+// ticketTTL is how long a session ticket can take over its session
+const ticketTTL = 24 * time.Hour
+
+// supportedFeatures is the bitmap of proto.Features the server implements
+var supportedFeatures = uint64(proto.Feature_FEATURE_FLOWS)
+
+// TunnelSettings are the network settings handed to clients in the
+// handshake
+type TunnelSettings struct {
+	MTU    int
+	DNS    []string
+	Routes []string
+}
+
+// SetCompression decides whether clients may compress their sessions
+func (s *Server) SetCompression(enabled bool) {
+	s.compression = enabled
+}
+
+// features is the bitmap of proto.Features offered to clients
+func (s *Server) features() uint64 {
+	features := supportedFeatures
+	if s.compression {
+		features |= uint64(proto.Feature_FEATURE_COMPRESSION)
+	}
+	return features
+}
+
+// SetTunnelSettings sets the MTU, DNS servers and routes sent to clients
+func (s *Server) SetTunnelSettings(settings TunnelSettings) {
+	s.settings = settings
+}
+
+func newTicketKey() []byte {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	return key
+}
+
+// receiveHello waits for the client's ClientHello and checks that its
+// protocol version is still supported
+func receiveHello(stream proto.TunnelService_ConnectServer) (*proto.ClientHello, error) {
+	frames := make(chan *proto.TunnelFrame, 1)
+	errs := make(chan error, 1)
+	go func() {
+		frame, err := stream.Recv()
+		if err != nil {
+			errs <- err
+			return
+		}
+		frames <- frame
+	}()
+
+	timer := time.NewTimer(helloTimeout)
+	defer timer.Stop()
+
+	var frame *proto.TunnelFrame
+	select {
+	case frame = <-frames:
+	case err := <-errs:
+		return nil, err
+	case <-timer.C:
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"no ClientHello received: the client is too old, protocol version %d or newer is required", MinProtocolVersion)
+	}
+
+	hello := &proto.ClientHello{}
+	if err := protobuf.Unmarshal(frame.Data, hello); err != nil {
+		// Clients from before the handshake open with their raw key
+		if len(frame.Data) == crypto.KeySize {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"the client is too old, protocol version %d or newer is required: please update the client", MinProtocolVersion)
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "malformed ClientHello")
+	}
+	if hello.Version < MinProtocolVersion {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"protocol version %d is not supported, the server accepts %d to %d: please update the client",
+			hello.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	return hello, nil
+}
+
+// serverHello builds the handshake reply for a new session
+func (s *Server) serverHello(session *Session, key []byte) ([]byte, error) {
+	network := s.clientManager.TunnelNetwork()
+	return protobuf.Marshal(&proto.ServerHello{
+		Version:    session.Version,
+		Features:   session.Features,
+		Key:        key,
+		Addresses:  []string{netip.PrefixFrom(session.TunnelIP, network.Bits()).String()},
+		Gateway:    network.Addr().String(),
+		Mtu:        uint32(s.settings.MTU),
+		Dns:        s.settings.DNS,
+		Routes:     append(append([]string(nil), s.settings.Routes...), s.peerRoutes(session.ClientID)...),
+		ServerTime: time.Now().UnixMilli(),
+		Ticket:     s.issueTicket(session),
+	})
+}
+
+// issueTicket returns a ticket that lets the session's client take the
+// session over from a new connection within ticketTTL
+func (s *Server) issueTicket(session *Session) []byte {
+	payload := fmt.Sprintf("%s|%s|%d", session.ClientID, session.ID, time.Now().Add(ticketTTL).Unix())
+	mac := hmac.New(sha256.New, s.ticketKey)
+	mac.Write([]byte(payload))
+	return mac.Sum([]byte(payload))
+}
+
+// ticketSession returns the session a ticket was issued for, if the ticket
+// is genuine, unexpired and belongs to clientID
+func (s *Server) ticketSession(ticket []byte, clientID string) (string, bool) {
+	if len(ticket) <= sha256.Size {
+		return "", false
+	}
+
+	payload, sum := ticket[:len(ticket)-sha256.Size], ticket[len(ticket)-sha256.Size:]
+	mac := hmac.New(sha256.New, s.ticketKey)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return "", false
+	}
+
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 3 || parts[0] != clientID {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// featureNames lists the features set in a bitmap
+func featureNames(features uint64) []string {
+	names := make([]string, 0)
+	for bit := uint64(1); bit != 0 && bit <= features; bit <<= 1 {
+		if features&bit == 0 {
+			continue
+		}
+		if name, ok := proto.Feature_name[int32(bit)]; ok {
+			names = append(names, strings.ToLower(strings.TrimPrefix(name, "FEATURE_")))
+		}
+	}
+	return names
+}
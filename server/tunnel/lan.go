@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// LANDomain is the DNS zone clients on a LAN find each other under, as
+// "<client-name>.yuki"
+const LANDomain = "yuki"
+
+// SetLANGroups sets the client tags that form private LANs. Sessions of
+// clients that share one of these tags exchange packets directly.
+func (s *Server) SetLANGroups(groups []string) {
+	s.lanGroups = make(map[string]bool, len(groups))
+	for _, group := range groups {
+		s.lanGroups[group] = true
+	}
+}
+
+// sharesLAN reports whether two clients' tags have a LAN group in common
+func (s *Server) sharesLAN(tags, peerTags []string) bool {
+	for _, tag := range tags {
+		if !s.lanGroups[tag] {
+			continue
+		}
+		for _, peerTag := range peerTags {
+			if peerTag == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// switchLAN hands a packet from session straight to the live session of
+// another client on the same LAN, bypassing the kernel and the ACL. It
+// reports false when the packet must take the normal path.
+func (s *Server) switchLAN(session *Session, packet []byte) bool {
+	if len(s.lanGroups) == 0 {
+		return false
+	}
+
+	src, ok := packetSource(packet)
+	if !ok {
+		return false
+	}
+	dst, ok := packetDestination(packet)
+	if !ok {
+		return false
+	}
+
+	peer := s.sessions.route(dst)
+	if peer == nil || peer.ClientID == session.ClientID {
+		return false
+	}
+
+	// Only packets from the session's own address or subnets, so a client
+	// cannot pose as another LAN member.
+	if !s.sessions.owns(session, src) {
+		return false
+	}
+
+	if !s.sharesLAN(session.Tags(), peer.Tags()) {
+		return false
+	}
+
+	s.scheduler.enqueue(peer, newPacket(packet))
+	return true
+}
+
+// LANHost resolves a DNS label to the tunnel address of the client with that
+// host name, if it shares a LAN group with the client at source. When names
+// collide the oldest client wins.
+func (s *Server) LANHost(label string, source netip.Addr) (netip.Addr, bool) {
+	if len(s.lanGroups) == 0 {
+		return netip.Addr{}, false
+	}
+
+	from, exists := s.ClientByAddress(source)
+	if !exists {
+		return netip.Addr{}, false
+	}
+
+	clients := s.clientManager.ListClients()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Created.Before(clients[j].Created) })
+	for _, c := range clients {
+		if c.HostName() != label || !s.sharesLAN(from.Tags, c.Tags) {
+			continue
+		}
+		if addr, ok := s.clientAddress(c); ok {
+			return addr, true
+		}
+		if addr, err := netip.ParseAddr(c.TunnelIP); err == nil {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
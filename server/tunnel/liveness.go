@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"time"
+
+	"yuki-server/crypto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	defaultKeepAliveInterval = 15 * time.Second
+	// grpcMinPingInterval is how often clients may send HTTP/2 pings; the
+	// client library never pings more often than every 10 seconds
+	grpcMinPingInterval = 5 * time.Second
+)
+
+// KeepAlive configures how sessions are kept alive and found dead
+type KeepAlive struct {
+	// Interval is how often the server pings each client, 0 for 15 seconds
+	Interval time.Duration
+	// Timeout ends sessions that did not ping or answer a ping for that
+	// long, 0 for two intervals
+	Timeout time.Duration
+}
+
+func (k KeepAlive) withDefaults() KeepAlive {
+	if k.Interval <= 0 {
+		k.Interval = defaultKeepAliveInterval
+	}
+	if k.Timeout <= 0 {
+		k.Timeout = 2 * k.Interval
+	}
+	return k
+}
+
+// ServerOptions make the gRPC server ping idle connections and accept the
+// pings of clients that keep their connection alive the same way
+func (k KeepAlive) ServerOptions() []grpc.ServerOption {
+	k = k.withDefaults()
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    k.Interval,
+			Timeout: k.Timeout,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             grpcMinPingInterval,
+			PermitWithoutStream: true,
+		}),
+	}
+}
+
+// SetKeepAlive sets the ping interval and timeout of sessions
+func (s *Server) SetKeepAlive(k KeepAlive) {
+	s.keepAlive = k.withDefaults()
+}
+
+// rttEstimator smooths round-trip samples the way TCP does and tracks
+// jitter as the mean deviation between consecutive samples (RFC 3550)
+type rttEstimator struct {
+	rtt    time.Duration
+	jitter time.Duration
+	last   time.Duration
+}
+
+func (e *rttEstimator) add(sample time.Duration) {
+	if e.last == 0 {
+		e.rtt = sample
+	} else {
+		e.rtt += (sample - e.rtt) / 8
+		e.jitter += (abs(sample-e.last) - e.jitter) / 16
+	}
+	e.last = sample
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// pingFrame is a ping stamped with the session's age. The client echoes
+// the stamp in its pong, so the round trip needs no synchronized clocks.
+func (session *Session) pingFrame() *crypto.Frame {
+	stamp := binary.BigEndian.AppendUint64(nil, uint64(time.Since(session.Started)))
+	return &crypto.Frame{Type: 1, Length: uint32(len(stamp)), Data: stamp}
+}
+
+// pong records an answer to a ping. Clients that do not echo the stamp
+// only prove they are alive.
+func (session *Session) pong(data []byte) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.LastPing = time.Now()
+	if len(data) != 8 {
+		return
+	}
+	sample := time.Since(session.Started) - time.Duration(binary.BigEndian.Uint64(data))
+	if sample <= 0 {
+		return
+	}
+	session.rtt.add(sample)
+	session.RTT = session.rtt.rtt
+	session.Jitter = session.rtt.jitter
+}
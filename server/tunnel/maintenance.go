@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"yuki-server/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Maintenance describes the server's maintenance mode. While enabled, new
+// sessions are refused and live ones are asked to reconnect later or to
+// ServerAddress, then closed once DrainDeadline passes.
+type Maintenance struct {
+	Enabled       bool      `json:"enabled"`
+	Reason        string    `json:"reason,omitempty"`
+	RetryAfter    int64     `json:"retry_after,omitempty"`
+	ServerAddress string    `json:"server_address,omitempty"`
+	DrainDeadline time.Time `json:"drain_deadline,omitempty"`
+}
+
+func (m Maintenance) reconnect() *proto.ControlMessage {
+	return &proto.ControlMessage{
+		Message: &proto.ControlMessage_Reconnect{
+			Reconnect: &proto.Reconnect{
+				Reason:        m.Reason,
+				RetryAfter:    m.RetryAfter,
+				ServerAddress: m.ServerAddress,
+			},
+		},
+	}
+}
+
+// trailer carries the reconnect hints on a refused Connect, for clients that
+// never got a session to receive a control frame on
+func (m Maintenance) trailer() metadata.MD {
+	md := metadata.Pairs("yuki-retry-after", strconv.FormatInt(m.RetryAfter, 10))
+	if m.ServerAddress != "" {
+		md.Append("yuki-server-address", m.ServerAddress)
+	}
+	return md
+}
+
+// SetMaxSessions caps the number of concurrent sessions server-wide; 0
+// disables the cap
+func (s *Server) SetMaxSessions(max int) {
+	s.maintenanceMutex.Lock()
+	defer s.maintenanceMutex.Unlock()
+	s.maxSessions = max
+}
+
+func (s *Server) Maintenance() Maintenance {
+	s.maintenanceMutex.Lock()
+	defer s.maintenanceMutex.Unlock()
+	return s.maintenance
+}
+
+// SetMaintenance switches maintenance mode. Enabling it tells every live
+// session to reconnect and closes the sessions still open after drain.
+func (s *Server) SetMaintenance(m Maintenance, drain time.Duration) {
+	s.maintenanceMutex.Lock()
+	if s.drainTimer != nil {
+		s.drainTimer.Stop()
+		s.drainTimer = nil
+	}
+	if !m.Enabled {
+		s.maintenance = Maintenance{}
+		s.maintenanceMutex.Unlock()
+		log.Println("✅ Maintenance mode disabled")
+		return
+	}
+
+	m.DrainDeadline = time.Now().Add(drain)
+	s.maintenance = m
+	s.drainTimer = time.AfterFunc(drain, func() {
+		s.closeAll(codes.Unavailable, "server is in maintenance")
+	})
+	s.maintenanceMutex.Unlock()
+
+	log.Printf("🚧 Maintenance mode enabled, draining sessions within %s", drain)
+	s.broadcast(m.reconnect())
+}
+
+// Drain enables maintenance mode and blocks until every session is gone or
+// the deadline has passed
+func (s *Server) Drain(m Maintenance, drain time.Duration) {
+	m.Enabled = true
+	s.SetMaintenance(m, drain)
+
+	deadline := time.Now().Add(drain + disconnectTimeout + time.Second)
+	for time.Now().Before(deadline) {
+		if s.sessions.count() == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// admit checks server-wide admission before a session is created
+func (s *Server) admit(stream proto.TunnelService_ConnectServer) error {
+	s.maintenanceMutex.Lock()
+	maintenance := s.maintenance
+	s.maintenanceMutex.Unlock()
+
+	if maintenance.Enabled {
+		stream.SetTrailer(maintenance.trailer())
+		message := "server is in maintenance"
+		if maintenance.Reason != "" {
+			message += ": " + maintenance.Reason
+		}
+		return status.Error(codes.Unavailable, message)
+	}
+	return nil
+}
+
+// closeAll terminates every live session
+func (s *Server) closeAll(code codes.Code, reason string) {
+	sessions := s.sessions.list()
+	for _, session := range sessions {
+		session.close(code, reason)
+	}
+	if len(sessions) > 0 {
+		log.Printf("🔌 Closed %d session(s): %s", len(sessions), reason)
+	}
+}
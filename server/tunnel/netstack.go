@@ -0,0 +1,396 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	netstackNIC = 1
+	// netstackQueueSize is how many packets the stack may have waiting for
+	// the dispatcher
+	netstackQueueSize = 1024
+	// tcpReceiveWindow and maxInFlight bound connections being set up
+	tcpReceiveWindow = 0
+	maxInFlight      = 1024
+)
+
+// DNSHandler answers DNS queries the netstack receives for the gateway
+type DNSHandler interface {
+	ResolveUDP(query []byte, source netip.Addr) []byte
+	ServeConn(conn net.Conn)
+}
+
+// NetstackConfig describes the tunnel network the userspace stack serves
+type NetstackConfig struct {
+	// Network is the tunnel subnet with the gateway address
+	Network netip.Prefix
+	MTU     int
+}
+
+// Netstack terminates tunneled packets in a userspace TCP/IP stack and
+// opens their TCP and UDP flows as ordinary sockets, so the server needs
+// neither /dev/net/tun nor root. It stands in for the TUN device: clients'
+// packets are written to it and replies are read from it.
+//
+// DNS to the gateway goes to the DNSHandler. Other flows to the gateway
+// and flows to loopback are refused, so services the host binds to
+// loopback stay out of reach as they are from a TUN device. ICMP is only
+// answered for the gateway itself.
+type Netstack struct {
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	gateway  netip.Addr
+	dns      DNSHandler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func NewNetstack(config NetstackConfig) (*Netstack, error) {
+	if !config.Network.Addr().Is4() {
+		return nil, errors.New("tunnel network must be IPv4")
+	}
+	if config.MTU <= 0 {
+		config.MTU = 1500
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
+	})
+
+	endpoint := channel.New(netstackQueueSize, uint32(config.MTU), "")
+	if err := s.CreateNIC(netstackNIC, endpoint); err != nil {
+		return nil, fmt.Errorf("failed to create NIC: %s", err)
+	}
+
+	// Accept packets for any destination and answer from it
+	s.SetPromiscuousMode(netstackNIC, true)
+	s.SetSpoofing(netstackNIC, true)
+
+	gateway := config.Network.Addr()
+	err := s.AddProtocolAddress(netstackNIC, tcpip.ProtocolAddress{
+		Protocol: ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFrom4(gateway.As4()),
+			PrefixLen: config.Network.Bits(),
+		},
+	}, stack.AddressProperties{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add gateway address: %s", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: netstackNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: netstackNIC},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Netstack{
+		stack:    s,
+		endpoint: endpoint,
+		gateway:  gateway,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	tcpForwarder := tcp.NewForwarder(s, tcpReceiveWindow, maxInFlight, n.forwardTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, n.forwardUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	return n, nil
+}
+
+// SetDNS answers DNS to the gateway with handler
+func (n *Netstack) SetDNS(handler DNSHandler) {
+	n.dns = handler
+}
+
+// Write takes a packet from a client
+func (n *Netstack) Write(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, nil
+	}
+
+	var protocol tcpip.NetworkProtocolNumber
+	switch packet[0] >> 4 {
+	case 4:
+		protocol = ipv4.ProtocolNumber
+	case 6:
+		protocol = ipv6.ProtocolNumber
+	default:
+		return len(packet), nil
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(packet),
+	})
+	n.endpoint.InjectInbound(protocol, pkt)
+	pkt.DecRef()
+	return len(packet), nil
+}
+
+// Read returns the next packet the stack sends to a client
+func (n *Netstack) Read(b []byte) (int, error) {
+	pkt := n.endpoint.ReadContext(n.ctx)
+	if pkt.IsNil() {
+		return 0, io.EOF
+	}
+	defer pkt.DecRef()
+
+	view := pkt.ToView()
+	defer view.Release()
+	return copy(b, view.AsSlice()), nil
+}
+
+func (n *Netstack) Close() error {
+	n.once.Do(func() {
+		n.cancel()
+		n.endpoint.Close()
+		n.stack.Close()
+	})
+	return nil
+}
+
+func (n *Netstack) LocalAddr() net.Addr {
+	return &net.IPAddr{IP: n.gateway.AsSlice()}
+}
+
+func (n *Netstack) RemoteAddr() net.Addr {
+	return &net.IPAddr{IP: n.gateway.AsSlice()}
+}
+
+func (n *Netstack) SetDeadline(deadline time.Time) error {
+	return nil
+}
+
+func (n *Netstack) SetReadDeadline(deadline time.Time) error {
+	return nil
+}
+
+func (n *Netstack) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
+
+// DialContext opens a connection from the gateway to a client, for
+// forwards. The endpoint is bound first, so bound learns its port before
+// the connection starts.
+func (n *Netstack) DialContext(ctx context.Context, network, address string, bound func(local netip.AddrPort)) (net.Conn, error) {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, err
+	}
+	remote := tcpip.FullAddress{NIC: netstackNIC, Addr: tcpip.AddrFrom4(addrPort.Addr().Unmap().As4()), Port: addrPort.Port()}
+
+	var protocol tcpip.TransportProtocolNumber
+	switch network {
+	case "tcp":
+		protocol = tcp.ProtocolNumber
+	case "udp":
+		protocol = udp.ProtocolNumber
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	var queue waiter.Queue
+	endpoint, tcpErr := n.stack.NewEndpoint(protocol, ipv4.ProtocolNumber, &queue)
+	if tcpErr != nil {
+		return nil, errors.New(tcpErr.String())
+	}
+	if tcpErr = endpoint.Bind(tcpip.FullAddress{NIC: netstackNIC, Addr: tcpip.AddrFrom4(n.gateway.As4())}); tcpErr != nil {
+		endpoint.Close()
+		return nil, errors.New(tcpErr.String())
+	}
+	local, tcpErr := endpoint.GetLocalAddress()
+	if tcpErr != nil {
+		endpoint.Close()
+		return nil, errors.New(tcpErr.String())
+	}
+	bound(netip.AddrPortFrom(n.gateway, local.Port))
+
+	// Return untyped nils on failure so callers can compare with nil
+	if protocol == udp.ProtocolNumber {
+		if tcpErr := endpoint.Connect(remote); tcpErr != nil {
+			endpoint.Close()
+			return nil, errors.New(tcpErr.String())
+		}
+		return gonet.NewUDPConn(n.stack, &queue, endpoint), nil
+	}
+
+	entry, notify := waiter.NewChannelEntry(waiter.WritableEvents)
+	queue.EventRegister(&entry)
+	defer queue.EventUnregister(&entry)
+
+	tcpErr = endpoint.Connect(remote)
+	if _, started := tcpErr.(*tcpip.ErrConnectStarted); started {
+		select {
+		case <-ctx.Done():
+			endpoint.Close()
+			return nil, ctx.Err()
+		case <-notify:
+		}
+		tcpErr = endpoint.LastError()
+	}
+	if tcpErr != nil {
+		endpoint.Close()
+		return nil, errors.New(tcpErr.String())
+	}
+	return gonet.NewTCPConn(&queue, endpoint), nil
+}
+
+// target returns where a flow to dst is opened on the host and whether it
+// is DNS for the gateway. It is false for flows that are refused.
+func (n *Netstack) target(dst tcpip.Address, port uint16) (target string, dns bool, ok bool) {
+	addr := netipAddr(dst)
+	if addr == n.gateway {
+		return "", true, port == 53 && n.dns != nil
+	}
+	if addr.IsLoopback() || addr.IsUnspecified() || addr.Is4In6() {
+		return "", false, false
+	}
+	return net.JoinHostPort(addr.String(), strconv.Itoa(int(port))), false, true
+}
+
+func (n *Netstack) forwardTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	target, dns, ok := n.target(id.LocalAddress, id.LocalPort)
+	if !ok {
+		r.Complete(true)
+		return
+	}
+
+	var upstream net.Conn
+	if !dns {
+		var err error
+		upstream, err = net.DialTimeout("tcp", target, forwardDialTimeout)
+		if err != nil {
+			// Refuse the client's connection like the destination did
+			r.Complete(true)
+			return
+		}
+	}
+
+	var queue waiter.Queue
+	endpoint, tcpErr := r.CreateEndpoint(&queue)
+	if tcpErr != nil {
+		r.Complete(true)
+		if upstream != nil {
+			upstream.Close()
+		}
+		return
+	}
+	r.Complete(false)
+	conn := gonet.NewTCPConn(&queue, endpoint)
+
+	if dns {
+		n.dns.ServeConn(conn)
+		return
+	}
+	defer conn.Close()
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (n *Netstack) forwardUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	target, dns, ok := n.target(id.LocalAddress, id.LocalPort)
+	if !ok {
+		return
+	}
+	source := netipAddr(id.RemoteAddress)
+
+	var queue waiter.Queue
+	endpoint, err := r.CreateEndpoint(&queue)
+	if err != nil {
+		return
+	}
+	conn := gonet.NewUDPConn(n.stack, &queue, endpoint)
+
+	go func() {
+		defer conn.Close()
+
+		if dns {
+			buffer := make([]byte, 65535)
+			for {
+				conn.SetReadDeadline(time.Now().Add(udpForwardIdle))
+				length, err := conn.Read(buffer)
+				if err != nil {
+					return
+				}
+				if response := n.dns.ResolveUDP(buffer[:length], source); response != nil {
+					conn.Write(response)
+				}
+			}
+		}
+
+		upstream, err := net.Dial("udp", target)
+		if err != nil {
+			log.Printf("⚠️ Netstack UDP flow to %s failed: %v", target, err)
+			return
+		}
+		defer upstream.Close()
+
+		go func() {
+			buffer := make([]byte, 65535)
+			for {
+				upstream.SetReadDeadline(time.Now().Add(udpForwardIdle))
+				length, err := upstream.Read(buffer)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				conn.Write(buffer[:length])
+			}
+		}()
+
+		buffer := make([]byte, 65535)
+		for {
+			conn.SetReadDeadline(time.Now().Add(udpForwardIdle))
+			length, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			upstream.Write(buffer[:length])
+		}
+	}()
+}
+
+func netipAddr(addr tcpip.Address) netip.Addr {
+	if addr.Len() == 4 {
+		return netip.AddrFrom4(addr.As4())
+	}
+	return netip.AddrFrom16(addr.As16())
+}
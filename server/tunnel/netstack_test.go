@@ -0,0 +1,53 @@
+package tunnel
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+type stubDNS struct{}
+
+func (stubDNS) ResolveUDP(query []byte, source netip.Addr) []byte { return nil }
+func (stubDNS) ServeConn(conn net.Conn)                           { conn.Close() }
+
+func TestNetstackTarget(t *testing.T) {
+	netstack, err := NewNetstack(NetstackConfig{Network: netip.MustParsePrefix("10.0.0.1/24")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netstack.Close()
+	netstack.SetDNS(stubDNS{})
+
+	tests := []struct {
+		name   string
+		dst    string
+		port   uint16
+		target string
+		dns    bool
+		ok     bool
+	}{
+		{"DNS on the gateway", "10.0.0.1", 53, "", true, true},
+		{"other gateway port", "10.0.0.1", 6379, "", true, false},
+		{"loopback", "127.0.0.1", 6379, "", false, false},
+		{"mapped loopback", "::ffff:127.0.0.1", 6379, "", false, false},
+		{"IPv6 loopback", "::1", 8080, "", false, false},
+		{"unspecified", "0.0.0.0", 8080, "", false, false},
+		{"internet", "192.0.2.1", 443, "192.0.2.1:443", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, dns, ok := netstack.target(tcpip.AddrFromSlice(netip.MustParseAddr(test.dst).AsSlice()), test.port)
+			if ok != test.ok || ok && (target != test.target || dns != test.dns) {
+				t.Fatalf("target = %q, %v, %v; want %q, %v, %v", target, dns, ok, test.target, test.dns, test.ok)
+			}
+		})
+	}
+
+	netstack.SetDNS(nil)
+	if _, _, ok := netstack.target(tcpip.AddrFrom4([4]byte{10, 0, 0, 1}), 53); ok {
+		t.Fatal("DNS on the gateway accepted without a resolver")
+	}
+}
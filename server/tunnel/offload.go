@@ -0,0 +1,379 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// virtioNetHdrLen is the size of the header IFF_VNET_HDR puts in front of
+// every packet crossing the TUN
+const virtioNetHdrLen = 10
+
+const (
+	vnetFlagNeedsCsum = 1
+
+	vnetGSONone  = 0
+	vnetGSOTCPv4 = 1
+	vnetGSOTCPv6 = 4
+	vnetGSOECN   = 0x80
+)
+
+// maxCoalesced bounds a coalesced packet, which must fit the IP length
+const maxCoalesced = 65535
+
+// virtioNetHdr describes the offloads pending on a packet. It is in the
+// host's byte order.
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.NativeEndian.Uint16(b[2:])
+	h.gsoSize = binary.NativeEndian.Uint16(b[4:])
+	h.csumStart = binary.NativeEndian.Uint16(b[6:])
+	h.csumOffset = binary.NativeEndian.Uint16(b[8:])
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.NativeEndian.PutUint16(b[2:], h.hdrLen)
+	binary.NativeEndian.PutUint16(b[4:], h.gsoSize)
+	binary.NativeEndian.PutUint16(b[6:], h.csumStart)
+	binary.NativeEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+// checksumAdd adds b to a ones' complement sum
+func checksumAdd(sum uint64, b []byte) uint64 {
+	for len(b) >= 8 {
+		word := binary.BigEndian.Uint64(b)
+		sum += word >> 32
+		sum += word & 0xffffffff
+		b = b[8:]
+	}
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds a sum to 16 bits without complementing it
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum sums the pseudo header of a TCP or UDP packet with ip as
+// its IP header and length bytes of transport header and payload
+func pseudoHeaderSum(ip []byte, ipv6 bool, protocol byte, length int) uint64 {
+	var sum uint64
+	if ipv6 {
+		sum = checksumAdd(0, ip[8:40])
+	} else {
+		sum = checksumAdd(0, ip[12:20])
+	}
+	return sum + uint64(protocol) + uint64(length)
+}
+
+// ipv4HeaderChecksum recomputes the header checksum of an IPv4 packet
+func ipv4HeaderChecksum(ip []byte) {
+	ip[10], ip[11] = 0, 0
+	binary.BigEndian.PutUint16(ip[10:], ^checksumFold(checksumAdd(0, ip)))
+}
+
+// completeChecksum finishes a checksum the kernel left to us: the field
+// already holds the pseudo header sum, and the rest is summed from start
+func completeChecksum(packet []byte, start, offset int) {
+	if start+offset+2 > len(packet) {
+		return
+	}
+	checksum := ^checksumFold(checksumAdd(0, packet[start:]))
+	if checksum == 0 && offset == 6 {
+		// UDP sends a zero checksum as all ones
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(packet[start+offset:], checksum)
+}
+
+// segmenter splits a TCP packet the kernel handed over with segmentation
+// offload into packets of at most gsoSize bytes of payload, as the stack
+// would have sent them without offload
+type segmenter struct {
+	packet      []byte
+	ipv6        bool
+	ipHeaderLen int
+	headerLen   int
+	gsoSize     int
+	offset      int
+	index       int
+	id          uint16
+	seq         uint32
+	flags       byte
+}
+
+// reset starts splitting packet and reports whether it is a TCP packet
+// that can be split
+func (g *segmenter) reset(packet []byte, header virtioNetHdr) bool {
+	g.packet = nil
+	if header.gsoSize == 0 || len(packet) < 20 {
+		return false
+	}
+
+	switch header.gsoType &^ vnetGSOECN {
+	case vnetGSOTCPv4:
+		g.ipv6 = false
+		g.ipHeaderLen = int(packet[0]&0x0f) * 4
+		if packet[0]>>4 != 4 || g.ipHeaderLen < 20 || packet[9] != 6 {
+			return false
+		}
+		g.id = binary.BigEndian.Uint16(packet[4:])
+	case vnetGSOTCPv6:
+		g.ipv6 = true
+		g.ipHeaderLen = 40
+		// Extension headers are not expected from the kernel's TCP
+		if len(packet) < 40 || packet[0]>>4 != 6 || packet[6] != 6 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if len(packet) < g.ipHeaderLen+20 {
+		return false
+	}
+	tcp := packet[g.ipHeaderLen:]
+	g.headerLen = g.ipHeaderLen + int(tcp[12]>>4)*4
+	if g.headerLen < g.ipHeaderLen+20 || len(packet) < g.headerLen {
+		return false
+	}
+
+	g.packet = packet
+	g.gsoSize = int(header.gsoSize)
+	g.offset = g.headerLen
+	g.index = 0
+	g.seq = binary.BigEndian.Uint32(tcp[4:])
+	g.flags = tcp[13]
+	return true
+}
+
+// next writes the next segment to b and returns its length, or 0 once the
+// packet is used up
+func (g *segmenter) next(b []byte) int {
+	if g.packet == nil || g.offset >= len(g.packet) && g.index > 0 {
+		g.packet = nil
+		return 0
+	}
+
+	payload := min(g.gsoSize, len(g.packet)-g.offset)
+	n := g.headerLen + payload
+	if len(b) < n {
+		g.packet = nil
+		return 0
+	}
+	copy(b, g.packet[:g.headerLen])
+	copy(b[g.headerLen:], g.packet[g.offset:g.offset+payload])
+	last := g.offset+payload >= len(g.packet)
+
+	ip := b[:g.ipHeaderLen]
+	if g.ipv6 {
+		binary.BigEndian.PutUint16(ip[4:], uint16(n-40))
+	} else {
+		binary.BigEndian.PutUint16(ip[2:], uint16(n))
+		binary.BigEndian.PutUint16(ip[4:], g.id+uint16(g.index))
+		ipv4HeaderChecksum(ip)
+	}
+
+	tcp := b[g.ipHeaderLen:n]
+	binary.BigEndian.PutUint32(tcp[4:], g.seq+uint32(g.offset-g.headerLen))
+	flags := g.flags
+	if !last {
+		// FIN and PSH belong to the last segment only
+		flags &^= 0x01 | 0x08
+	}
+	if g.index > 0 {
+		// CWR is only sent once
+		flags &^= 0x80
+	}
+	tcp[13] = flags
+	tcp[16], tcp[17] = 0, 0
+	sum := pseudoHeaderSum(ip, g.ipv6, 6, len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(sum, tcp)))
+
+	g.offset += payload
+	g.index++
+	return n
+}
+
+// coalescer joins consecutive TCP segments of the same connection into one
+// packet that the kernel splits again, so a burst from a client costs one
+// write. Only plain data segments are joined; anything else is passed on
+// as it is.
+type coalescer struct {
+	// buffer holds the virtio header and the packet being built
+	buffer      []byte
+	segments    int
+	gsoSize     int
+	ipv6        bool
+	ipHeaderLen int
+	headerLen   int
+	nextSeq     uint32
+	// pushed is set once a joined segment had PSH, which ends the packet
+	pushed bool
+	// write sends a finished packet including its virtio header
+	write func(b []byte) error
+}
+
+func newCoalescer(write func(b []byte) error) *coalescer {
+	return &coalescer{
+		buffer: make([]byte, 0, virtioNetHdrLen+maxCoalesced),
+		write:  write,
+	}
+}
+
+// add queues a packet, sending what was queued before if it cannot join it
+func (c *coalescer) add(packet []byte) error {
+	if c.segments > 0 && c.joins(packet) {
+		c.buffer = append(c.buffer, packet[c.headerLen:]...)
+		c.segments++
+		c.pushed = packet[c.ipHeaderLen+13]&0x08 != 0
+		c.nextSeq += uint32(len(packet) - c.headerLen)
+		return nil
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	ipHeaderLen, headerLen, ok := coalescable(packet)
+	c.buffer = append(c.buffer[:virtioNetHdrLen], packet...)
+	c.segments = 1
+	if !ok || packet[ipHeaderLen+13]&0x08 != 0 {
+		return c.flush()
+	}
+	c.ipv6 = packet[0]>>4 == 6
+	c.ipHeaderLen = ipHeaderLen
+	c.headerLen = headerLen
+	c.gsoSize = len(packet) - headerLen
+	c.nextSeq = binary.BigEndian.Uint32(packet[ipHeaderLen+4:]) + uint32(c.gsoSize)
+	return nil
+}
+
+// joins reports whether packet continues the packet being built
+func (c *coalescer) joins(packet []byte) bool {
+	ipHeaderLen, headerLen, ok := coalescable(packet)
+	if !ok || ipHeaderLen != c.ipHeaderLen || headerLen != c.headerLen {
+		return false
+	}
+	payload := len(packet) - headerLen
+	if payload > c.gsoSize || len(c.buffer)-virtioNetHdrLen+payload > maxCoalesced {
+		return false
+	}
+	// The last segment so far must be full, and must not have pushed
+	if c.pushed || (len(c.buffer)-virtioNetHdrLen-c.headerLen)%c.gsoSize != 0 {
+		return false
+	}
+	if binary.BigEndian.Uint32(packet[ipHeaderLen+4:]) != c.nextSeq {
+		return false
+	}
+
+	// Everything but the lengths, IDs, checksums, sequence numbers and
+	// PSH must match
+	first := c.buffer[virtioNetHdrLen:]
+	if c.ipv6 {
+		if packet[0]>>4 != 6 || !bytes.Equal(first[0:4], packet[0:4]) || !bytes.Equal(first[6:40], packet[6:40]) {
+			return false
+		}
+	} else {
+		if packet[0]>>4 != 4 || first[1] != packet[1] || !bytes.Equal(first[6:10], packet[6:10]) || !bytes.Equal(first[12:ipHeaderLen], packet[12:ipHeaderLen]) {
+			return false
+		}
+	}
+	tcp, firstTCP := packet[ipHeaderLen:headerLen], first[ipHeaderLen:headerLen]
+	return bytes.Equal(firstTCP[0:4], tcp[0:4]) && bytes.Equal(firstTCP[8:13], tcp[8:13]) &&
+		firstTCP[13]|0x08 == tcp[13]|0x08 && bytes.Equal(firstTCP[14:16], tcp[14:16]) &&
+		bytes.Equal(firstTCP[18:], tcp[18:])
+}
+
+// flush sends the packet being built
+func (c *coalescer) flush() error {
+	if c.segments == 0 {
+		return nil
+	}
+	segments, pushed := c.segments, c.pushed
+	c.segments, c.pushed = 0, false
+
+	header := virtioNetHdr{gsoType: vnetGSONone}
+	packet := c.buffer[virtioNetHdrLen:]
+	if segments > 1 {
+		ip := packet[:c.ipHeaderLen]
+		if c.ipv6 {
+			binary.BigEndian.PutUint16(ip[4:], uint16(len(packet)-40))
+			header.gsoType = vnetGSOTCPv6
+		} else {
+			binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+			ipv4HeaderChecksum(ip)
+			header.gsoType = vnetGSOTCPv4
+		}
+
+		// The kernel computes the checksum of every segment from the
+		// pseudo header sum left in the checksum field
+		tcp := packet[c.ipHeaderLen:]
+		if pushed {
+			// The kernel keeps PSH on the last segment only
+			tcp[13] |= 0x08
+		}
+		binary.BigEndian.PutUint16(tcp[16:], checksumFold(pseudoHeaderSum(ip, c.ipv6, 6, len(tcp))))
+		header.flags = vnetFlagNeedsCsum
+		header.hdrLen = uint16(c.headerLen)
+		header.gsoSize = uint16(c.gsoSize)
+		header.csumStart = uint16(c.ipHeaderLen)
+		header.csumOffset = 16
+	}
+	header.encode(c.buffer)
+	return c.write(c.buffer)
+}
+
+// coalescable returns the header lengths of a TCP data segment that may be
+// joined with others: no IP options or fragments and only ACK and PSH set
+func coalescable(packet []byte) (int, int, bool) {
+	if len(packet) < 20 {
+		return 0, 0, false
+	}
+	var ipHeaderLen int
+	switch packet[0] >> 4 {
+	case 4:
+		ipHeaderLen = 20
+		if packet[0]&0x0f != 5 || packet[9] != 6 || binary.BigEndian.Uint16(packet[6:])&0x3fff != 0 ||
+			int(binary.BigEndian.Uint16(packet[2:])) != len(packet) {
+			return 0, 0, false
+		}
+	case 6:
+		ipHeaderLen = 40
+		if len(packet) < 40 || packet[6] != 6 || int(binary.BigEndian.Uint16(packet[4:]))+40 != len(packet) {
+			return 0, 0, false
+		}
+	default:
+		return 0, 0, false
+	}
+	if len(packet) < ipHeaderLen+20 {
+		return 0, 0, false
+	}
+	tcp := packet[ipHeaderLen:]
+	headerLen := ipHeaderLen + int(tcp[12]>>4)*4
+	if headerLen < ipHeaderLen+20 || len(packet) <= headerLen || tcp[13]&^0x08 != 0x10 {
+		return 0, 0, false
+	}
+	return ipHeaderLen, headerLen, true
+}
@@ -0,0 +1,282 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+	tcpCWR = 0x80
+)
+
+// tcpSegment builds a TCP packet with valid checksums from 10.0.0.2:40000
+// to 192.0.2.1:443, or between the matching IPv6 addresses
+func tcpSegment(ipv6 bool, id uint16, seq uint32, flags byte, payload []byte) []byte {
+	ipHeaderLen := 20
+	if ipv6 {
+		ipHeaderLen = 40
+	}
+	packet := make([]byte, ipHeaderLen+20+len(payload))
+	ip := packet[:ipHeaderLen]
+	if ipv6 {
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(packet)-40))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:24], netip.MustParseAddr("fd00::2").AsSlice())
+		copy(ip[24:40], netip.MustParseAddr("2001:db8::1").AsSlice())
+	} else {
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+		binary.BigEndian.PutUint16(ip[4:], id)
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:16], netip.MustParseAddr("10.0.0.2").AsSlice())
+		copy(ip[16:20], netip.MustParseAddr("192.0.2.1").AsSlice())
+		ipv4HeaderChecksum(ip)
+	}
+
+	tcp := packet[ipHeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], 7777)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	sum := pseudoHeaderSum(ip, ipv6, 6, len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], ^checksumFold(checksumAdd(sum, tcp)))
+	return packet
+}
+
+func testPayload(n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+	return payload
+}
+
+func TestSegmenter(t *testing.T) {
+	payload := testPayload(2500)
+	tests := []struct {
+		name    string
+		ipv6    bool
+		in      byte
+		gsoSize int
+		// sizes and flags are the payload sizes and TCP flags of the
+		// segments
+		sizes []int
+		flags []byte
+	}{
+		{
+			name:    "IPv4",
+			in:      tcpACK | tcpPSH | tcpFIN | tcpCWR,
+			gsoSize: 1000,
+			sizes:   []int{1000, 1000, 500},
+			flags:   []byte{tcpACK | tcpCWR, tcpACK, tcpACK | tcpPSH | tcpFIN},
+		},
+		{
+			name:    "IPv6",
+			ipv6:    true,
+			in:      tcpACK | tcpPSH,
+			gsoSize: 1200,
+			sizes:   []int{1200, 1200, 100},
+			flags:   []byte{tcpACK, tcpACK, tcpACK | tcpPSH},
+		},
+		{
+			name:    "exact multiple",
+			in:      tcpACK,
+			gsoSize: 1250,
+			sizes:   []int{1250, 1250},
+			flags:   []byte{tcpACK, tcpACK},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			const id, seq = 0x1234, 0xfffff000
+			packet := tcpSegment(test.ipv6, id, seq, test.in, payload)
+			header := virtioNetHdr{gsoType: vnetGSOTCPv4, gsoSize: uint16(test.gsoSize)}
+			ipHeaderLen := 20
+			if test.ipv6 {
+				header.gsoType = vnetGSOTCPv6
+				ipHeaderLen = 40
+			}
+
+			var g segmenter
+			if !g.reset(packet, header) {
+				t.Fatal("packet not accepted for segmentation")
+			}
+			buffer := make([]byte, 2048)
+			offset := 0
+			for i, size := range test.sizes {
+				n := g.next(buffer)
+				if n != ipHeaderLen+20+size {
+					t.Fatalf("segment %d: length %d, want %d", i, n, ipHeaderLen+20+size)
+				}
+				segment := buffer[:n]
+				ip, tcp := segment[:ipHeaderLen], segment[ipHeaderLen:]
+
+				if test.ipv6 {
+					if length := binary.BigEndian.Uint16(ip[4:]); int(length) != n-40 {
+						t.Errorf("segment %d: payload length %d, want %d", i, length, n-40)
+					}
+				} else {
+					if length := binary.BigEndian.Uint16(ip[2:]); int(length) != n {
+						t.Errorf("segment %d: total length %d, want %d", i, length, n)
+					}
+					if got := binary.BigEndian.Uint16(ip[4:]); got != id+uint16(i) {
+						t.Errorf("segment %d: IP ID %#x, want %#x", i, got, id+uint16(i))
+					}
+					if checksumFold(checksumAdd(0, ip)) != 0xffff {
+						t.Errorf("segment %d: bad IP header checksum", i)
+					}
+				}
+				if got := binary.BigEndian.Uint32(tcp[4:]); got != seq+uint32(offset) {
+					t.Errorf("segment %d: seq %#x, want %#x", i, got, seq+uint32(offset))
+				}
+				if tcp[13] != test.flags[i] {
+					t.Errorf("segment %d: flags %#x, want %#x", i, tcp[13], test.flags[i])
+				}
+				if checksumFold(checksumAdd(pseudoHeaderSum(ip, test.ipv6, 6, len(tcp)), tcp)) != 0xffff {
+					t.Errorf("segment %d: bad TCP checksum", i)
+				}
+				if !bytes.Equal(tcp[20:], payload[offset:offset+size]) {
+					t.Errorf("segment %d: payload differs", i)
+				}
+				offset += size
+			}
+			if n := g.next(buffer); n != 0 {
+				t.Fatalf("extra segment of %d bytes", n)
+			}
+		})
+	}
+}
+
+func TestSegmenterRejects(t *testing.T) {
+	udp := tcpSegment(false, 1, 1, tcpACK, testPayload(100))
+	udp[9] = 17
+	tests := []struct {
+		name   string
+		packet []byte
+		header virtioNetHdr
+	}{
+		{"no size", tcpSegment(false, 1, 1, tcpACK, testPayload(100)), virtioNetHdr{gsoType: vnetGSOTCPv4}},
+		{"UDP", udp, virtioNetHdr{gsoType: vnetGSOTCPv4, gsoSize: 50}},
+		{"family mismatch", tcpSegment(true, 1, 1, tcpACK, testPayload(100)), virtioNetHdr{gsoType: vnetGSOTCPv4, gsoSize: 50}},
+		{"truncated", tcpSegment(false, 1, 1, tcpACK, nil)[:30], virtioNetHdr{gsoType: vnetGSOTCPv4, gsoSize: 50}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var g segmenter
+			if g.reset(test.packet, test.header) {
+				t.Fatal("packet accepted for segmentation")
+			}
+			if n := g.next(make([]byte, 2048)); n != 0 {
+				t.Fatalf("segment of %d bytes from a rejected packet", n)
+			}
+		})
+	}
+}
+
+// TestCoalesceSegment joins a burst of segments and splits the result
+// again, which must give back the original segments
+func TestCoalesceSegment(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		const id, seq, size = 100, 5000, 1000
+		payload := testPayload(4*size + 300)
+		var segments [][]byte
+		for offset := 0; offset < len(payload); offset += size {
+			end := min(offset+size, len(payload))
+			flags := byte(tcpACK)
+			if end == len(payload) {
+				flags |= tcpPSH
+			}
+			segments = append(segments, tcpSegment(ipv6, id+uint16(len(segments)), seq+uint32(offset), flags, payload[offset:end]))
+		}
+
+		var writes [][]byte
+		c := newCoalescer(func(b []byte) error {
+			writes = append(writes, bytes.Clone(b))
+			return nil
+		})
+		for _, segment := range segments {
+			if err := c.add(segment); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.flush(); err != nil {
+			t.Fatal(err)
+		}
+		if len(writes) != 1 {
+			t.Fatalf("IPv6 %v: %d writes, want the burst joined into 1", ipv6, len(writes))
+		}
+
+		var header virtioNetHdr
+		header.decode(writes[0])
+		if header.gsoSize != size || header.flags&vnetFlagNeedsCsum == 0 {
+			t.Fatalf("IPv6 %v: header %+v", ipv6, header)
+		}
+		joined := writes[0][virtioNetHdrLen:]
+		if int(header.hdrLen)+len(payload) != len(joined) {
+			t.Fatalf("IPv6 %v: joined packet of %d bytes", ipv6, len(joined))
+		}
+
+		var g segmenter
+		if !g.reset(joined, header) {
+			t.Fatalf("IPv6 %v: joined packet not accepted for segmentation", ipv6)
+		}
+		buffer := make([]byte, 2048)
+		for i, segment := range segments {
+			n := g.next(buffer)
+			if !bytes.Equal(buffer[:n], segment) {
+				t.Fatalf("IPv6 %v: segment %d differs after the round trip", ipv6, i)
+			}
+		}
+		if n := g.next(buffer); n != 0 {
+			t.Fatalf("IPv6 %v: extra segment of %d bytes", ipv6, n)
+		}
+	}
+}
+
+func TestCoalescerPassesOthers(t *testing.T) {
+	var writes [][]byte
+	c := newCoalescer(func(b []byte) error {
+		writes = append(writes, bytes.Clone(b))
+		return nil
+	})
+	packets := [][]byte{
+		tcpSegment(false, 1, 1000, tcpSYN, nil),
+		tcpSegment(false, 2, 1001, tcpACK, testPayload(500)),
+		// A gap in the sequence numbers starts a new packet
+		tcpSegment(false, 3, 9999, tcpACK, testPayload(500)),
+	}
+	for _, packet := range packets {
+		if err := c.add(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(writes) != len(packets) {
+		t.Fatalf("%d writes, want %d", len(writes), len(packets))
+	}
+	for i, write := range writes {
+		var header virtioNetHdr
+		header.decode(write)
+		if header.gsoType != vnetGSONone || !bytes.Equal(write[virtioNetHdrLen:], packets[i]) {
+			t.Errorf("packet %d changed on the way through", i)
+		}
+	}
+}
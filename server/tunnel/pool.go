@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"slices"
+	"sync"
+)
+
+// packetBufferSize covers packets up to the usual MTUs. Larger packets get
+// a buffer of their own that is not recycled, so the pool never holds more
+// than a queue of small buffers per session.
+const packetBufferSize = 2048
+
+var packetPool = sync.Pool{
+	New: func() any {
+		return &packetBuffer{data: make([]byte, 0, packetBufferSize)}
+	},
+}
+
+// packetBuffer carries a packet on its way to a session. Whoever takes it
+// off the session's outbound queue must release it once it is sent.
+type packetBuffer struct {
+	data []byte
+}
+
+// newPacket copies data into a pooled buffer
+func newPacket(data []byte) *packetBuffer {
+	if len(data) > packetBufferSize {
+		return &packetBuffer{data: slices.Clone(data)}
+	}
+	packet := packetPool.Get().(*packetBuffer)
+	packet.data = append(packet.data[:0], data...)
+	return packet
+}
+
+// release returns the buffer to the pool; it must not be used afterwards
+func (packet *packetBuffer) release() {
+	if cap(packet.data) == packetBufferSize {
+		packetPool.Put(packet)
+	}
+}
@@ -0,0 +1,388 @@
+package tunnel
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueuePolicy decides which packets a session's send queue drops when the
+// client does not keep up
+type QueuePolicy string
+
+const (
+	// TailDrop drops new packets while the queue is full
+	TailDrop QueuePolicy = "tail_drop"
+	// CoDel drops packets that waited too long, so the queue stays short
+	// even while it is not full
+	CoDel QueuePolicy = "codel"
+)
+
+const (
+	// defaultQueueSize is how many packets may wait for a session unless
+	// configured otherwise
+	defaultQueueSize = 256
+	// interactiveSize is the largest packet the priority class takes:
+	// keystrokes, game updates, DNS and TCP acknowledgements
+	interactiveSize = 256
+	// interactiveQueueSize bounds the priority class of a session
+	interactiveQueueSize = 64
+
+	// schedulerQuantum is how many bytes a session may send per round
+	schedulerQuantum = 16 * 1024
+	// schedulerBatch bounds the packets handed to a session at once
+	schedulerBatch = 64
+
+	codelTarget   = 5 * time.Millisecond
+	codelInterval = 100 * time.Millisecond
+	// codelBacklog is the backlog CoDel never drops below, about one
+	// packet at the usual MTUs
+	codelBacklog = 1500
+)
+
+// QueueSettings configure the send queues of new sessions
+type QueueSettings struct {
+	// Size is how many packets may wait per session, 0 for the default
+	Size   int
+	Policy QueuePolicy
+	// Priority sends small packets ahead of bulk traffic
+	Priority bool
+}
+
+// SetQueueSettings sets how packets wait for clients that fall behind
+func (s *Server) SetQueueSettings(settings QueueSettings) {
+	if settings.Size <= 0 {
+		settings.Size = defaultQueueSize
+	}
+	s.queueSettings = settings
+}
+
+type queuedPacket struct {
+	packet   *packetBuffer
+	enqueued time.Time
+}
+
+// packetFIFO is a fixed-size ring of packets
+type packetFIFO struct {
+	packets []queuedPacket
+	head    int
+	count   int
+	bytes   int
+}
+
+func newPacketFIFO(size int) packetFIFO {
+	return packetFIFO{packets: make([]queuedPacket, size)}
+}
+
+func (f *packetFIFO) full() bool {
+	return f.count == len(f.packets)
+}
+
+func (f *packetFIFO) push(packet *packetBuffer, now time.Time) {
+	f.packets[(f.head+f.count)%len(f.packets)] = queuedPacket{packet: packet, enqueued: now}
+	f.count++
+	f.bytes += len(packet.data)
+}
+
+func (f *packetFIFO) peek() *queuedPacket {
+	if f.count == 0 {
+		return nil
+	}
+	return &f.packets[f.head]
+}
+
+func (f *packetFIFO) pop() *packetBuffer {
+	packet := f.packets[f.head].packet
+	f.packets[f.head] = queuedPacket{}
+	f.head = (f.head + 1) % len(f.packets)
+	f.count--
+	f.bytes -= len(packet.data)
+	return packet
+}
+
+// codel is the state of the CoDel algorithm (RFC 8289) for one queue
+type codel struct {
+	firstAbove time.Time
+	dropNext   time.Time
+	count      int
+	lastCount  int
+	dropping   bool
+}
+
+// ok reports whether a packet that waited sojourn may be sent, tracking
+// how long the queue has stayed above its target
+func (c *codel) ok(sojourn time.Duration, backlog int, now time.Time) bool {
+	if sojourn < codelTarget || backlog <= codelBacklog {
+		c.firstAbove = time.Time{}
+		return true
+	}
+	if c.firstAbove.IsZero() {
+		c.firstAbove = now.Add(codelInterval)
+		return true
+	}
+	return now.Before(c.firstAbove)
+}
+
+// drop decides whether the packet at the head of the queue is dropped.
+// Drops come closer together the longer the queue stays above target.
+func (c *codel) drop(sojourn time.Duration, backlog int, now time.Time) bool {
+	ok := c.ok(sojourn, backlog, now)
+	if c.dropping {
+		if ok {
+			c.dropping = false
+			return false
+		}
+		if now.Before(c.dropNext) {
+			return false
+		}
+		c.count++
+		c.dropNext = c.controlLaw(c.dropNext)
+		return true
+	}
+	if ok {
+		return false
+	}
+
+	c.dropping = true
+	// Resume near the previous drop rate if the queue only just recovered
+	delta := c.count - c.lastCount
+	c.count = 1
+	if delta > 1 && now.Sub(c.dropNext) < 16*codelInterval {
+		c.count = delta
+	}
+	c.lastCount = c.count
+	c.dropNext = c.controlLaw(now)
+	return true
+}
+
+func (c *codel) controlLaw(t time.Time) time.Time {
+	return t.Add(time.Duration(float64(codelInterval) / math.Sqrt(float64(c.count))))
+}
+
+// sendQueue holds the packets waiting for one session
+type sendQueue struct {
+	policy   QueuePolicy
+	priority bool
+
+	mutex       sync.Mutex
+	interactive packetFIFO
+	bulk        packetFIFO
+	codel       codel
+	closed      bool
+
+	depth   atomic.Int64
+	dropped atomic.Int64
+}
+
+func newSendQueue(settings QueueSettings) *sendQueue {
+	q := &sendQueue{
+		policy:   settings.Policy,
+		priority: settings.Priority,
+		bulk:     newPacketFIFO(max(settings.Size, 1)),
+	}
+	if settings.Priority {
+		q.interactive = newPacketFIFO(interactiveQueueSize)
+	}
+	return q
+}
+
+// push queues a packet, or drops it when its class is full
+func (q *sendQueue) push(packet *packetBuffer) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	fifo := &q.bulk
+	if q.priority && len(packet.data) <= interactiveSize {
+		fifo = &q.interactive
+	}
+	if q.closed || fifo.full() {
+		q.dropped.Add(1)
+		packet.release()
+		return false
+	}
+
+	fifo.push(packet, time.Now())
+	q.depth.Add(1)
+	return true
+}
+
+// take appends to batch the packets that fit in budget bytes, interactive
+// ones first, and returns the bytes they take. CoDel drops bulk packets
+// here, once it knows how long they waited.
+func (q *sendQueue) take(batch []*packetBuffer, budget int) ([]*packetBuffer, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	spent := 0
+	for _, fifo := range []*packetFIFO{&q.interactive, &q.bulk} {
+		for len(batch) < cap(batch) {
+			head := fifo.peek()
+			if head == nil {
+				break
+			}
+			size := len(head.packet.data)
+			if fifo == &q.bulk && q.policy == CoDel {
+				now := time.Now()
+				if q.codel.drop(now.Sub(head.enqueued), fifo.bytes, now) {
+					fifo.pop().release()
+					q.depth.Add(-1)
+					q.dropped.Add(1)
+					continue
+				}
+			}
+			if spent+size > budget {
+				return batch, spent
+			}
+			batch = append(batch, fifo.pop())
+			q.depth.Add(-1)
+			spent += size
+		}
+	}
+	if q.bulk.count == 0 {
+		// An empty queue starts CoDel over
+		q.codel.dropping = false
+		q.codel.firstAbove = time.Time{}
+	}
+	return batch, spent
+}
+
+func (q *sendQueue) empty() bool {
+	return q.depth.Load() == 0
+}
+
+// handOff signals ready that a batch taken from the queue is waiting,
+// unless the queue was closed in the meantime
+func (q *sendQueue) handOff(ready chan<- struct{}) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return false
+	}
+	ready <- struct{}{}
+	return true
+}
+
+// close drops what is queued; later packets are dropped on arrival
+func (q *sendQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	for _, fifo := range []*packetFIFO{&q.interactive, &q.bulk} {
+		for fifo.count > 0 {
+			fifo.pop().release()
+		}
+	}
+	q.depth.Store(0)
+}
+
+// scheduler hands queued packets to the sessions' senders in deficit
+// round-robin order. Every session has at most one batch in flight, so a
+// client that stops reading only holds up its own queue, and no session
+// sends much more than a quantum while others wait.
+type scheduler struct {
+	mutex  sync.Mutex
+	active []*Session
+	wake   chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{wake: make(chan struct{}, 1)}
+}
+
+// enqueue queues a packet for session. It must not be used afterwards.
+func (sc *scheduler) enqueue(session *Session, packet *packetBuffer) {
+	if session.queue.push(packet) {
+		sc.activate(session)
+	}
+}
+
+// activate puts session in the round unless it is in it or sending. The
+// scheduled flag keeps the common case free of the scheduler's lock.
+func (sc *scheduler) activate(session *Session) {
+	if session.scheduled.CompareAndSwap(false, true) {
+		sc.append(session)
+	}
+}
+
+func (sc *scheduler) append(session *Session) {
+	sc.mutex.Lock()
+	sc.active = append(sc.active, session)
+	sc.mutex.Unlock()
+
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// done returns a session to the round once its sender is through a batch
+func (sc *scheduler) done(session *Session) {
+	sc.append(session)
+}
+
+// remove drops what waits for a session whose sender has stopped: its
+// queue, and a batch handed over that the sender never took
+func (sc *scheduler) remove(session *Session) {
+	session.queue.close()
+	// A batch is either handed over before the queue closed, or released
+	// by the scheduler once it finds the queue closed
+	select {
+	case <-session.ready:
+		for i, packet := range session.batch {
+			packet.release()
+			session.batch[i] = nil
+		}
+		session.batch = session.batch[:0]
+	default:
+	}
+}
+
+func (sc *scheduler) next() *Session {
+	for {
+		sc.mutex.Lock()
+		if len(sc.active) > 0 {
+			session := sc.active[0]
+			sc.active[0] = nil
+			sc.active = sc.active[1:]
+			sc.mutex.Unlock()
+			return session
+		}
+		sc.mutex.Unlock()
+		<-sc.wake
+	}
+}
+
+func (sc *scheduler) run() {
+	for {
+		session := sc.next()
+		session.deficit += schedulerQuantum
+
+		batch, spent := session.queue.take(session.batch[:0], session.deficit)
+		if len(batch) > 0 {
+			session.deficit -= spent
+			session.batch = batch
+			// The sender calls done when it has sent the batch
+			if !session.queue.handOff(session.ready) {
+				for _, packet := range batch {
+					packet.release()
+				}
+			}
+			continue
+		}
+
+		if !session.queue.empty() {
+			// The next packet is larger than the deficit so far
+			sc.append(session)
+			continue
+		}
+		session.deficit = 0
+		session.scheduled.Store(false)
+		// A packet may have arrived before the flag was cleared
+		if !session.queue.empty() {
+			sc.activate(session)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerRemoveReleasesBatch(t *testing.T) {
+	sc := newScheduler()
+	go sc.run()
+	session := &Session{
+		queue: newSendQueue(QueueSettings{Size: 16}),
+		ready: make(chan struct{}, 1),
+		batch: make([]*packetBuffer, 0, schedulerBatch),
+	}
+
+	// The sender never takes the batch, as when its session has ended
+	for range 3 {
+		sc.enqueue(session, newPacket(make([]byte, 100)))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(session.ready) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no batch handed to the session")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sc.remove(session)
+	if len(session.ready) != 0 || len(session.batch) != 0 {
+		t.Fatalf("batch of %d packets left with the session", len(session.batch))
+	}
+	if !session.queue.empty() {
+		t.Fatal("packets left in the queue")
+	}
+
+	sc.enqueue(session, newPacket(make([]byte, 100)))
+	if !session.queue.empty() || session.queue.dropped.Load() != 1 {
+		t.Fatal("packet queued for a removed session")
+	}
+}
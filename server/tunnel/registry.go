@@ -0,0 +1,175 @@
+package tunnel
+
+import (
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+)
+
+// reapInterval is how often sessions are checked for silence and expiry
+const reapInterval = time.Second
+
+// registry holds the live sessions, indexed by session ID, client and
+// tunnel address under one lock. The packet path does not take the lock: it
+// reads the routing table the registry publishes on every change.
+type registry struct {
+	mutex    sync.RWMutex
+	byID     map[string]*Session
+	byClient map[string][]*Session
+	// byIP holds the newest session of each address, so a reconnecting
+	// client gets its traffic before the old session has timed out
+	byIP map[netip.Addr]*Session
+
+	routing atomic.Pointer[routingTable]
+}
+
+func newRegistry() *registry {
+	return &registry{
+		byID:     make(map[string]*Session),
+		byClient: make(map[string][]*Session),
+		byIP:     make(map[netip.Addr]*Session),
+	}
+}
+
+// newSessionID returns a random session ID; unlike the connect time it
+// cannot collide when a client connects twice at once
+func newSessionID() string {
+	return uuid.New().String()
+}
+
+// insert registers session once admit, called under the lock with the
+// other live sessions, lets it in
+func (r *registry) insert(session *Session, admit func(sessions map[string]*Session) error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := admit(r.byID); err != nil {
+		return err
+	}
+
+	r.byID[session.ID] = session
+	r.byClient[session.ClientID] = append(r.byClient[session.ClientID], session)
+	r.byIP[session.TunnelIP] = session
+	r.rebuildRoutes()
+	return nil
+}
+
+func (r *registry) remove(session *Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.byID[session.ID] != session {
+		return
+	}
+	delete(r.byID, session.ID)
+
+	sessions := r.byClient[session.ClientID]
+	for i, other := range sessions {
+		if other == session {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(r.byClient, session.ClientID)
+	} else {
+		r.byClient[session.ClientID] = sessions
+	}
+
+	if r.byIP[session.TunnelIP] == session {
+		delete(r.byIP, session.TunnelIP)
+		// The address goes back to an older session of the client, if any
+		for _, other := range sessions {
+			if other.TunnelIP == session.TunnelIP {
+				r.byIP[other.TunnelIP] = other
+			}
+		}
+	}
+	r.rebuildRoutes()
+}
+
+func (r *registry) get(id string) (*Session, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	session, exists := r.byID[id]
+	return session, exists
+}
+
+// client returns the live sessions of a client, oldest first
+func (r *registry) client(clientID string) []*Session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return append([]*Session(nil), r.byClient[clientID]...)
+}
+
+func (r *registry) list() []*Session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(r.byID))
+	for _, session := range r.byID {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (r *registry) count() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.byID)
+}
+
+// setSubnets routes subnets to the sessions of a client
+func (r *registry) setSubnets(clientID string, subnets []netip.Prefix) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, session := range r.byClient[clientID] {
+		session.subnets = subnets
+	}
+	r.rebuildRoutes()
+}
+
+// owns reports whether addr is the session's tunnel address or in one of
+// its subnets
+func (r *registry) owns(session *Session, addr netip.Addr) bool {
+	if addr == session.TunnelIP {
+		return true
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return session.owns(addr)
+}
+
+// reap closes sessions that stopped answering pings and sessions of clients
+// whose expiry passed while they were connected
+func (s *Server) reap() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, session := range s.sessions.list() {
+			if session.closing.Load() {
+				continue
+			}
+			if silence := time.Since(session.lastPing()); silence > s.keepAlive.Timeout {
+				// A client that lost its connection may come back
+				session.close(codes.Unavailable, "ping timeout")
+				log.Printf("💤 Closed session %s: silent for %s", session.ID, silence.Round(time.Second))
+				continue
+			}
+			if s.clientManager.Expired(session.ClientID) {
+				session.close(codes.Unauthenticated, "client expired")
+				log.Printf("⌛ Closed session %s: client expired", session.ID)
+			}
+		}
+	}
+}
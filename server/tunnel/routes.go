@@ -0,0 +1,277 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"yuki-server/proto"
+)
+
+// subnetRoute sends packets for a client's subnet to one of its sessions
+type subnetRoute struct {
+	prefix  netip.Prefix
+	session *Session
+}
+
+// routingTable is an immutable snapshot of where packets go, replaced as a
+// whole whenever sessions or subnets change so packets are routed without
+// taking the registry's lock
+type routingTable struct {
+	byIP    map[netip.Addr]*Session
+	subnets []subnetRoute
+}
+
+// SetTunDevice names the TUN interface routes to client subnets are
+// installed on. Without it no kernel routes are touched.
+func (s *Server) SetTunDevice(name string) {
+	s.tunDevice = name
+}
+
+// SyncRoutes installs a kernel route for every client subnet and removes
+// the routes of subnets that are gone. The ACL learns the subnets too, so
+// its subnets keyword lets other clients reach them.
+func (s *Server) SyncRoutes() {
+	wanted := s.clientManager.RoutedSubnets()
+	s.acl.SetSubnets(slices.Collect(maps.Keys(wanted)))
+
+	if s.tunDevice == "" {
+		return
+	}
+
+	s.routesMutex.Lock()
+	defer s.routesMutex.Unlock()
+
+	for prefix := range s.installedRoutes {
+		if _, exists := wanted[prefix]; exists {
+			continue
+		}
+		if err := deleteRoute(s.tunDevice, prefix); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+		delete(s.installedRoutes, prefix)
+	}
+	for prefix := range wanted {
+		if s.installedRoutes[prefix] {
+			continue
+		}
+		if err := addRoute(s.tunDevice, prefix); err != nil {
+			log.Printf("⚠️ %v", err)
+			continue
+		}
+		s.installedRoutes[prefix] = true
+		log.Printf("🛣️ Routing %s to the tunnel", prefix)
+	}
+}
+
+// HostNetworks lists the networks of the server's interfaces and the
+// destinations of its kernel routes, leaving out the default route and the
+// routes on the TUN device, which lead to clients
+func HostNetworks(tunDevice string) []netip.Prefix {
+	var networks []netip.Prefix
+
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		if iface.Name == tunDevice {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+			bits, _ := ipNet.Mask.Size()
+			networks = append(networks, netip.PrefixFrom(ip.Unmap(), bits).Masked())
+		}
+	}
+
+	return append(networks, kernelRoutes(tunDevice)...)
+}
+
+// kernelRoutes reads the IPv4 routing table, skipping the default route and
+// the routes on the given device
+func kernelRoutes(skipDevice string) []netip.Prefix {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var routes []netip.Prefix
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] == skipDevice {
+			continue
+		}
+		destination, errDestination := strconv.ParseUint(fields[1], 16, 32)
+		mask, errMask := strconv.ParseUint(fields[7], 16, 32)
+		if errDestination != nil || errMask != nil || mask == 0 {
+			continue
+		}
+		// The kernel prints both in host byte order
+		var addr, netmask [4]byte
+		binary.NativeEndian.PutUint32(addr[:], uint32(destination))
+		binary.NativeEndian.PutUint32(netmask[:], uint32(mask))
+		bits, _ := net.IPMask(netmask[:]).Size()
+		routes = append(routes, netip.PrefixFrom(netip.AddrFrom4(addr), bits).Masked())
+	}
+	return routes
+}
+
+// SubnetsChanged applies a client's new subnets: kernel routes, routing to
+// its live sessions, and pushing the routes to the sessions of every other
+// client. Who may use them is up to the ACL. Clients cannot be told to drop
+// a route, so removed subnets stay routed on their side until they
+// reconnect.
+func (s *Server) SubnetsChanged(clientID string) {
+	s.SyncRoutes()
+
+	var subnets []netip.Prefix
+	var routes []string
+	if c, exists := s.clientManager.GetClient(clientID); exists {
+		subnets = parseSubnets(c.Subnets)
+		routes = c.Subnets
+	}
+
+	s.sessions.setSubnets(clientID, subnets)
+	if len(routes) == 0 {
+		return
+	}
+
+	var peers []*Session
+	for _, session := range s.sessions.list() {
+		if session.ClientID != clientID {
+			peers = append(peers, session)
+		}
+	}
+	if len(peers) > 0 {
+		sendAll(peers, &proto.ControlMessage{
+			Message: &proto.ControlMessage_ConfigUpdate{
+				ConfigUpdate: &proto.ConfigUpdate{Routes: routes},
+			},
+		})
+	}
+}
+
+// rebuildRoutes recomputes the routing table, subnets longest prefix first;
+// must be called with the mutex held. The newest session of a client gets
+// its subnets, like its tunnel address.
+func (r *registry) rebuildRoutes() {
+	sessions := make([]*Session, 0, len(r.byID))
+	for _, session := range r.byID {
+		if len(session.subnets) > 0 {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.After(sessions[j].Started) })
+
+	seen := make(map[netip.Prefix]bool)
+	routes := make([]subnetRoute, 0)
+	for _, session := range sessions {
+		for _, prefix := range session.subnets {
+			if seen[prefix] {
+				continue
+			}
+			seen[prefix] = true
+			routes = append(routes, subnetRoute{prefix: prefix, session: session})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].prefix.Bits() > routes[j].prefix.Bits() })
+
+	r.routing.Store(&routingTable{byIP: maps.Clone(r.byIP), subnets: routes})
+}
+
+// route returns the session packets for dst go to
+func (r *registry) route(dst netip.Addr) *Session {
+	table := r.routing.Load()
+	if table == nil {
+		return nil
+	}
+	if session := table.byIP[dst]; session != nil {
+		return session
+	}
+	for _, route := range table.subnets {
+		if route.prefix.Contains(dst) {
+			return route.session
+		}
+	}
+	return nil
+}
+
+// peerRoutes lists the subnets of the other clients
+func (s *Server) peerRoutes(clientID string) []string {
+	var routes []string
+	for prefix, owner := range s.clientManager.RoutedSubnets() {
+		if owner != clientID {
+			routes = append(routes, prefix.String())
+		}
+	}
+	sort.Strings(routes)
+	return routes
+}
+
+// subnetReply reports whether a packet from session comes from the network
+// behind its client and goes to another client that may reach that network,
+// so it passes as a reply. The ACL keeps clients away from each other, which
+// would otherwise drop every answer from the network.
+func (s *Server) subnetReply(session *Session, packet []byte) bool {
+	// The routing table is checked first: it takes no lock, and most
+	// packets are bound for the internet
+	dst, ok := packetDestination(packet)
+	if !ok {
+		return false
+	}
+	peer := s.sessions.route(dst)
+	if peer == nil || peer.TunnelIP != dst || peer.ClientID == session.ClientID {
+		return false
+	}
+	src, ok := packetSource(packet)
+	if !ok || src == session.TunnelIP || !s.sessions.owns(session, src) {
+		return false
+	}
+
+	return s.acl.AllowReply(peer.ClientID, peer.Tags(), packet)
+}
+
+// owns reports whether addr is the session's tunnel address or inside one
+// of its subnets; must be called with the registry's mutex held
+func (session *Session) owns(addr netip.Addr) bool {
+	if addr == session.TunnelIP {
+		return true
+	}
+	for _, prefix := range session.subnets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSubnets(subnets []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(subnets))
+	for _, subnet := range subnets {
+		if prefix, err := netip.ParsePrefix(subnet); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"yuki-server/acl"
+	"yuki-server/client"
+	"yuki-server/crypto"
+	"yuki-server/proto"
+)
+
+const benchmarkPacketSize = 1400
+
+// discardStream is a Connect stream that drops what the server sends, so
+// benchmarks measure the server and not gRPC
+type discardStream struct {
+	proto.TunnelService_ConnectServer
+}
+
+func (discardStream) Send(*proto.TunnelFrame) error { return nil }
+
+// discardTun is a TUN queue that drops what the server writes
+type discardTun struct {
+	net.Conn
+}
+
+func (discardTun) Write(data []byte) (int, error) { return len(data), nil }
+
+// benchmarkSession sets up a server with the default ACL and a session of a
+// client at 10.0.0.2, and returns the cipher of the client's side
+func benchmarkSession(b *testing.B) (*Server, *Session, *crypto.Cipher) {
+	clientManager := client.NewManager()
+	if err := clientManager.SetTunnelNetwork("10.0.0.1/24"); err != nil {
+		b.Fatal(err)
+	}
+	engine, err := acl.New("", acl.Config{Network: clientManager.TunnelNetwork()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := NewServer(clientManager)
+	server.SetACL(engine)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	serverCipher, err := crypto.NewServerCipher(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	clientCipher, err := crypto.NewClientCipher(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	session := &Session{
+		ID:       "session",
+		ClientID: "client",
+		TunnelIP: netip.MustParseAddr("10.0.0.2"),
+		Cipher:   serverCipher,
+		TunConn:  discardTun{},
+		queue:    newSendQueue(server.queueSettings),
+		ready:    make(chan struct{}, 1),
+		batch:    make([]*packetBuffer, 0, schedulerBatch),
+		gateway:  clientManager.TunnelNetwork().Addr(),
+	}
+	return server, session, clientCipher
+}
+
+// udpPacket builds an IPv4 UDP packet of size bytes from src to dst:53
+func udpPacket(src, dst string, size int) []byte {
+	packet := make([]byte, size)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(size))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], netip.MustParseAddr(src).AsSlice())
+	copy(packet[16:20], netip.MustParseAddr(dst).AsSlice())
+	binary.BigEndian.PutUint16(packet[20:], 40000)
+	binary.BigEndian.PutUint16(packet[22:], 53)
+	binary.BigEndian.PutUint16(packet[24:], uint16(size-20))
+	return packet
+}
+
+// BenchmarkSendBatch sends full batches of packets from the TUN to a client
+func BenchmarkSendBatch(b *testing.B) {
+	server, session, _ := benchmarkSession(b)
+	stream := discardStream{}
+	packet := udpPacket("1.1.1.1", "10.0.0.2", benchmarkPacketSize)
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkPacketSize * schedulerBatch)
+	for i := 0; i < b.N; i++ {
+		session.batch = session.batch[:0]
+		for range schedulerBatch {
+			session.batch = append(session.batch, newPacket(packet))
+		}
+		if err := server.sendBatch(stream, session); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReceiveFrame runs data frames from a client through decryption
+// and the ACL into the TUN. Each frame is sealed by the client's cipher
+// inside the loop, since frames cannot be replayed.
+func BenchmarkReceiveFrame(b *testing.B) {
+	server, session, clientCipher := benchmarkSession(b)
+	stream := discardStream{}
+	packet := udpPacket("10.0.0.2", "1.1.1.1", benchmarkPacketSize)
+	frame := crypto.Frame{Length: uint32(len(packet)), Data: packet}
+	message := &proto.TunnelFrame{SessionId: session.ID}
+	var buffer []byte
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkPacketSize)
+	for i := 0; i < b.N; i++ {
+		var err error
+		buffer, err = clientCipher.AppendFrame(buffer[:0], &frame)
+		if err != nil {
+			b.Fatal(err)
+		}
+		message.Data = buffer
+		if err := server.receiveFrame(stream, session, message); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if session.packetsDown.Load() != int64(b.N) {
+		b.Fatalf("%d of %d packets reached the TUN", session.packetsDown.Load(), b.N)
+	}
+}
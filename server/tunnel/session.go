@@ -0,0 +1,493 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"yuki-server/compress"
+	"yuki-server/crypto"
+	"yuki-server/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// disconnectTimeout bounds how long a closing session waits for its
+// Disconnect frame to go out before the stream is torn down
+const disconnectTimeout = time.Second
+
+// SessionLimitPolicy decides what happens when a client that is at its
+// concurrent session limit connects again
+type SessionLimitPolicy string
+
+const (
+	// RejectNewSession refuses the new connection
+	RejectNewSession SessionLimitPolicy = "reject"
+	// EvictOldestSession closes the client's oldest session to make room
+	EvictOldestSession SessionLimitPolicy = "evict_oldest"
+)
+
+var (
+	errSessionEnded = errors.New("session ended")
+	errSessionLimit = status.Error(codes.ResourceExhausted, "session limit reached")
+	errServerFull   = status.Error(codes.ResourceExhausted, "server is full")
+	errNoAddress    = status.Error(codes.ResourceExhausted, "no tunnel address available")
+)
+
+type Session struct {
+	ID         string
+	ClientID   string
+	RemoteAddr string
+	// TunnelIP is the client's address for its first session; the others
+	// get one leased from the pool, which goes back when they end
+	TunnelIP netip.Addr
+	leased   atomic.Bool
+	Started  time.Time
+	Cipher   *crypto.Cipher
+	TunConn  net.Conn
+	// Version and Features were negotiated in the handshake
+	Version  uint32
+	Features uint64
+	Software string
+
+	// mutex guards LastPing, RTT and Jitter, which the admin API reads
+	// while the tunnel goroutines update them
+	mutex    sync.Mutex
+	LastPing time.Time
+	RTT      time.Duration
+	Jitter   time.Duration
+	rtt      rttEstimator
+
+	// The traffic counters are updated for every packet, so they are atomic
+	// rather than behind the mutex. dropped counts packets from the client
+	// the ACL refused; unreported is traffic not yet added to the client's
+	// totals in the manager.
+	bytesUp     atomic.Int64
+	bytesDown   atomic.Int64
+	packetsUp   atomic.Int64
+	packetsDown atomic.Int64
+	dropped     atomic.Int64
+	unreported  atomic.Int64
+
+	// subnets are the client networks routed to this session; they are
+	// guarded by the registry's mutex
+	subnets []netip.Prefix
+
+	// flows are the connections the client handed over in flow mode
+	flowsMutex  sync.Mutex
+	flows       map[uint32]*flow
+	flowsOpened int64
+
+	// codec compresses frames when the session negotiated
+	// FEATURE_COMPRESSION; nil otherwise
+	codec *compress.Codec
+
+	stream      proto.TunnelService_ConnectServer
+	cancel      context.CancelCauseFunc
+	closing     atomic.Bool
+	quotaWarned atomic.Bool
+	// maxBandwidth is the client's traffic limit, published here so the
+	// packet path never reads the client record; 0 is unlimited
+	maxBandwidth atomic.Int64
+	// tags are the client's tags, published the same way for the ACL and
+	// LAN checks
+	tags atomic.Pointer[[]string]
+	// queue holds the packets waiting for the client. While scheduled is
+	// set the session is in the scheduler's round or sending the batch
+	// it was handed through ready; deficit belongs to the scheduler.
+	queue     *sendQueue
+	scheduled atomic.Bool
+	ready     chan struct{}
+	batch     []*packetBuffer
+	deficit   int
+	// gateway is the server's tunnel address
+	gateway netip.Addr
+
+	// sendMutex serializes sends; ended is set under it once Connect has
+	// returned and the stream must no longer be used. sendBuffer and
+	// sendMessage are reused for every frame under it.
+	sendMutex   sync.Mutex
+	ended       bool
+	sendBuffer  []byte
+	sendMessage proto.TunnelFrame
+}
+
+// SessionInfo is a point-in-time view of a live session
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	ClientID   string    `json:"client_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	TunnelIP   string    `json:"tunnel_ip"`
+	Started    time.Time `json:"started"`
+	LastPing   time.Time `json:"last_ping"`
+	RTTMillis  float64   `json:"rtt_ms"`
+	// JitterMillis is how much the round trips of pings vary
+	JitterMillis float64 `json:"jitter_ms"`
+	BytesUp      int64   `json:"bytes_up"`
+	BytesDown    int64   `json:"bytes_down"`
+	PacketsUp    int64   `json:"packets_up"`
+	PacketsDown  int64   `json:"packets_down"`
+	Dropped      int64   `json:"packets_dropped"`
+	// QueueDepth is how many packets wait for the client; QueueDropped
+	// counts the ones dropped because it did not keep up
+	QueueDepth   int64    `json:"queue_depth"`
+	QueueDropped int64    `json:"queue_dropped"`
+	Version      uint32   `json:"protocol_version"`
+	Features     []string `json:"features"`
+	Software     string   `json:"software,omitempty"`
+	// FlowsOpened counts the flows of the session so far; Flows are the
+	// ones still open
+	FlowsOpened int64      `json:"flows_opened"`
+	Flows       []FlowInfo `json:"flows,omitempty"`
+	// Compression is set for sessions that compress their frames
+	Compression *compress.Stats `json:"compression,omitempty"`
+}
+
+func (session *Session) Info() SessionInfo {
+	flows := session.Flows()
+	session.flowsMutex.Lock()
+	flowsOpened := session.flowsOpened
+	session.flowsMutex.Unlock()
+
+	var compression *compress.Stats
+	if session.codec != nil {
+		stats := session.codec.Stats()
+		compression = &stats
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return SessionInfo{
+		ID:           session.ID,
+		ClientID:     session.ClientID,
+		RemoteAddr:   session.RemoteAddr,
+		TunnelIP:     session.TunnelIP.String(),
+		Started:      session.Started,
+		LastPing:     session.LastPing,
+		RTTMillis:    float64(session.RTT) / float64(time.Millisecond),
+		JitterMillis: float64(session.Jitter) / float64(time.Millisecond),
+		BytesUp:      session.bytesUp.Load(),
+		BytesDown:    session.bytesDown.Load(),
+		PacketsUp:    session.packetsUp.Load(),
+		PacketsDown:  session.packetsDown.Load(),
+		Dropped:      session.dropped.Load(),
+		QueueDepth:   session.queue.depth.Load(),
+		QueueDropped: session.queue.dropped.Load(),
+		Version:      session.Version,
+		Features:     featureNames(session.Features),
+		Software:     session.Software,
+		FlowsOpened:  flowsOpened,
+		Flows:        flows,
+		Compression:  compression,
+	}
+}
+
+func (session *Session) touch() {
+	session.mutex.Lock()
+	session.LastPing = time.Now()
+	session.mutex.Unlock()
+}
+
+func (session *Session) lastPing() time.Time {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.LastPing
+}
+
+// countUp records a packet sent to the client and returns the session total
+func (session *Session) countUp(n int) int64 {
+	session.packetsUp.Add(1)
+	session.unreported.Add(int64(n))
+	return session.bytesUp.Add(int64(n))
+}
+
+// countDown records a packet received from the client
+func (session *Session) countDown(n int) {
+	session.bytesDown.Add(int64(n))
+	session.packetsDown.Add(1)
+}
+
+// countDropped records a packet from the client the ACL refused
+func (session *Session) countDropped() {
+	session.dropped.Add(1)
+}
+
+// reportTraffic adds the traffic since the last report to the client's
+// totals. Sessions report once a second and when they end rather than per
+// packet, so sessions do not contend on the manager's lock.
+func (s *Server) reportTraffic(session *Session) {
+	if bytesUp := session.unreported.Swap(0); bytesUp > 0 {
+		s.clientManager.UpdateTraffic(session.ClientID, bytesUp, 0)
+	}
+}
+
+// sendFrame encrypts and sends a frame. The cipher's nonce sequence and the
+// gRPC stream both require a single writer, so all sends go through here.
+func (session *Session) sendFrame(stream proto.TunnelService_ConnectServer, frame *crypto.Frame, sessionID string) error {
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+
+	if session.ended {
+		return errSessionEnded
+	}
+
+	// Compress before the frame is encrypted and before any padding is
+	// added, which would otherwise be compressed away or leak the ratio
+	if session.codec != nil {
+		compressed := *frame
+		compressed.Type, compressed.Data = session.codec.Compress(frame.Type, frame.Data)
+		compressed.Length = uint32(len(compressed.Data))
+		frame = &compressed
+	}
+
+	frameData, err := session.Cipher.AppendFrame(session.sendBuffer[:0], frame)
+	if err != nil {
+		return err
+	}
+	session.sendBuffer = frameData
+
+	// Send has marshalled the message by the time it returns, and the
+	// server installs no stats handlers that could hold on to it, so the
+	// message and its buffer can be reused for the next frame
+	session.sendMessage.Data = frameData
+	session.sendMessage.Timestamp = time.Now().Unix()
+	session.sendMessage.SessionId = sessionID
+	return stream.Send(&session.sendMessage)
+}
+
+// end marks the stream as finished once Connect returns
+func (session *Session) end() {
+	session.sendMutex.Lock()
+	session.ended = true
+	session.sendMutex.Unlock()
+}
+
+// close terminates the session. The client gets a Disconnect frame with
+// reason first, then reason as the stream's status; only Unavailable tells
+// it to come back.
+func (session *Session) close(code codes.Code, reason string) {
+	if session.closing.Swap(true) {
+		return
+	}
+
+	go func() {
+		sent := make(chan struct{})
+		go func() {
+			session.disconnect(reason, code == codes.Unavailable)
+			close(sent)
+		}()
+
+		// A client that stopped reading must not keep the session open
+		select {
+		case <-sent:
+		case <-time.After(disconnectTimeout):
+		}
+		session.cancel(status.Error(code, reason))
+	}()
+}
+
+// addSession registers a session, enforcing the client's concurrent session
+// limit (0 for none) and the server-wide cap under the same lock so parallel
+// connects cannot overshoot. The session with ID replaces, if any, is closed
+// and handed over to the new one.
+func (s *Server) addSession(session *Session, limit int, replaces string) error {
+	s.reaper.Do(func() { go s.reap() })
+
+	s.maintenanceMutex.Lock()
+	maxSessions := s.maxSessions
+	s.maintenanceMutex.Unlock()
+
+	return s.sessions.insert(session, func(sessions map[string]*Session) error {
+		// Sessions already being closed no longer count
+		total := 0
+		var live []*Session
+		var resumed *Session
+		for _, other := range sessions {
+			if other.closing.Load() {
+				continue
+			}
+			if other.ID == replaces && other.ClientID == session.ClientID {
+				resumed = other
+				continue
+			}
+			total++
+			if other.ClientID == session.ClientID {
+				live = append(live, other)
+			}
+		}
+
+		if limit > 0 {
+			if len(live) >= limit {
+				if s.sessionPolicy != EvictOldestSession {
+					return errSessionLimit
+				}
+
+				sort.Slice(live, func(i, j int) bool { return live[i].Started.Before(live[j].Started) })
+				for _, old := range live[:len(live)-limit+1] {
+					old.close(codes.Unauthenticated, "replaced by a newer session")
+					log.Printf("🔌 Evicted session %s: session limit of %d reached", old.ID, limit)
+					total--
+				}
+			}
+		}
+
+		if maxSessions > 0 && total >= maxSessions {
+			return errServerFull
+		}
+
+		// Each live session has an address of its own, or the newest
+		// would get all of the client's traffic. A resumed session keeps
+		// the address of the one it takes over.
+		if resumed != nil {
+			resumed.close(codes.Unauthenticated, "session resumed on another connection")
+			log.Printf("🔁 Session %s resumed by a new connection", resumed.ID)
+			session.TunnelIP = resumed.TunnelIP
+			session.leased.Store(resumed.leased.Swap(false))
+			return nil
+		}
+		for _, other := range live {
+			if other.TunnelIP == session.TunnelIP && !other.closing.Load() {
+				addr, ok := s.clientManager.LeaseAddress()
+				if !ok {
+					return errNoAddress
+				}
+				session.TunnelIP = addr
+				session.leased.Store(true)
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Server) removeSession(session *Session) {
+	s.sessions.remove(session)
+	if session.leased.Swap(false) {
+		s.clientManager.ReleaseAddress(session.TunnelIP)
+	}
+}
+
+// Sessions lists the live sessions, oldest first
+func (s *Server) Sessions() []SessionInfo {
+	live := s.sessions.list()
+	sessions := make([]SessionInfo, 0, len(live))
+	for _, session := range live {
+		sessions = append(sessions, session.Info())
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions
+}
+
+func (s *Server) GetSession(id string) (SessionInfo, bool) {
+	session, exists := s.sessions.get(id)
+	if !exists {
+		return SessionInfo{}, false
+	}
+	return session.Info(), true
+}
+
+// CloseSession terminates one session. The client receives reason as an
+// Unauthenticated status so it does not retry blindly.
+func (s *Server) CloseSession(id string, reason string) bool {
+	session, exists := s.sessions.get(id)
+	if !exists {
+		return false
+	}
+
+	session.close(codes.Unauthenticated, reason)
+	log.Printf("🔌 Closed session %s: %s", id, reason)
+	return true
+}
+
+// ClientChanged applies a client's edited limits to its live sessions
+func (s *Server) ClientChanged(clientID string) {
+	c, exists := s.clientManager.GetClient(clientID)
+	if !exists {
+		return
+	}
+	for _, session := range s.sessions.client(clientID) {
+		session.maxBandwidth.Store(c.MaxBandwidth)
+		session.setTags(c.Tags)
+	}
+}
+
+// Tags returns the client's tags as of its last change
+func (session *Session) Tags() []string {
+	if tags := session.tags.Load(); tags != nil {
+		return *tags
+	}
+	return nil
+}
+
+func (session *Session) setTags(tags []string) {
+	tags = append([]string(nil), tags...)
+	session.tags.Store(&tags)
+}
+
+// CloseClientSessions terminates every live session of a client
+func (s *Server) CloseClientSessions(clientID string, reason string) int {
+	closed := 0
+	for _, session := range s.sessions.client(clientID) {
+		session.close(codes.Unauthenticated, reason)
+		closed++
+	}
+	if closed > 0 {
+		log.Printf("🔌 Closed %d session(s) of %s: %s", closed, clientID, reason)
+	}
+	return closed
+}
+
+// dispatch reads a queue of the shared TUN and hands each packet to the
+// session that owns its destination address or subnet
+func (s *Server) dispatch(queue net.Conn) {
+	buffer := make([]byte, 65535)
+	for {
+		n, err := queue.Read(buffer)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("❌ TUN read error: %v", err)
+			}
+			return
+		}
+
+		dst, ok := packetDestination(buffer[:n])
+		if !ok {
+			continue
+		}
+
+		session := s.sessions.route(dst)
+		if session == nil {
+			continue
+		}
+
+		// A session that is not keeping up drops from its own queue rather
+		// than stall the TUN
+		s.scheduler.enqueue(session, newPacket(buffer[:n]))
+	}
+}
+
+// packetDestination returns the destination address of an IPv4 packet
+func packetDestination(packet []byte) (netip.Addr, bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFrom4([4]byte(packet[16:20])), true
+}
+
+// packetSource returns the source address of an IPv4 packet
+func packetSource(packet []byte) (netip.Addr, bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFrom4([4]byte(packet[12:16])), true
+}
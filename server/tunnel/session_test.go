@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"yuki-server/client"
+)
+
+// TestSessionsGetOwnAddresses connects one client three times: every session
+// needs an address of its own for its downstream traffic to reach it
+func TestSessionsGetOwnAddresses(t *testing.T) {
+	clientManager := client.NewManager()
+	if err := clientManager.SetTunnelNetwork("10.0.0.1/29"); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := clientManager.CreateClient("laptop", 0, nil, 0, "")
+	other, _ := clientManager.CreateClient("phone", 0, nil, 0, "")
+	server := NewServer(clientManager)
+	own := netip.MustParseAddr(c.TunnelIP)
+
+	connect := func(id string) (*Session, error) {
+		session := &Session{ID: id, ClientID: c.ID, TunnelIP: own, Started: time.Now()}
+		return session, server.addSession(session, 0, "")
+	}
+
+	first, err := connect("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := connect("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.TunnelIP != own {
+		t.Fatalf("first session at %s, want the client's %s", first.TunnelIP, own)
+	}
+	if second.TunnelIP == own || second.TunnelIP.String() == other.TunnelIP {
+		t.Fatalf("second session at %s, which is taken", second.TunnelIP)
+	}
+	for _, session := range []*Session{first, second} {
+		if peer := server.sessions.route(session.TunnelIP); peer != session {
+			t.Errorf("traffic to %s does not reach its session", session.TunnelIP)
+		}
+		if found, ok := server.ClientByAddress(session.TunnelIP); !ok || found.ID != c.ID {
+			t.Errorf("%s does not belong to the client", session.TunnelIP)
+		}
+	}
+
+	// A lent address is not given to new clients while it is in use
+	third, _ := clientManager.CreateClient("tablet", 0, nil, 0, "")
+	if third.TunnelIP == second.TunnelIP.String() {
+		t.Fatalf("new client got %s, lent to a session", third.TunnelIP)
+	}
+
+	// With the client's own address free again, the next session takes it
+	// and the lent address goes back to the pool
+	lent := second.TunnelIP
+	server.removeSession(first)
+	server.removeSession(second)
+	if again, err := connect("again"); err != nil || again.TunnelIP != own {
+		t.Fatalf("session at %s (%v), want %s", again.TunnelIP, err, own)
+	}
+	if fourth, _ := clientManager.CreateClient("watch", 0, nil, 0, ""); fourth.TunnelIP != lent.String() {
+		t.Fatalf("new client got %s, want the returned %s", fourth.TunnelIP, lent)
+	}
+
+	// The /29 has no address left to lend
+	clientManager.CreateClient("tv", 0, nil, 0, "")
+	if _, err := connect("extra"); err != errNoAddress {
+		t.Fatalf("got %v with the network full, want %v", err, errNoAddress)
+	}
+}
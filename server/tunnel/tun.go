@@ -5,11 +5,10 @@ package tunnel
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
-	"syscall"
 	"time"
-	"unsafe"
 )
 
 const (
@@ -26,31 +25,9 @@ type ifReq struct {
 
 // CreateTunInterface creates a TUN interface on Linux
 func CreateTunInterface(name string, ip string, mtu int) (*os.File, error) {
-	// Open TUN device
-	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	file, actualName, err := openTunQueue(name, IFF_TUN|IFF_NO_PI)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open /dev/net/tun: %v", err)
-	}
-
-	// Prepare interface request
-	var ifr ifReq
-	copy(ifr.Name[:], name)
-	ifr.Flags = IFF_TUN | IFF_NO_PI
-
-	// Create TUN interface
-	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr)))
-	if errno != 0 {
-		file.Close()
-		return nil, fmt.Errorf("failed to create TUN interface: %v", errno)
-	}
-
-	// Get actual interface name
-	actualName := string(ifr.Name[:])
-	for i, b := range ifr.Name {
-		if b == 0 {
-			actualName = string(ifr.Name[:i])
-			break
-		}
+		return nil, err
 	}
 
 	// Configure interface
@@ -120,3 +97,21 @@ func (t *TunConn) SetReadDeadline(deadline time.Time) error {
 func (t *TunConn) SetWriteDeadline(deadline time.Time) error {
 	return nil
 }
+
+// addRoute routes a network to the TUN interface
+func addRoute(name string, prefix netip.Prefix) error {
+	cmd := exec.Command("ip", "route", "replace", prefix.String(), "dev", name)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add route %s: %v, output: %s", prefix, err, output)
+	}
+	return nil
+}
+
+// deleteRoute removes a route added by addRoute
+func deleteRoute(name string, prefix netip.Prefix) error {
+	cmd := exec.Command("ip", "route", "del", prefix.String(), "dev", name)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete route %s: %v, output: %s", prefix, err, output)
+	}
+	return nil
+}
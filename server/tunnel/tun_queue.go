@@ -0,0 +1,374 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	IFF_MULTI_QUEUE = 0x0100
+	IFF_VNET_HDR    = 0x4000
+
+	TUNSETOFFLOAD = 0x400454d0
+	TUN_F_CSUM    = 0x01
+	TUN_F_TSO4    = 0x02
+	TUN_F_TSO6    = 0x04
+)
+
+// maxTunQueues is the kernel's limit on the queues of one device
+const maxTunQueues = 256
+
+// tunWriteBatch bounds how many packets a queue's writer joins at once
+const tunWriteBatch = 64
+
+// TunOptions select how the TUN device is opened
+type TunOptions struct {
+	// Queues is how many queues to open; each is read on its own
+	// goroutine. More than one needs IFF_MULTI_QUEUE.
+	Queues int
+	// Offload enables IFF_VNET_HDR with checksum and TCP segmentation
+	// offload, so large TCP segments cross the TUN in one syscall
+	Offload bool
+}
+
+// TunQueue is one queue of a TUN device. Read returns one packet at a time
+// and must not be called concurrently; Write may be, and returns once the
+// kernel has the packet.
+type TunQueue struct {
+	file      *os.File
+	localAddr net.Addr
+	offload   bool
+
+	// readBuffer and segments hold a segmentation offload packet that is
+	// being split across reads
+	readBuffer []byte
+	segments   segmenter
+
+	// writes feeds the writer, which joins the TCP segments sessions
+	// write through SessionConn before they go to the kernel
+	writes    chan tunWrite
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// CreateTunQueues creates a TUN interface with the queues and offloads in
+// options. What the kernel does not support is left out, down to a single
+// queue of plain packets.
+func CreateTunQueues(name string, ip string, mtu int, options TunOptions) ([]*TunQueue, error) {
+	queues := min(max(options.Queues, 1), maxTunQueues)
+
+	flags := uint16(IFF_TUN | IFF_NO_PI)
+	if queues > 1 {
+		flags |= IFF_MULTI_QUEUE
+	}
+	if options.Offload {
+		flags |= IFF_VNET_HDR
+	}
+
+	file, actualName, err := openTunQueue(name, flags)
+	if err != nil && flags&IFF_MULTI_QUEUE != 0 {
+		log.Printf("⚠️ Multi-queue TUN unavailable, using a single queue: %v", err)
+		flags &^= IFF_MULTI_QUEUE
+		queues = 1
+		file, actualName, err = openTunQueue(name, flags)
+	}
+	if err != nil && flags&IFF_VNET_HDR != 0 {
+		log.Printf("⚠️ TUN offloads unavailable: %v", err)
+		flags &^= IFF_VNET_HDR
+		file, actualName, err = openTunQueue(name, flags)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&IFF_VNET_HDR != 0 {
+		if err := setTunOffload(file); err != nil {
+			// The device goes away with its last queue and is created again
+			// without the header
+			log.Printf("⚠️ TUN offloads unavailable: %v", err)
+			file.Close()
+			flags &^= IFF_VNET_HDR
+			file, actualName, err = openTunQueue(name, flags)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	files := []*os.File{file}
+	for len(files) < queues {
+		file, _, err := openTunQueue(actualName, flags)
+		if err != nil {
+			log.Printf("⚠️ Opened %d of %d TUN queues: %v", len(files), queues, err)
+			break
+		}
+		files = append(files, file)
+	}
+
+	if err := configureInterface(actualName, ip, mtu); err != nil {
+		for _, file := range files {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	localAddr := &net.IPAddr{}
+	if address, _, err := net.ParseCIDR(ip); err == nil {
+		localAddr.IP = address
+	}
+	result := make([]*TunQueue, len(files))
+	for i, file := range files {
+		result[i] = newTunQueue(file, localAddr, flags&IFF_VNET_HDR != 0)
+	}
+	return result, nil
+}
+
+// openTunQueue attaches a queue to the TUN interface name, creating it if
+// needed, and returns the interface's actual name
+func openTunQueue(name string, flags uint16) (*os.File, string, error) {
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open /dev/net/tun: %v", err)
+	}
+
+	var ifr ifReq
+	copy(ifr.Name[:], name)
+	ifr.Flags = flags
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		file.Close()
+		return nil, "", fmt.Errorf("failed to create TUN interface: %v", errno)
+	}
+
+	actualName := string(ifr.Name[:])
+	for i, b := range ifr.Name {
+		if b == 0 {
+			actualName = string(ifr.Name[:i])
+			break
+		}
+	}
+	return file, actualName, nil
+}
+
+// setTunOffload lets the kernel hand over packets with their checksums and
+// TCP segmentation left to us
+func setTunOffload(file *os.File) error {
+	offloads := TUN_F_CSUM | TUN_F_TSO4 | TUN_F_TSO6
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), uintptr(TUNSETOFFLOAD), uintptr(offloads))
+	if errno != 0 {
+		return fmt.Errorf("failed to enable offloads: %v", errno)
+	}
+	return nil
+}
+
+func newTunQueue(file *os.File, localAddr net.Addr, offload bool) *TunQueue {
+	q := &TunQueue{
+		file:      file,
+		localAddr: localAddr,
+		offload:   offload,
+		closed:    make(chan struct{}),
+	}
+	if offload {
+		q.readBuffer = make([]byte, virtioNetHdrLen+maxCoalesced)
+		q.writes = make(chan tunWrite, tunWriteBatch)
+		go q.writeLoop()
+	}
+	return q
+}
+
+func (q *TunQueue) Read(b []byte) (int, error) {
+	if !q.offload {
+		return q.file.Read(b)
+	}
+
+	for {
+		if n := q.segments.next(b); n > 0 {
+			return n, nil
+		}
+
+		n, err := q.file.Read(q.readBuffer)
+		if err != nil {
+			return 0, err
+		}
+		if n < virtioNetHdrLen {
+			continue
+		}
+		var header virtioNetHdr
+		header.decode(q.readBuffer)
+		packet := q.readBuffer[virtioNetHdrLen:n]
+
+		if header.gsoType == vnetGSONone {
+			if header.flags&vnetFlagNeedsCsum != 0 {
+				completeChecksum(packet, int(header.csumStart), int(header.csumOffset))
+			}
+			return copy(b, packet), nil
+		}
+		// Packets that cannot be split are dropped, as a NIC would
+		q.segments.reset(packet, header)
+	}
+}
+
+// noOffloads is the virtio header of a packet without pending offloads
+var noOffloads [virtioNetHdrLen]byte
+
+func (q *TunQueue) Write(b []byte) (int, error) {
+	if !q.offload {
+		return q.file.Write(b)
+	}
+
+	packet := packetPool.Get().(*packetBuffer)
+	defer packet.release()
+	packet.data = append(append(packet.data[:0], noOffloads[:]...), b...)
+	if _, err := q.file.Write(packet.data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SessionConn returns the connection a session writes its packets to. On
+// an offload queue the packets go through the queue's writer, which joins
+// the TCP segments waiting for it at the same time. Write returns once the
+// kernel has the packet, with the error of the kernel write that carried
+// it, as on a plain queue.
+func (q *TunQueue) SessionConn() net.Conn {
+	if !q.offload {
+		return q
+	}
+	return tunWriter{TunQueue: q}
+}
+
+// tunWriter is a session's connection to an offload queue
+type tunWriter struct {
+	*TunQueue
+}
+
+// tunWrite is a packet waiting for the writer of an offload queue, which
+// sends the result of its kernel write to done
+type tunWrite struct {
+	packet *packetBuffer
+	done   chan error
+}
+
+// tunWriteDone holds the channels writes wait on
+var tunWriteDone = sync.Pool{New: func() any { return make(chan error, 1) }}
+
+func (w tunWriter) Write(b []byte) (int, error) {
+	write := tunWrite{packet: newPacket(b), done: tunWriteDone.Get().(chan error)}
+	select {
+	case w.writes <- write:
+	case <-w.closed:
+		write.packet.release()
+		tunWriteDone.Put(write.done)
+		return 0, os.ErrClosed
+	}
+
+	select {
+	case err := <-write.done:
+		tunWriteDone.Put(write.done)
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	case <-w.closed:
+		// The writer may still answer, so the channel is not reused
+		return 0, os.ErrClosed
+	}
+}
+
+// Close leaves the queue open for the other sessions
+func (w tunWriter) Close() error {
+	return nil
+}
+
+// writeLoop writes the packets of an offload queue, joining TCP segments
+// that arrived together. Each write gets the result of the kernel write
+// that carried its packet.
+func (q *TunQueue) writeLoop() {
+	c := newCoalescer(func(b []byte) error {
+		_, err := q.file.Write(b)
+		return err
+	})
+	// joined are the writes whose packets the coalescer holds
+	var joined []chan error
+	settle := func(err error, writes ...chan error) {
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Printf("❌ TUN write error: %v", err)
+		}
+		for _, done := range writes {
+			done <- err
+		}
+	}
+
+	batch := make([]tunWrite, 0, tunWriteBatch)
+	for {
+		select {
+		case write := <-q.writes:
+			batch = append(batch[:0], write)
+		case <-q.closed:
+			return
+		}
+	take:
+		for len(batch) < tunWriteBatch {
+			select {
+			case write := <-q.writes:
+				batch = append(batch, write)
+			default:
+				break take
+			}
+		}
+
+		for _, write := range batch {
+			// Send what the packet does not join first, so an error is
+			// put down to the packets it carried
+			if c.segments > 0 && !c.joins(write.packet.data) {
+				settle(c.flush(), joined...)
+				joined = joined[:0]
+			}
+			err := c.add(write.packet.data)
+			write.packet.release()
+			if err == nil && c.segments > 0 {
+				joined = append(joined, write.done)
+			} else {
+				settle(err, write.done)
+			}
+		}
+		settle(c.flush(), joined...)
+		clear(joined)
+		joined = joined[:0]
+	}
+}
+
+func (q *TunQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.closed) })
+	return q.file.Close()
+}
+
+func (q *TunQueue) LocalAddr() net.Addr {
+	return q.localAddr
+}
+
+func (q *TunQueue) RemoteAddr() net.Addr {
+	return &net.IPAddr{}
+}
+
+func (q *TunQueue) SetDeadline(deadline time.Time) error {
+	return nil
+}
+
+func (q *TunQueue) SetReadDeadline(deadline time.Time) error {
+	return nil
+}
+
+func (q *TunQueue) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
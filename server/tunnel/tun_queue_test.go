@@ -0,0 +1,58 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+)
+
+// TestTunQueueWriteErrors checks that a failed kernel write is returned by
+// the write whose packet it carried, on the queue and through a session
+func TestTunQueueWriteErrors(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	q := newTunQueue(writer, &net.IPAddr{}, true)
+	defer q.Close()
+
+	packet := tcpSegment(false, 1, 1, tcpACK, testPayload(100))
+	if _, err := q.Write(packet); err == nil {
+		t.Fatal("queue write succeeded without a reader")
+	}
+	if _, err := q.SessionConn().Write(packet); err == nil {
+		t.Fatal("session write succeeded without a reader")
+	}
+}
+
+// TestTunQueueSessionWrite checks that a session's packet is with the
+// kernel by the time its write returns
+func TestTunQueueSessionWrite(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	q := newTunQueue(writer, &net.IPAddr{}, true)
+	defer q.Close()
+
+	packet := tcpSegment(false, 1, 1, tcpACK|tcpPSH, testPayload(100))
+	if n, err := q.SessionConn().Write(packet); err != nil || n != len(packet) {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+
+	// The pipe keeps what was written even once the queue is closed
+	q.Close()
+	buffer := make([]byte, 2048)
+	n, err := reader.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer[virtioNetHdrLen:n], packet) {
+		t.Fatal("packet changed on the way to the kernel")
+	}
+}